@@ -54,7 +54,9 @@ var startCmd = &cobra.Command{
 
 		authService, err := auth.NewService(app)
 		if err != nil {
-			fmt.Printf("Error initializing auth service: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error initializing auth service: %v\n", err)
+			app.Close()
+			os.Exit(1)
 		}
 
 		for _, cfgUser := range cfg.Users {
@@ -70,7 +72,9 @@ var startCmd = &cobra.Command{
 		// T3 Chat
 		chatService, err := chat.NewService(app)
 		if err != nil {
-			fmt.Printf("Error initializing auth service: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error initializing chat service: %v\n", err)
+			app.Close()
+			os.Exit(1)
 		}
 
 		// Add all models from the config file
@@ -1,12 +1,17 @@
 package application
 
 import (
+	"context"
 	"database/sql"
 	_ "embed"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
@@ -21,6 +26,15 @@ type App struct {
 	Logger   *slog.Logger
 	Router   *mux.Router
 	Database *sql.DB
+
+	limiter       *rateLimiter
+	shutdownHooks []func(ctx context.Context)
+}
+
+// OnShutdown registers a function that is called when the app receives a termination signal,
+// before the HTTP server is shut down. ctx expires after the configured shutdown timeout.
+func (app *App) OnShutdown(fn func(ctx context.Context)) {
+	app.shutdownHooks = append(app.shutdownHooks, fn)
 }
 
 func NewApp(config Config) (*App, error) {
@@ -44,12 +58,26 @@ func NewApp(config Config) (*App, error) {
 		// Database is not initialized, run init SQL
 		_, err = db.Exec(initSQL)
 		if err != nil {
+			db.Close()
+			if strings.Contains(err.Error(), "fts5") {
+				return nil, fmt.Errorf("failed to initialize database, build with -tags sqlite_fts5: %w", err)
+			}
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+		// init.sql already contains the changes of all migrations
+		if _, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations))); err != nil {
 			db.Close()
 			return nil, fmt.Errorf("failed to initialize database: %w", err)
 		}
 	} else if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to check database initialization: %w", err)
+	} else if err = migrate(db); err != nil {
+		db.Close()
+		if strings.Contains(err.Error(), "fts5") {
+			return nil, fmt.Errorf("failed to migrate database, build with -tags sqlite_fts5: %w", err)
+		}
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	// Open the log file in append mode, create if it doesn't exist
@@ -117,12 +145,17 @@ func (app *App) Start() error {
 	// Add logging middleware to router
 	app.Router.Use(app.loggingMiddleware)
 
+	// Add rate limiting middleware, it runs after the auth middleware to limit users by their ID
+	app.limiter = newRateLimiter(app.Config.RateLimits)
+	app.Router.Use(app.rateLimitMiddleware)
+
 	// Setup CORS middleware
 	// TODO: use proper cors settings in production
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
 		AllowedHeaders: []string{"*"},
+		ExposedHeaders: []string{"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Next-Cursor"},
 	})
 
 	handler := c.Handler(app.Router)
@@ -132,7 +165,40 @@ func (app *App) Start() error {
 		Addr:    ":3141",
 	}
 
-	return server.ListenAndServe()
+	// Serve until the server fails or a termination signal is received
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		stop() // a second signal terminates immediately
+	}
+
+	fmt.Println("Shutting down app...")
+	app.Logger.Info("Shutting down", "timeout", app.Config.Server.ShutdownTimeout)
+
+	// Let the services finish their work before the connections are closed
+	hookCtx, cancel := context.WithTimeout(context.Background(), app.Config.Server.ShutdownTimeout)
+	defer cancel()
+	for _, fn := range app.shutdownHooks {
+		fn(hookCtx)
+	}
+
+	serverCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(serverCtx); err != nil {
+		app.Logger.Warn("Failed to shut down server gracefully", "error", err)
+		return err
+	}
+
+	return nil
 
 }
 
@@ -9,4 +9,6 @@ var (
 	ErrSessionUnverified  = errors.New("session not verified")
 	ErrSessionExpired     = errors.New("session is expired")
 	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrTokenNotFound      = errors.New("token not found")
+	ErrTokenExpired       = errors.New("token is expired")
 )
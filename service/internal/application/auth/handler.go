@@ -19,6 +19,9 @@ func (s *Service) Handle(r *mux.Router) {
 	router.HandleFunc("/login/", s.Login)
 	router.HandleFunc("/logout/", s.Logout)
 	router.HandleFunc("/session/", s.GetCurrentSession)
+	router.HandleFunc("/tokens/", s.ListAPITokens).Methods("GET")
+	router.HandleFunc("/tokens/", s.CreateAPIToken).Methods("POST")
+	router.HandleFunc("/tokens/{id}/", s.RevokeAPIToken).Methods("DELETE")
 
 }
 
@@ -148,3 +151,117 @@ func (s *Service) GetCurrentSession(w http.ResponseWriter, r *http.Request) {
 	})
 
 }
+
+// CreateTokenRequest represents a request to create an API token.
+type CreateTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`     // Any of "chat", "attachments" and "read_only"
+	ExpiresAt int64    `json:"expires_at"` // Unix Timestamp in milliseconds, 0 if the token should never expire
+}
+
+func (s *Service) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("Unauthorized request to create token handler")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var request CreateTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.log.Debug("Invalid create token request payload", "error", err)
+		http.Error(w, "invalid_request_payload", http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" {
+		http.Error(w, "name_required", http.StatusBadRequest)
+		return
+	}
+
+	scopes, ok := parseScopes(request.Scopes)
+	if !ok {
+		http.Error(w, "invalid_scopes", http.StatusBadRequest)
+		return
+	}
+
+	if request.ExpiresAt != 0 && request.ExpiresAt <= time.Now().UnixMilli() {
+		http.Error(w, "invalid_expires_at", http.StatusBadRequest)
+		return
+	}
+
+	token, err := s.CreateToken(r.Context(), userID, request.Name, scopes, request.ExpiresAt)
+	if err != nil {
+		s.log.Warn("Failed to create token", "user_id", userID, "error", err)
+		http.Error(w, "failed_create_token", http.StatusInternalServerError)
+		return
+	}
+
+	// The token is only returned once, the client has to store it
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{
+		"token": token,
+	})
+
+}
+
+func (s *Service) ListAPITokens(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("Unauthorized request to list tokens handler")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := s.ListTokens(r.Context(), userID)
+	if err != nil {
+		s.log.Warn("Failed to list tokens", "user_id", userID, "error", err)
+		http.Error(w, "failed_list_tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"tokens": tokens,
+	})
+
+}
+
+func (s *Service) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("Unauthorized request to revoke token handler")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	tokenID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.log.Debug("Invalid token id", "error", err)
+		http.Error(w, "invalid_id", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DeleteToken(r.Context(), userID, tokenID); err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			http.Error(w, "token_not_found", http.StatusNotFound)
+		} else {
+			s.log.Warn("Failed to revoke token", "token_id", tokenID, "error", err)
+			http.Error(w, "failed_revoke_token", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{})
+
+}
@@ -3,15 +3,36 @@ package auth
 import (
 	"context"
 	"net/http"
+	"slices"
 	"strings"
+
+	"github.com/gorilla/websocket"
 )
 
+// queryTokenRoutes are the path prefixes of the EventSource routes, which accept the token as a query parameter.
+var queryTokenRoutes = []string{"/v1/streams/", "/v1/events/"}
+
 func (s *Service) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Get the Authorization header
 		authHeader := r.Header.Get("Authorization")
 
+		// Browsers cannot set headers on WebSockets, they offer the token as a subprotocol ("bearer", "<token>")
+		if authHeader == "" {
+			if protocols := websocket.Subprotocols(r); len(protocols) == 2 && protocols[0] == "bearer" {
+				authHeader = "Bearer " + protocols[1]
+			}
+		}
+
+		// EventSource cannot set headers either, it passes the token as a query parameter. Other routes
+		// do not accept it, as URLs end up in logs and the browser history.
+		if authHeader == "" && slices.ContainsFunc(queryTokenRoutes, func(prefix string) bool { return strings.HasPrefix(r.URL.Path, prefix) }) {
+			if token := r.URL.Query().Get("access_token"); token != "" {
+				authHeader = "Bearer " + token
+			}
+		}
+
 		if authHeader == "" {
 			s.log.Debug("No authorization header provided")
 			next.ServeHTTP(w, r)
@@ -27,6 +48,28 @@ func (s *Service) AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		sessionToken := parts[1]
+
+		// API tokens are limited to the routes their scopes allow
+		if strings.HasPrefix(sessionToken, TokenPrefix) {
+			token, err := s.AuthorizeToken(r.Context(), sessionToken)
+			if err != nil {
+				s.log.Debug("Failed to authorize token", "token_prefix", sessionToken[:min(len(sessionToken), len(TokenPrefix)+8)], "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !token.Allows(r) {
+				s.log.Debug("Token scopes do not allow request", "token_id", token.ID, "path", r.URL.Path)
+				http.Error(w, "insufficient_scope", http.StatusForbidden)
+				return
+			}
+			s.log.Info("Authorized token", "user_id", token.UserID, "token_id", token.ID)
+			ctx := r.Context()
+			ctx = context.WithValue(ctx, "user_id", token.UserID)
+			ctx = context.WithValue(ctx, "token_id", token.ID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		if len(sessionToken) == 0 {
 			s.log.Debug("No session token provided", "auth_header", authHeader)
 			next.ServeHTTP(w, r)
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+	app, err := application.NewApp(application.Config{Logging: application.LoggingConfig{LogFilePath: "app.log"}})
+	if err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skip("database tests need -tags sqlite_fts5")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+
+	s, err := NewService(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMiddlewareTokenScopes(t *testing.T) {
+
+	s := newTestService(t)
+	userID := uuid.New()
+	token, err := s.CreateToken(context.Background(), userID, "Reader", []string{ScopeReadOnly}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/v1/chats/", http.StatusOK},
+		{"POST", "/v1/chats/", http.StatusForbidden},
+		{"GET", "/v1/admin/streams/", http.StatusForbidden},
+		{"GET", "/v1/admin/stats/models/", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+
+		var got uuid.UUID
+		handler := s.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = r.Context().Value("user_id").(uuid.UUID)
+		}))
+
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+token.Token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		if tt.status == http.StatusOK && got != userID {
+			t.Errorf("%s %s: got user %v, want %v", tt.method, tt.path, got, userID)
+		}
+
+	}
+
+}
+
+// Only the EventSource routes accept the token as a query parameter.
+func TestMiddlewareQueryToken(t *testing.T) {
+
+	s := newTestService(t)
+	userID := uuid.New()
+	token, err := s.CreateToken(context.Background(), userID, "Events", []string{ScopeChat}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/v1/events/", true},
+		{"/v1/streams/" + uuid.NewString() + "/", true},
+		{"/v1/chats/", false},
+		{"/v1/ws/", false},
+	}
+
+	for _, tt := range tests {
+
+		var got uuid.UUID
+		handler := s.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = r.Context().Value("user_id").(uuid.UUID)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path+"?access_token="+token.Token, nil))
+
+		if (got == userID) != tt.want {
+			t.Errorf("%s: got user %v, want authenticated %v", tt.path, got, tt.want)
+		}
+
+	}
+
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenPrefix marks API tokens, so they can be told apart from session tokens.
+const TokenPrefix = "t3c_"
+
+// Scopes limit what an API token can be used for.
+const (
+	ScopeChat        = "chat"        // Chats, streams and the compatible APIs
+	ScopeAttachments = "attachments" // Uploading and managing attachments
+	ScopeReadOnly    = "read_only"   // Reading everything but the excluded routes
+)
+
+// readOnlyExcluded are the path prefixes the read only scope does not grant access to. The profile
+// contains the user's provider keys, WebSocket clients can send messages once connected, and the
+// admin endpoints show the streams of all users.
+var readOnlyExcluded = []string{"/v1/profile/", "/v1/ws/", "/v1/admin/"}
+
+// scopeRoutes are the path prefixes a scope grants full access to.
+var scopeRoutes = map[string][]string{
+	ScopeChat:        {"/v1/chats/", "/v1/chat/", "/v1/streams/", "/v1/events/", "/v1/ws/", "/v1/models", "/v1/share/", "/v1/search/", "/v1/projects/", "/api/"},
+	ScopeAttachments: {"/v1/attachments/"},
+}
+
+// APIToken represents a long-lived token for programmatic access.
+type APIToken struct {
+	ID     uuid.UUID `json:"id"`              // Unique identifier for the token.
+	UserID uuid.UUID `json:"user_id"`         // Unique identifier of the user the token acts for.
+	Name   string    `json:"name"`            // Name chosen by the user to recognize the token.
+	Prefix string    `json:"prefix"`          // Beginning of the token, shown in listings instead of the token itself.
+	Token  string    `json:"token,omitempty"` // The token, only returned once on creation. Only its hash is stored.
+	Scopes []string  `json:"scopes"`          // What the token can be used for.
+
+	CreatedAt  int64 `json:"created_at"`   // The time the token was created as Unix Timestamp
+	ExpiresAt  int64 `json:"expires_at"`   // The time the token expires as Unix Timestamp, 0 if it never expires
+	LastUsedAt int64 `json:"last_used_at"` // The time the token was last used as Unix Timestamp, 0 if never
+}
+
+// Allows reports whether the token's scopes permit the request.
+// The auth endpoints are never accessible with an API token.
+func (t *APIToken) Allows(r *http.Request) bool {
+
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1/auth/") {
+		return false
+	}
+
+	for _, scope := range t.Scopes {
+		if scope == ScopeReadOnly && (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+			!slices.ContainsFunc(readOnlyExcluded, func(prefix string) bool { return strings.HasPrefix(path, prefix) }) {
+			return true
+		}
+		for _, prefix := range scopeRoutes[scope] {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+
+}
+
+// hashToken returns the hash of an API token as stored in the database.
+// Tokens are random, so a fast hash suffices and allows looking them up.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Service) CreateToken(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt int64) (*APIToken, error) {
+
+	tokenID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new 256bit token from crypto random bytes
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	tokenString := TokenPrefix + hex.EncodeToString(secret)
+
+	var token = APIToken{
+		ID:        tokenID,
+		UserID:    userID,
+		Name:      name,
+		Prefix:    tokenString[:len(TokenPrefix)+8],
+		Token:     tokenString,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UnixMilli(),
+		ExpiresAt: expiresAt,
+	}
+
+	// Insert new token into database
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO api_tokens (
+			id, user_id, name, prefix, token_hash, scopes,
+			created_at, expires_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+		token.ID, token.UserID, token.Name, token.Prefix, hashToken(tokenString), strings.Join(token.Scopes, ","),
+		token.CreatedAt, token.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+
+}
+
+func (s *Service) ListTokens(ctx context.Context, userID uuid.UUID) ([]APIToken, error) {
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = ?
+		ORDER BY created_at DESC;`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var token APIToken
+		var scopes string
+		if err := rows.Scan(
+			&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes,
+			&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt,
+		); err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+
+}
+
+func (s *Service) DeleteToken(ctx context.Context, userID, tokenID uuid.UUID) error {
+
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM api_tokens WHERE id = ? AND user_id = ?;`,
+		tokenID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+
+}
+
+// AuthorizeToken returns the API token with the given value if it exists and did not expire.
+func (s *Service) AuthorizeToken(ctx context.Context, tokenString string) (*APIToken, error) {
+
+	var token APIToken
+	var scopes string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, user_id, name, prefix, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE token_hash = ?;`,
+		hashToken(tokenString),
+	).Scan(
+		&token.ID, &token.UserID, &token.Name, &token.Prefix, &scopes,
+		&token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+
+	now := time.Now().UnixMilli()
+	if token.ExpiresAt > 0 && now >= token.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	// Failing to record the usage should not fail the request
+	if _, err := s.db.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, token.ID); err != nil {
+		s.log.Warn("Failed to update token usage", "token_id", token.ID, "error", err)
+	}
+
+	return &token, nil
+
+}
+
+// parseScopes removes duplicate scopes and reports whether all of them are known.
+func parseScopes(scopes []string) ([]string, bool) {
+	var parsed []string
+	for _, scope := range scopes {
+		if scope != ScopeChat && scope != ScopeAttachments && scope != ScopeReadOnly {
+			return nil, false
+		}
+		if !slices.Contains(parsed, scope) {
+			parsed = append(parsed, scope)
+		}
+	}
+	return parsed, len(parsed) > 0
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+
+	tests := []struct {
+		scopes       []string
+		method, path string
+		want         bool
+	}{
+		{[]string{ScopeChat}, "POST", "/v1/chats/", true},
+		{[]string{ScopeChat}, "GET", "/v1/events/", true},
+		{[]string{ScopeChat}, "GET", "/v1/ws/", true},
+		{[]string{ScopeChat}, "POST", "/v1/attachments/", false},
+		{[]string{ScopeChat}, "GET", "/v1/profile/", false},
+		{[]string{ScopeAttachments}, "POST", "/v1/attachments/", true},
+		{[]string{ScopeAttachments}, "GET", "/v1/events/", false},
+		{[]string{ScopeReadOnly}, "GET", "/v1/chats/", true},
+		{[]string{ScopeReadOnly}, "GET", "/v1/events/", true},
+		{[]string{ScopeReadOnly}, "DELETE", "/v1/chats/x/", false},
+		{[]string{ScopeReadOnly}, "GET", "/v1/profile/", false},
+		{[]string{ScopeReadOnly}, "GET", "/v1/ws/", false},
+		{[]string{ScopeReadOnly}, "GET", "/v1/admin/streams/", false},
+		{[]string{ScopeChat, ScopeReadOnly}, "GET", "/v1/auth/tokens/", false},
+	}
+
+	for _, tt := range tests {
+		token := &APIToken{Scopes: tt.scopes}
+		if got := token.Allows(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%v %s %s: got %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+		}
+	}
+
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+type ModelStats struct {
+	Model                 string  `json:"model"`
+	Messages              int64   `json:"messages"`
+	AvgTimeToFirstToken   float64 `json:"avg_ttft_ms"`
+	AvgTimeToFirstContent float64 `json:"avg_ttfc_ms"`
+	AvgDuration           float64 `json:"avg_duration_ms"`
+	AvgTokensPerSecond    float64 `json:"avg_tokens_per_second"`
+	TotalOutputTokens     int64   `json:"total_output_tokens"`
+}
+
+// isAdmin reports whether the user is listed as an admin in the config.
+func (s *Service) isAdmin(userID uuid.UUID) bool {
+	var username string
+	err := s.db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err != nil {
+		s.log.Debug("failed to get username", "user_id", userID, "error", err)
+		return false
+	}
+	return slices.Contains(s.cfg.Admins, username)
+}
+
+func (s *Service) GetModelStats(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		s.log.Debug("User is not an admin", "user_id", userID)
+		http.Error(w, "not_authorized", http.StatusForbidden)
+		return
+	}
+
+	// Only include messages created after the optional since timestamp (unix millis)
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid_since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.Query(`
+		SELECT
+			model, COUNT(*),
+			AVG(ttft_ms), AVG(ttfc_ms), AVG(duration_ms), AVG(tokens_per_second),
+			SUM(output_tokens)
+		FROM messages
+		WHERE role = 'assistant' AND status = 'done' AND duration_ms > 0 AND created_at >= ?
+		GROUP BY model
+		ORDER BY model ASC`,
+		since,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	stats := make([]ModelStats, 0)
+	for rows.Next() {
+		var stat ModelStats
+		if err := rows.Scan(
+			&stat.Model, &stat.Messages,
+			&stat.AvgTimeToFirstToken, &stat.AvgTimeToFirstContent, &stat.AvgDuration, &stat.AvgTokensPerSecond,
+			&stat.TotalOutputTokens,
+		); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stats = append(stats, stat)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+// ListStreams lists the streams in the pool, including finished streams that were not evicted yet.
+func (s *Service) ListStreams(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		s.log.Debug("User is not an admin", "user_id", userID)
+		http.Error(w, "not_authorized", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.sp.List()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+func (s *Service) GetStreamStats(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.isAdmin(userID) {
+		s.log.Debug("User is not an admin", "user_id", userID)
+		http.Error(w, "not_authorized", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.sp.Stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
@@ -1,17 +1,29 @@
 package chat
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 type Attachment struct {
 	ID        uuid.UUID `json:"id,omitzero"`
 	UserId    uuid.UUID `json:"user_id,omitzero"`
@@ -109,24 +121,60 @@ func (s *Service) UploadAttachment(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
+	// Store the uploaded file as a new attachment, it is linked to a message once it is sent
+	attachment, err := s.saveAttachment(userID, uuid.UUID{}, header.Filename, header.Header.Get("Content-Type"), file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(attachment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+// saveAttachment creates an attachment record and saves its data to disk.
+func (s *Service) saveAttachment(userID, messageID uuid.UUID, name, mimeType string, data io.Reader) (*Attachment, error) {
+	return s.saveAttachmentTx(s.db, userID, messageID, name, mimeType, data)
+}
+
+// saveAttachmentTx is saveAttachment with the record created by db, e.g. a transaction.
+// The file is written either way and has to be removed if the transaction is rolled back.
+func (s *Service) saveAttachmentTx(db execer, userID, messageID uuid.UUID, name, mimeType string, data io.Reader) (*Attachment, error) {
+
 	// Create attachment record
 	now := time.Now()
 	attachment := Attachment{
 		ID:        uuid.New(),
 		UserId:    userID,
-		Name:      header.Filename,
-		Type:      header.Header.Get("Content-Type"),
+		MessageID: messageID,
+		Name:      name,
+		Type:      mimeType,
 		CreatedAt: now.UnixMilli(),
 	}
 
 	attachment.Src = fmt.Sprintf("%s/v1/attachments/%s/", os.Getenv("PUBLIC_API_URL"), attachment.ID) // TODO: Replace with proper location
 
+	// Keep the text of text based attachments, so they can be found by search
+	var text string
+	if chat.IsText(mimeType) {
+		buf, err := io.ReadAll(data)
+		if err != nil {
+			return nil, err
+		}
+		text = excerpt(strings.ToValidUTF8(string(buf), ""), attachmentTextLimit)
+		data = bytes.NewReader(buf)
+	}
+
 	// Save to database
-	_, err = s.db.Exec("INSERT INTO attachments (id, user_id, message_id, name, type, src, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		attachment.ID, attachment.UserId, attachment.MessageID, attachment.Name, attachment.Type, attachment.Src, attachment.CreatedAt)
+	_, err := db.Exec("INSERT INTO attachments (id, user_id, message_id, name, type, src, text, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		attachment.ID, attachment.UserId, attachment.MessageID, attachment.Name, attachment.Type, attachment.Src, text, attachment.CreatedAt)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Create attachments directory if it doesn't exist
@@ -135,24 +183,91 @@ func (s *Service) UploadAttachment(w http.ResponseWriter, r *http.Request) {
 	// Save file to disk
 	dst, err := os.Create(fmt.Sprintf("data/users/%s/attachments/%s", userID, attachment.ID))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	_, err = io.Copy(dst, data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(attachment); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	return &attachment, nil
+
+}
+
+// copyLinkedAttachments replaces the attachments that already belong to another message with
+// copies, so sending them again, e.g. with an edited version of a message, leaves the earlier
+// message its files. Unknown attachments are kept and ignored when the message is linked.
+func (s *Service) copyLinkedAttachments(attachmentIDs []uuid.UUID, messageID, userID uuid.UUID) ([]uuid.UUID, error) {
+
+	ids := slices.Clone(attachmentIDs)
+	for i, id := range ids {
+
+		var name, mimeType, linkedID string
+		err := s.db.QueryRow("SELECT name, type, message_id FROM attachments WHERE id = ? AND user_id = ?", id, userID).
+			Scan(&name, &mimeType, &linkedID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if linked, _ := uuid.Parse(linkedID); linked == uuid.Nil || linked == messageID {
+			continue
+		}
+
+		data, err := getAttachmentData(userID, id)
+		if err != nil {
+			return nil, err
+		}
+		attachment, err := s.saveAttachment(userID, uuid.UUID{}, name, mimeType, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = attachment.ID
+
 	}
 
+	return ids, nil
+
+}
+
+// storeImages returns an interceptor that stores images generated by the model as
+// attachments of the assistant message, so subscribers receive a link instead of the data.
+func (s *Service) storeImages(userID, messageID uuid.UUID) stream.Interceptor {
+	return stream.InterceptorFunc(func(c stream.Chunk) ([]stream.Chunk, error) {
+		for i, block := range c.Blocks {
+			if block.Type != "image" || block.Data == nil {
+				continue
+			}
+			name := fmt.Sprintf("image-%d%s", time.Now().UnixMilli(), imageExtension(block.MimeType))
+			attachment, err := s.saveAttachment(userID, messageID, name, block.MimeType, bytes.NewReader(block.Data))
+			if err != nil {
+				s.log.Error("failed to store generated image", "message_id", messageID, "error", err)
+				continue
+			}
+			c.Blocks[i].Data = nil
+			c.Blocks[i].AttachmentID = attachment.ID.String()
+			c.Blocks[i].Src = attachment.Src
+		}
+		return []stream.Chunk{c}, nil
+	})
+}
+
+func imageExtension(mimeType string) string {
+	switch mimeType {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ""
+	}
 }
 
 func (s *Service) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Sending the attachments of a message again, as editing it does, must not take them away from it.
+func TestLinkAttachmentsTwice(t *testing.T) {
+
+	s := newTestService(t)
+	userID, original, edited := uuid.New(), uuid.New(), uuid.New()
+
+	attachment, err := s.saveAttachment(userID, uuid.UUID{}, "notes.txt", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, messageID := range []uuid.UUID{original, edited} {
+		linked, err := s.loadAndUpdateAttachments([]uuid.UUID{attachment.ID}, messageID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(linked) != 1 {
+			t.Fatalf("message %s: got %d attachments, want 1", messageID, len(linked))
+		}
+	}
+
+	tests := []struct {
+		name      string
+		messageID uuid.UUID
+	}{
+		{"original", original},
+		{"edited", edited},
+	}
+
+	for _, tt := range tests {
+
+		var id uuid.UUID
+		err := s.db.QueryRow("SELECT id FROM attachments WHERE message_id = ?", tt.messageID).Scan(&id)
+		if err != nil {
+			t.Fatalf("%s message has no attachment: %v", tt.name, err)
+		}
+		if (id == attachment.ID) != (tt.messageID == original) {
+			t.Errorf("%s message got attachment %s, original attachment is %s", tt.name, id, attachment.ID)
+		}
+
+		data, err := getAttachmentData(userID, id)
+		if err != nil || string(data) != "hello" {
+			t.Errorf("%s message: got data %q and error %v", tt.name, data, err)
+		}
+
+	}
+
+}
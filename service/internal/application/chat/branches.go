@@ -0,0 +1,320 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Messages form a tree: each message points to the message it follows. Editing a user message or
+// regenerating a response adds a sibling instead of replacing it, and the chat remembers the last
+// message of the branch the user is looking at.
+
+var (
+	errChatNotFound    = errors.New("chat not found")
+	errMessageNotFound = errors.New("message not found")
+)
+
+// parentString returns the value stored in parent_id, which is empty for the first message.
+func parentString(parentID uuid.UUID) string {
+	if parentID == uuid.Nil {
+		return ""
+	}
+	return parentID.String()
+}
+
+// activeLeaf returns the last message of the active branch. Chats created before branches
+// existed have no active message, their latest message is used instead.
+func (c *Chat) activeLeaf() uuid.UUID {
+	if c.ActiveMessageID != uuid.Nil && slices.ContainsFunc(c.Messages, func(m Message) bool { return m.ID == c.ActiveMessageID }) {
+		return c.ActiveMessageID
+	}
+	if len(c.Messages) == 0 {
+		return uuid.Nil
+	}
+	return c.Messages[len(c.Messages)-1].ID
+}
+
+// branch returns the messages from the first message up to leafID, with their siblings set.
+// c.Messages must contain all messages of the chat ordered by creation.
+func (c *Chat) branch(leafID uuid.UUID) []Message {
+
+	byID := make(map[uuid.UUID]int, len(c.Messages))
+	children := make(map[uuid.UUID][]uuid.UUID)
+	for i, m := range c.Messages {
+		byID[m.ID] = i
+		children[m.ParentID] = append(children[m.ParentID], m.ID)
+	}
+
+	branch := []Message{}
+	seen := make(map[uuid.UUID]bool)
+	for id := leafID; id != uuid.Nil && !seen[id]; {
+		i, ok := byID[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		branch = append(branch, c.Messages[i])
+		id = c.Messages[i].ParentID
+	}
+	slices.Reverse(branch)
+
+	for i := range branch {
+		siblings := children[branch[i].ParentID]
+		branch[i].Siblings = siblings
+		branch[i].SiblingCount = len(siblings)
+		branch[i].SiblingIndex = slices.Index(siblings, branch[i].ID)
+	}
+
+	return branch
+
+}
+
+// latestLeaf follows the most recent replies from messageID to the end of its branch.
+func (c *Chat) latestLeaf(messageID uuid.UUID) uuid.UUID {
+
+	latest := make(map[uuid.UUID]uuid.UUID)
+	for _, m := range c.Messages {
+		latest[m.ParentID] = m.ID // Messages are ordered by creation, the last one wins
+	}
+
+	seen := map[uuid.UUID]bool{messageID: true}
+	for {
+		child, ok := latest[messageID]
+		if !ok || seen[child] {
+			return messageID
+		}
+		seen[child] = true
+		messageID = child
+	}
+
+}
+
+// switchBranch makes the branch containing messageID the active one. If the message has
+// replies, the branch continues with the most recent of them.
+func (s *Service) switchBranch(chatID, userID, messageID uuid.UUID) error {
+
+	c, err := s.loadChat(chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(c.Messages, func(m Message) bool { return m.ID == messageID }) {
+		return errMessageNotFound
+	}
+
+	_, err = s.db.Exec("UPDATE chats SET active_message_id = ?, updated_at = ? WHERE id = ? AND user_id = ?",
+		c.latestLeaf(messageID), time.Now().UnixMilli(), chatID, userID,
+	)
+	return err
+
+}
+
+// findMessage returns the message with the given ID from all messages of the chat.
+func (c *Chat) findMessage(messageID uuid.UUID) (*Message, bool) {
+	i := slices.IndexFunc(c.Messages, func(m Message) bool { return m.ID == messageID })
+	if i < 0 {
+		return nil, false
+	}
+	return &c.Messages[i], true
+}
+
+// editMessage adds a new version of a user message next to the original and starts the assistant's
+// response to it. The original message and its replies are kept on their own branch.
+func (s *Service) editMessage(chatID, userID, messageID uuid.UUID, body ChatCompletionRequest) (uuid.UUID, uuid.UUID, error) {
+
+	c, err := s.loadChat(chatID, userID)
+	if errors.Is(err, errChatNotFound) {
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusNotFound, "chat_not_found"}
+	} else if err != nil {
+		s.log.Debug("failed to get chat", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_chat_failed"}
+	}
+
+	original, ok := c.findMessage(messageID)
+	if !ok {
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusNotFound, "message_not_found"}
+	}
+	if original.Role != "user" {
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusBadRequest, "not_a_user_message"}
+	}
+
+	if body.Model == "" {
+		body.Model = c.Model
+	}
+
+	model, profile, err := s.prepareCompletion(userID, body, false)
+	if err != nil {
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+
+	// The new version sees the history the original message was sent with
+	parentID := original.ParentID
+	c.Messages = c.branch(parentID)
+
+	messages, err := c.ModelMessages(model, s.mr)
+	if err != nil {
+		s.log.Debug("failed to get chat messages", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_messages_failed"}
+	}
+
+	newID, message, err := s.newUserMessage(chatID, userID, parentID, body)
+	if err != nil {
+		s.log.Warn("failed to create user message", "error", err)
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "create_user_message_failed"}
+	}
+
+	streamID, err := s.startCompletion(chatID, userID, newID, body, model, profile, append(messages, message))
+	if err != nil {
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+
+	return newID, streamID, nil
+
+}
+
+// regenerateMessage adds a new response next to an assistant message, optionally from another model.
+func (s *Service) regenerateMessage(chatID, userID, messageID uuid.UUID, body ChatCompletionRequest) (uuid.UUID, error) {
+
+	c, err := s.loadChat(chatID, userID)
+	if errors.Is(err, errChatNotFound) {
+		return uuid.UUID{}, &requestError{http.StatusNotFound, "chat_not_found"}
+	} else if err != nil {
+		s.log.Debug("failed to get chat", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_chat_failed"}
+	}
+
+	original, ok := c.findMessage(messageID)
+	if !ok {
+		return uuid.UUID{}, &requestError{http.StatusNotFound, "message_not_found"}
+	}
+	if original.Role != "assistant" {
+		return uuid.UUID{}, &requestError{http.StatusBadRequest, "not_an_assistant_message"}
+	}
+
+	if body.Model == "" {
+		body.Model = original.Model
+	}
+
+	model, profile, err := s.prepareCompletion(userID, body, false)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	// The response is regenerated for the history up to the message it answered
+	parentID := original.ParentID
+	c.Messages = c.branch(parentID)
+
+	messages, err := c.ModelMessages(model, s.mr)
+	if err != nil {
+		s.log.Debug("failed to get chat messages", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_messages_failed"}
+	}
+
+	return s.startCompletion(chatID, userID, parentID, body, model, profile, messages)
+
+}
+
+func (s *Service) EditMessage(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	chatID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.log.Debug("invalid uuid", "error", err)
+		http.Error(w, "invalid_id", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["message_id"])
+	if err != nil {
+		s.log.Debug("invalid uuid", "error", err)
+		http.Error(w, "invalid_message_id", http.StatusBadRequest)
+		return
+	}
+
+	var body ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		http.Error(w, "failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	newID, streamID, err := s.editMessage(chatID, userID, messageID, body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"message_id": newID,
+		"stream_id":  streamID,
+	}); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
+
+func (s *Service) RegenerateMessage(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	chatID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.log.Debug("invalid uuid", "error", err)
+		http.Error(w, "invalid_id", http.StatusBadRequest)
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["message_id"])
+	if err != nil {
+		s.log.Debug("invalid uuid", "error", err)
+		http.Error(w, "invalid_message_id", http.StatusBadRequest)
+		return
+	}
+
+	// Model and reasoning effort are optional, the content is ignored
+	var body ChatCompletionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			s.log.Debug("failed to decode request body", "error", err)
+			http.Error(w, "failed to decode request body", http.StatusBadRequest)
+			return
+		}
+	}
+	body.Content, body.Attachments = "", nil
+
+	streamID, err := s.regenerateMessage(chatID, userID, messageID, body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"stream_id": streamID,
+	}); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
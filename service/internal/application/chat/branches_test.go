@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// tree builds a chat from messages given as "id:parent" pairs in creation order,
+// with IDs derived from the names for readable failures.
+func tree(active string, messages ...[2]string) (*Chat, map[uuid.UUID]string) {
+	id := func(name string) uuid.UUID {
+		if name == "" {
+			return uuid.Nil
+		}
+		return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name))
+	}
+	c := &Chat{ActiveMessageID: id(active)}
+	names := map[uuid.UUID]string{}
+	for _, m := range messages {
+		c.Messages = append(c.Messages, Message{ID: id(m[0]), ParentID: id(m[1])})
+		names[id(m[0])] = m[0]
+	}
+	return c, names
+}
+
+func TestBranch(t *testing.T) {
+
+	// a ─ b ─ c
+	//   └ d ─ e   (d is an edit of b)
+	messages := [][2]string{{"a", ""}, {"b", "a"}, {"c", "b"}, {"d", "a"}, {"e", "d"}}
+
+	tests := []struct {
+		name     string
+		active   string
+		messages [][2]string
+		branch   []string
+		siblings []int // Sibling index of each message on the branch
+		count    []int
+	}{
+		{"active branch", "c", messages, []string{"a", "b", "c"}, []int{0, 0, 0}, []int{1, 2, 1}},
+		{"edited branch", "e", messages, []string{"a", "d", "e"}, []int{0, 1, 0}, []int{1, 2, 1}},
+		{"no active message", "", messages, []string{"a", "d", "e"}, []int{0, 1, 0}, []int{1, 2, 1}},
+		{"unknown active message", "x", messages, []string{"a", "d", "e"}, []int{0, 1, 0}, []int{1, 2, 1}},
+		{"empty chat", "", nil, []string{}, []int{}, []int{}},
+		{"cycle", "b", [][2]string{{"a", "b"}, {"b", "a"}}, []string{"a", "b"}, []int{0, 0}, []int{1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c, names := tree(tt.active, tt.messages...)
+			branch := c.branch(c.activeLeaf())
+
+			got := make([]string, len(branch))
+			siblings := make([]int, len(branch))
+			count := make([]int, len(branch))
+			for i, m := range branch {
+				got[i], siblings[i], count[i] = names[m.ID], m.SiblingIndex, m.SiblingCount
+			}
+			if !slices.Equal(got, tt.branch) {
+				t.Errorf("got branch %v, want %v", got, tt.branch)
+			}
+			if !slices.Equal(siblings, tt.siblings) || !slices.Equal(count, tt.count) {
+				t.Errorf("got sibling indexes %v of %v, want %v of %v", siblings, count, tt.siblings, tt.count)
+			}
+
+		})
+	}
+
+}
+
+func TestLatestLeaf(t *testing.T) {
+
+	// a ─ b ─ c
+	//   └ d ─ e ─ f
+	//       └ g   (g is a regenerated response to d)
+	c, names := tree("", [2]string{"a", ""}, [2]string{"b", "a"}, [2]string{"c", "b"},
+		[2]string{"d", "a"}, [2]string{"e", "d"}, [2]string{"f", "e"}, [2]string{"g", "d"})
+
+	tests := []struct {
+		from, want string
+	}{
+		{"a", "g"},
+		{"b", "c"},
+		{"c", "c"},
+		{"d", "g"},
+		{"e", "f"},
+	}
+
+	for _, tt := range tests {
+		var from uuid.UUID
+		for id, name := range names {
+			if name == tt.from {
+				from = id
+			}
+		}
+		if got := names[c.latestLeaf(from)]; got != tt.want {
+			t.Errorf("from %s: got %s, want %s", tt.from, got, tt.want)
+		}
+	}
+
+}
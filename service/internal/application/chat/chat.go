@@ -1,10 +1,13 @@
 package chat
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
@@ -22,7 +25,10 @@ type Chat struct {
 	LastMessageAt int64  `json:"last_message_at"`
 	SharedAt      int64  `json:"shared_at"`
 
-	Messages []Message `json:"messages"`
+	ProjectID       uuid.UUID `json:"project_id,omitzero"`        // Empty if the chat is not part of a project
+	ActiveMessageID uuid.UUID `json:"active_message_id,omitzero"` // Last message of the active branch
+	Messages        []Message `json:"messages"`                   // Messages of the active branch
+	HasMore         bool      `json:"has_more,omitempty"`         // Set if earlier messages were not loaded
 }
 
 type Message struct {
@@ -30,22 +36,33 @@ type Message struct {
 	ChatID   uuid.UUID `json:"chat_id,omitzero"`
 	UserID   uuid.UUID `json:"user_id,omitzero"`
 	StreamID uuid.UUID `json:"stream_id,omitzero"`
+	ParentID uuid.UUID `json:"parent_id,omitzero"` // Previous message on the branch
 
 	Role      string `json:"role"`
 	Model     string `json:"model"`
 	Content   string `json:"content"`
 	Reasoning string `json:"reasoning,omitempty"`
 
-	Status    string `json:"status"` // e.g. "streaming", "done", "error"
+	Blocks          []stream.Block        `json:"blocks,omitempty"` // Code, execution results and images, positioned by their offset in the content
+	ReasoningBlocks []chat.ReasoningBlock `json:"-"`                // Replayed to the provider that created them
+
+	Status    string `json:"status"` // e.g. "queued", "streaming", "done", "error", "aborted", "interrupted"
 	CreatedAt int64  `json:"created_at"`
 	UpdatedAt int64  `json:"updated_at"`
 
 	Attachments []Attachment `json:"attachments"`
+
+	// Messages with the same parent are alternative versions, e.g. after an edit or a regeneration
+	SiblingIndex int         `json:"sibling_index"`
+	SiblingCount int         `json:"sibling_count"`
+	Siblings     []uuid.UUID `json:"siblings,omitempty"` // IDs of all versions, ordered by creation
 }
 
 type ChatListItem struct {
 	ID            uuid.UUID `json:"id,omitzero"`
+	ProjectID     uuid.UUID `json:"project_id,omitzero"`
 	Title         string    `json:"title"`
+	Model         string    `json:"model"`
 	IsPinned      bool      `json:"is_pinned"`
 	Status        string    `json:"status"`
 	LastMessageAt int64     `json:"last_message_at"`
@@ -58,6 +75,9 @@ type PatchChatRequest struct {
 	IsPinned *bool   `json:"is_pinned,omitempty"`
 	Model    *string `json:"model,omitempty"`
 	SharedAt *int64  `json:"shared_at,omitempty"`
+
+	ActiveMessageID *uuid.UUID `json:"active_message_id,omitempty"` // Switch to the latest branch containing this message
+	ProjectID       *uuid.UUID `json:"project_id,omitempty"`        // Move to this project, or out of its project if zero
 }
 
 func (s *Service) ListChats(w http.ResponseWriter, r *http.Request) {
@@ -70,29 +90,23 @@ func (s *Service) ListChats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chats := make([]ChatListItem, 0)
-
-	rows, err := s.db.Query("SELECT id, title, is_pinned, status, last_message_at, created_at, shared_at FROM chats WHERE user_id = ?", userID)
+	query, err := parseChatQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.log.Debug("invalid chat query", "error", err)
+		writeError(w, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var chat ChatListItem
-		if err := rows.Scan(&chat.ID, &chat.Title, &chat.IsPinned, &chat.Status, &chat.LastMessageAt, &chat.CreatedAt, &chat.SharedAt); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		chats = append(chats, chat)
-	}
 
-	if err := rows.Err(); err != nil {
+	chats, next, err := s.listChats(userID, query)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(chats); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -111,118 +125,41 @@ func (s *Service) GetChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := mux.Vars(r)["id"]
-
-	query := `
-        SELECT
-            c.id, c.user_id, c.title, c.model, c.is_pinned, c.status, c.last_message_at, c.created_at, c.updated_at,
-            m.id, m.stream_id, m.role, m.model, m.content, m.reasoning, m.status, m.created_at, m.updated_at,
-            a.id, a.name, a.type, a.src, a.created_at
-        FROM chats c
-        LEFT JOIN messages m ON c.id = m.chat_id
-        LEFT JOIN attachments a ON m.id = a.message_id
-        WHERE c.id = ? AND c.user_id = ?
-        ORDER BY m.created_at ASC, a.created_at ASC
-    `
-
-	rows, err := s.db.Query(query, id, userID)
+	chatID, err := uuid.Parse(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Chat not found", http.StatusNotFound)
 		return
 	}
-	defer rows.Close()
 
+	// Long chats can be loaded in pages, starting with the latest messages
 	var chat *Chat
-	messages := make(map[string]*Message)
-
-	for rows.Next() {
-		var (
-			// Chat fields
-			cID, cUserID, cTitle, cModel, cStatus  string
-			cIsPinned                              int
-			cLastMessageAt, cCreatedAt, cUpdatedAt int64
-			// Message fields (nullable)
-			mID, mStreamID, mRole, mModel, mContent, mReasoning, mStatus sql.NullString
-			mCreatedAt, mUpdatedAt, aCreatedAt                           sql.NullInt64
-			// Attachment fields (nullable)
-			aID, aName, aType, aSrc sql.NullString
-		)
-
-		err := rows.Scan(
-			&cID, &cUserID, &cTitle, &cModel, &cIsPinned, &cStatus, &cLastMessageAt, &cCreatedAt, &cUpdatedAt,
-			&mID, &mStreamID, &mRole, &mModel, &mContent, &mReasoning, &mStatus, &mCreatedAt, &mUpdatedAt,
-			&aID, &aName, &aType, &aSrc, &aCreatedAt,
-		)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var limit int
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid_limit", http.StatusBadRequest)
 			return
 		}
-
-		// Initialize chat on first row
-		if chat == nil {
-			chat = &Chat{
-				ID:            uuid.MustParse(cID),
-				UserID:        uuid.MustParse(cUserID),
-				Title:         cTitle,
-				Model:         cModel,
-				IsPinned:      cIsPinned == 1,
-				Status:        cStatus,
-				LastMessageAt: cLastMessageAt,
-				CreatedAt:     cCreatedAt,
-				UpdatedAt:     cUpdatedAt,
-				Messages:      []Message{},
-			}
-		}
-
-		// Process message if it exists
-		if mID.Valid {
-			message, exists := messages[mID.String]
-			if !exists {
-				message = &Message{
-					ID:          uuid.MustParse(mID.String),
-					StreamID:    uuid.MustParse(mStreamID.String),
-					Role:        mRole.String,
-					Model:       mModel.String,
-					Content:     mContent.String,
-					Reasoning:   mReasoning.String,
-					Status:      mStatus.String,
-					CreatedAt:   mCreatedAt.Int64,
-					UpdatedAt:   mUpdatedAt.Int64,
-					Attachments: []Attachment{},
-				}
-				messages[mID.String] = message
-				chat.Messages = append(chat.Messages, *message)
-			}
-
-			// Add attachment if it exists
-			if aID.Valid {
-				attachment := Attachment{
-					ID:        uuid.MustParse(aID.String),
-					Name:      aName.String,
-					Type:      aType.String,
-					Src:       aSrc.String,
-					CreatedAt: aCreatedAt.Int64,
-				}
-
-				// Find the message in chat.Messages and add attachment
-				for i := range chat.Messages {
-					if chat.Messages[i].ID == uuid.MustParse(mID.String) { // TODO: that could be a problem
-						chat.Messages[i].Attachments = append(chat.Messages[i].Attachments, attachment)
-						break
-					}
-				}
+		var before uuid.UUID
+		if v := r.URL.Query().Get("before"); v != "" {
+			if before, err = uuid.Parse(v); err != nil {
+				http.Error(w, "invalid_before", http.StatusBadRequest)
+				return
 			}
 		}
+		chat, err = s.getChatPage(chatID, userID, before, min(limit, messagePageMaxLimit))
+	} else {
+		chat, err = s.getChat(chatID, userID)
 	}
-
-	if err := rows.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if chat == nil {
+	if errors.Is(err, errChatNotFound) {
 		http.Error(w, "Chat not found", http.StatusNotFound)
 		return
+	} else if errors.Is(err, errMessageNotFound) {
+		http.Error(w, "message_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -285,7 +222,7 @@ func (s *Service) EditChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Title == nil && req.IsPinned == nil && req.SharedAt == nil && req.Model == nil {
+	if req.Title == nil && req.IsPinned == nil && req.SharedAt == nil && req.Model == nil && req.ActiveMessageID == nil && req.ProjectID == nil {
 		http.Error(w, "No fields to update", http.StatusBadRequest)
 		return
 	}
@@ -373,6 +310,48 @@ func (s *Service) EditChat(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	if req.ActiveMessageID != nil {
+
+		chatID, err := uuid.Parse(id)
+		if err != nil {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		if err := s.switchBranch(chatID, userID, *req.ActiveMessageID); errors.Is(err, errChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, errMessageNotFound) {
+			http.Error(w, "message_not_found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	}
+
+	if req.ProjectID != nil {
+
+		chatID, err := uuid.Parse(id)
+		if err != nil {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+
+		if err := s.moveChat(chatID, userID, *req.ProjectID); errors.Is(err, errChatNotFound) {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, errProjectNotFound) {
+			http.Error(w, "project_not_found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 
 }
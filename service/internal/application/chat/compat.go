@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+)
+
+// The OpenAI and Ollama compatible APIs share how they wait for and subscribe to completions,
+// only the wire format is specific to each API.
+
+// finishReason returns the OpenAI finish reason of a stream status, false if the stream failed.
+func finishReason(status string) (string, bool) {
+	switch status {
+	case "done":
+		return "stop", true
+	case "blocked":
+		return "content_filter", true
+	default:
+		return "", false
+	}
+}
+
+// awaitCompletion waits until the completion is done and returns its content and finish reason.
+// The completion is canceled if ctx is done first, ctx.Err() is returned then and there is
+// nobody left to respond to. Failed completions are logged and reported with a stable code.
+func (s *Service) awaitCompletion(ctx context.Context, streamID uuid.UUID, compl *stream.Stream) (stream.Chunk, string, error) {
+
+	type result struct {
+		chunk stream.Chunk
+		err   error
+	}
+	done := make(chan result, 1)
+	compl.OnClose(func(chunk stream.Chunk, err error) {
+		done <- result{chunk, err}
+	})
+
+	var res result
+	select {
+	case <-ctx.Done():
+		s.log.Debug("completion: client closed connection", "stream_id", streamID)
+		compl.Fail(stream.ErrCanceled)
+		return stream.Chunk{}, "", ctx.Err()
+	case res = <-done:
+	}
+
+	reason, ok := finishReason(stream.Status(res.err))
+	if !ok {
+		s.log.Warn("completion failed", "stream_id", streamID, "error", res.err)
+		return stream.Chunk{}, "", &requestError{http.StatusBadGateway, "completion_failed"}
+	}
+	return res.chunk, reason, nil
+
+}
+
+// completionEncoder writes a completion stream in the wire format of an API.
+// Its methods report whether the client could be written to.
+type completionEncoder interface {
+	delta(content, reasoning string) bool
+	finish(reason string) bool
+	fail(code, message string) bool
+	end(err error) // The subscription ended, err is set if it was dropped by its backpressure policy
+}
+
+// subscribeDeltas sends the content of the completion to enc until it ends. The completion
+// is canceled if the client goes away, as nobody else receives it.
+func (s *Service) subscribeDeltas(ctx context.Context, streamID uuid.UUID, compl *stream.Stream, enc completionEncoder) {
+
+	// Deltas cannot be replaced by a snapshot, so the stream waits for the client instead
+	opts := s.subscribeOptions()
+	opts.Policy = stream.PolicyBlock
+
+	sub := compl.Subscribe(opts)
+	defer sub.Cancel()
+
+	var errMsg string
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Debug("completion: client closed connection", "stream_id", streamID)
+			compl.Fail(stream.ErrCanceled)
+			return
+
+		case event, more := <-sub.Read():
+			if !more {
+				enc.end(sub.Err())
+				return
+			}
+
+			ok := true
+			switch event.Type {
+			case stream.EventSnapshot:
+				// Content streamed before the subscription
+				if c := event.Snapshot; c != nil && (c.Content != "" || c.Reasoning != "") {
+					ok = enc.delta(c.Content, c.Reasoning)
+				}
+			case stream.EventContentDelta:
+				ok = enc.delta(event.Delta, "")
+			case stream.EventReasoningDelta:
+				ok = enc.delta("", event.Delta)
+			case stream.EventError:
+				errMsg = event.Error
+			case stream.EventStatus:
+				if event.Status == "streaming" {
+					break
+				}
+				if reason, finished := finishReason(event.Status); finished {
+					ok = enc.finish(reason)
+				} else {
+					ok = enc.fail(event.Status, errMsg)
+				}
+			}
+			if !ok {
+				s.log.Debug("completion: write failed", "stream_id", streamID)
+				compl.Fail(stream.ErrCanceled)
+				return
+			}
+		}
+	}
+
+}
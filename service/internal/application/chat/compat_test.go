@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+)
+
+// recordingEncoder records what a completion stream was encoded as.
+type recordingEncoder struct {
+	content, reasoning string
+	reason, code       string
+	ended              bool
+}
+
+func (e *recordingEncoder) delta(content, reasoning string) bool {
+	e.content += content
+	e.reasoning += reasoning
+	return true
+}
+
+func (e *recordingEncoder) finish(reason string) bool {
+	e.reason = reason
+	return true
+}
+
+func (e *recordingEncoder) fail(code, message string) bool {
+	e.code = code
+	return true
+}
+
+func (e *recordingEncoder) end(err error) {
+	e.ended = true
+}
+
+func newCompatTestService() *Service {
+	return &Service{
+		cfg: &application.Config{},
+		log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestSubscribeDeltas(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		err        error
+		wantReason string
+		wantCode   string
+	}{
+		{"done", nil, "stop", ""},
+		{"failed", errors.New("connection reset by provider"), "", "error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newCompatTestService()
+			compl := stream.New()
+			compl.Publish(stream.Chunk{Reasoning: "Thinking. "}) // Received as the snapshot
+			enc := &recordingEncoder{}
+
+			done := make(chan struct{})
+			go func() {
+				s.subscribeDeltas(context.Background(), uuid.New(), compl, enc)
+				close(done)
+			}()
+
+			compl.Publish(stream.Chunk{Content: "Hello"})
+			compl.Publish(stream.Chunk{Content: " world"})
+			if tt.err != nil {
+				compl.Fail(tt.err)
+			}
+			compl.Close()
+			<-done
+
+			if enc.content != "Hello world" || enc.reasoning != "Thinking. " {
+				t.Errorf("got content %q and reasoning %q", enc.content, enc.reasoning)
+			}
+			if enc.reason != tt.wantReason || enc.code != tt.wantCode || !enc.ended {
+				t.Errorf("got reason %q, code %q, ended %v", enc.reason, enc.code, enc.ended)
+			}
+
+		})
+	}
+
+}
+
+func TestAwaitCompletion(t *testing.T) {
+
+	s := newCompatTestService()
+
+	compl := stream.New()
+	compl.Publish(stream.Chunk{Content: "Hello"})
+	compl.Close()
+	chunk, reason, err := s.awaitCompletion(context.Background(), uuid.New(), compl)
+	if err != nil || chunk.Content != "Hello" || reason != "stop" {
+		t.Errorf("got %q, %q, %v", chunk.Content, reason, err)
+	}
+
+	compl = stream.New()
+	compl.Fail(errors.New("connection reset by provider"))
+	compl.Close()
+	_, _, err = s.awaitCompletion(context.Background(), uuid.New(), compl)
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.code != "completion_failed" {
+		t.Errorf("got error %v, want completion_failed", err)
+	}
+
+	// The completion is canceled when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	compl = stream.New()
+	if _, _, err := s.awaitCompletion(ctx, uuid.New(), compl); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+	compl.Close()
+	if err := compl.Wait(); stream.Status(err) != "canceled" {
+		t.Errorf("got stream error %v, want canceled", err)
+	}
+
+}
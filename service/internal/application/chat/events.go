@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// userEventBuffer is the number of events buffered per connection, further events are dropped.
+const userEventBuffer = 16
+
+// UserEvent notifies all connections of a user about a change made in the background.
+type UserEvent struct {
+	Type string      `json:"type"` // "chat_updated"
+	Chat *ChatUpdate `json:"chat,omitempty"`
+}
+
+// ChatUpdate contains the changed fields of a chat.
+type ChatUpdate struct {
+	ID    uuid.UUID `json:"id"`
+	Title string    `json:"title,omitempty"`
+}
+
+// userHub delivers user events to the connections of a user.
+type userHub struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan UserEvent]struct{}
+}
+
+func newUserHub() *userHub {
+	return &userHub{
+		subs: make(map[uuid.UUID]map[chan UserEvent]struct{}),
+	}
+}
+
+// subscribe returns a channel receiving the events of the user and a func to unsubscribe.
+func (h *userHub) subscribe(userID uuid.UUID) (<-chan UserEvent, func()) {
+
+	ch := make(chan UserEvent, userEventBuffer)
+
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan UserEvent]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs[userID], ch)
+			if len(h.subs[userID]) == 0 {
+				delete(h.subs, userID)
+			}
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+
+}
+
+// publish sends the event to every connection of the user. Connections that do not keep up
+// miss the event, user events only signal that something should be refreshed.
+func (h *userHub) publish(userID uuid.UUID, event UserEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// OpenEvents sends the user's events as Server-Sent Events until the client disconnects.
+func (s *Service) OpenEvents(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.log.Debug("streaming not supported", "user_id", userID)
+		http.Error(w, "streaming not supported", http.StatusNotFound)
+		return
+	}
+
+	events, unsubscribe := s.hub.subscribe(userID)
+	defer unsubscribe()
+
+	// Set headers for Server-Sent Events
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.log.Error("events: json encoding failed", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				s.log.Debug("events: write failed", "err", err)
+				return
+			}
+			flusher.Flush()
+		}
+	}
+
+}
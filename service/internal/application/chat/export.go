@@ -0,0 +1,419 @@
+package chat
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// exportVersion is increased when the JSON export format changes incompatibly.
+const exportVersion = 1
+
+// exportFormats maps the supported formats to their file extension.
+var exportFormats = map[string]string{
+	"markdown": ".md",
+	"json":     ".json",
+	"html":     ".html",
+}
+
+// ExportedChat is the lossless JSON export of a chat. It contains the messages of all branches.
+type ExportedChat struct {
+	Version         int               `json:"version"`
+	ID              uuid.UUID         `json:"id"`
+	Title           string            `json:"title"`
+	Model           string            `json:"model"`
+	IsPinned        bool              `json:"is_pinned"`
+	CreatedAt       int64             `json:"created_at"`
+	UpdatedAt       int64             `json:"updated_at"`
+	LastMessageAt   int64             `json:"last_message_at"`
+	ActiveMessageID uuid.UUID         `json:"active_message_id,omitzero"`
+	Messages        []ExportedMessage `json:"messages"`
+}
+
+type ExportedMessage struct {
+	ID          uuid.UUID            `json:"id"`
+	ParentID    uuid.UUID            `json:"parent_id,omitzero"`
+	Role        string               `json:"role"`
+	Model       string               `json:"model"`
+	Content     string               `json:"content"`
+	Reasoning   string               `json:"reasoning,omitempty"`
+	Blocks      []stream.Block       `json:"blocks,omitempty"`
+	Status      string               `json:"status"`
+	CreatedAt   int64                `json:"created_at"`
+	UpdatedAt   int64                `json:"updated_at"`
+	Attachments []ExportedAttachment `json:"attachments"`
+}
+
+type ExportedAttachment struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	CreatedAt int64     `json:"created_at"`
+	Data      []byte    `json:"data"` // Base64 encoded
+}
+
+// writeExport writes the chat in the given format. Markdown and HTML contain the active branch,
+// so c must contain all messages of the chat as returned by loadChat.
+func writeExport(w io.Writer, c *Chat, format string) error {
+	switch format {
+	case "markdown":
+		return writeMarkdown(w, c.Title, c.branch(c.activeLeaf()))
+	case "html":
+		return writeHTML(w, c.UserID, c.Title, c.branch(c.activeLeaf()))
+	case "json":
+		return writeJSONExport(w, c)
+	}
+	return fmt.Errorf("unsupported export format %q", format)
+}
+
+func writeJSONExport(w io.Writer, c *Chat) error {
+
+	export := ExportedChat{
+		Version:         exportVersion,
+		ID:              c.ID,
+		Title:           c.Title,
+		Model:           c.Model,
+		IsPinned:        c.IsPinned,
+		CreatedAt:       c.CreatedAt,
+		UpdatedAt:       c.UpdatedAt,
+		LastMessageAt:   c.LastMessageAt,
+		ActiveMessageID: c.ActiveMessageID,
+		Messages:        make([]ExportedMessage, 0, len(c.Messages)),
+	}
+
+	for _, m := range c.Messages {
+		message := ExportedMessage{
+			ID:          m.ID,
+			ParentID:    m.ParentID,
+			Role:        m.Role,
+			Model:       m.Model,
+			Content:     m.Content,
+			Reasoning:   m.Reasoning,
+			Blocks:      m.Blocks,
+			Status:      m.Status,
+			CreatedAt:   m.CreatedAt,
+			UpdatedAt:   m.UpdatedAt,
+			Attachments: make([]ExportedAttachment, 0, len(m.Attachments)),
+		}
+		for _, a := range m.Attachments {
+			data, err := getAttachmentData(c.UserID, a.ID)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // Removed from disk, the rest of the chat is still exported
+			} else if err != nil {
+				return err
+			}
+			message.Attachments = append(message.Attachments, ExportedAttachment{
+				ID:        a.ID,
+				Name:      a.Name,
+				Type:      a.Type,
+				CreatedAt: a.CreatedAt,
+				Data:      data,
+			})
+		}
+		export.Messages = append(export.Messages, message)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+
+}
+
+// interleave inserts the rendered blocks into the content at their offsets.
+func interleave(content string, blocks []stream.Block, render func(stream.Block) string) string {
+	var b strings.Builder
+	last := 0
+	for _, block := range blocks {
+		offset := min(max(block.Offset, last), len(content))
+		b.WriteString(content[last:offset])
+		b.WriteString(render(block))
+		last = offset
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+func markdownBlock(block stream.Block) string {
+	switch block.Type {
+	case "code":
+		return fmt.Sprintf("\n\n```%s\n%s\n```\n\n", block.Language, strings.TrimRight(block.Code, "\n"))
+	case "code_result":
+		return fmt.Sprintf("\n\n```\n%s\n```\n\n", strings.TrimRight(block.Output, "\n"))
+	}
+	return "" // Images and files are listed with the attachments
+}
+
+func writeMarkdown(w io.Writer, title string, messages []Message) error {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+
+	for _, m := range messages {
+		switch m.Role {
+		case "user":
+			b.WriteString("\n## User\n\n")
+		default:
+			fmt.Fprintf(&b, "\n## Assistant (%s)\n\n", m.Model)
+		}
+
+		// Reasoning is collapsed, so the answers remain readable
+		if m.Reasoning != "" {
+			fmt.Fprintf(&b, "<details>\n<summary>Reasoning</summary>\n\n%s\n\n</details>\n\n", strings.TrimSpace(m.Reasoning))
+		}
+
+		b.WriteString(strings.TrimSpace(interleave(m.Content, m.Blocks, markdownBlock)))
+		b.WriteString("\n")
+
+		if len(m.Attachments) > 0 {
+			b.WriteString("\n")
+			for _, a := range m.Attachments {
+				if strings.HasPrefix(a.Type, "image/") {
+					fmt.Fprintf(&b, "![%s](%s)\n", a.Name, a.Src)
+				} else {
+					fmt.Fprintf(&b, "- [%s](%s)\n", a.Name, a.Src)
+				}
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+
+}
+
+var htmlExport = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 48rem; margin: 2rem auto; padding: 0 1rem; font-family: system-ui, sans-serif; line-height: 1.5; color: #1f1f1f; }
+.message { margin: 1.5rem 0; padding: 1rem; border-radius: 0.5rem; }
+.user { background: #f3e8f7; }
+.assistant { background: #f7f7f7; }
+.role { font-size: 0.85rem; font-weight: 600; color: #6b6b6b; margin-bottom: 0.5rem; }
+.content { white-space: pre-wrap; word-wrap: break-word; }
+details { margin-bottom: 0.75rem; color: #555; }
+pre { background: #1f1f1f; color: #f0f0f0; padding: 0.75rem; border-radius: 0.375rem; overflow-x: auto; }
+img { max-width: 100%; border-radius: 0.375rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Messages}}<div class="message {{.Role}}">
+<div class="role">{{if eq .Role "user"}}User{{else}}Assistant ({{.Model}}){{end}}</div>
+{{if .Reasoning}}<details><summary>Reasoning</summary><div class="content">{{.Reasoning}}</div></details>
+{{end}}<div class="content">{{.Content}}</div>
+{{range .Blocks}}{{if .Code}}<pre><code>{{.Code}}</code></pre>
+{{else if .Output}}<pre>{{.Output}}</pre>
+{{end}}{{end}}{{range .Attachments}}{{if .Image}}<p><img src="{{.Image}}" alt="{{.Name}}"></p>
+{{else}}<p>Attachment: {{.Name}}</p>
+{{end}}{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+// writeHTML writes a standalone HTML page, images are embedded so the file can be opened offline.
+func writeHTML(w io.Writer, userID uuid.UUID, title string, messages []Message) error {
+
+	type attachment struct {
+		Name  string
+		Image template.URL
+	}
+	type message struct {
+		Message
+		Attachments []attachment
+	}
+
+	page := struct {
+		Title    string
+		Messages []message
+	}{Title: title}
+
+	for _, m := range messages {
+		msg := message{Message: m}
+		for _, a := range m.Attachments {
+			att := attachment{Name: a.Name}
+			if strings.HasPrefix(a.Type, "image/") {
+				data, err := getAttachmentData(userID, a.ID)
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				att.Image = template.URL("data:" + a.Type + ";base64," + base64.StdEncoding.EncodeToString(data))
+			}
+			msg.Attachments = append(msg.Attachments, att)
+		}
+		page.Messages = append(page.Messages, msg)
+	}
+
+	return htmlExport.Execute(w, page)
+
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// exportFileName returns a file name for the chat that is safe to use on any platform.
+func exportFileName(c *Chat, format string) string {
+	name := strings.Trim(unsafeFileChars.ReplaceAllString(strings.ToLower(c.Title), "-"), "-")
+	name = strings.Trim(excerpt(name, 60), "-…")
+	if name == "" {
+		name = "chat"
+	}
+	return fmt.Sprintf("%s-%s%s", name, c.ID.String()[:8], exportFormats[format])
+}
+
+// exportFormat returns the requested format, Markdown by default.
+func exportFormat(r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "markdown"
+	}
+	_, ok := exportFormats[format]
+	return format, ok
+}
+
+func (s *Service) ExportChat(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	chatID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+
+	format, ok := exportFormat(r)
+	if !ok {
+		http.Error(w, "unsupported_format", http.StatusBadRequest)
+		return
+	}
+
+	c, err := s.loadChat(chatID, userID)
+	if errors.Is(err, errChatNotFound) {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Rendered before writing, so errors can still be reported
+	var b strings.Builder
+	if err := writeExport(&b, c, format); err != nil {
+		s.log.Warn("failed to export chat", "chat_id", chatID, "error", err)
+		http.Error(w, "export_failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeTypeForExport(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(c, format)))
+	io.WriteString(w, b.String())
+
+}
+
+func mimeTypeForExport(format string) string {
+	switch format {
+	case "json":
+		return "application/json"
+	case "html":
+		return "text/html; charset=utf-8"
+	}
+	return "text/markdown; charset=utf-8"
+}
+
+// ExportChats streams all chats of the user as a zip archive with one file per chat.
+func (s *Service) ExportChats(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	format, ok := exportFormat(r)
+	if !ok {
+		http.Error(w, "unsupported_format", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.db.Query("SELECT id FROM chats WHERE user_id = ? ORDER BY created_at ASC", userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var chatIDs []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "chats-"+time.Now().Format("2006-01-02")+".zip"))
+
+	// The archive is streamed, errors past this point can only be logged
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+
+	// Chats that fail to load or render are skipped, a failed write means the client is gone
+	var buf bytes.Buffer
+	for _, chatID := range chatIDs {
+		c, err := s.loadChat(chatID, userID)
+		if err != nil {
+			s.log.Warn("skipped chat in export, failed to load", "chat_id", chatID, "error", err)
+			continue
+		}
+		buf.Reset()
+		if err := writeExport(&buf, c, format); err != nil {
+			s.log.Warn("skipped chat in export, failed to render", "chat_id", chatID, "error", err)
+			continue
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     exportFileName(c, format),
+			Method:   zip.Deflate,
+			Modified: time.UnixMilli(c.UpdatedAt),
+		})
+		if err == nil {
+			_, err = buf.WriteTo(f)
+		}
+		if err != nil {
+			s.log.Debug("export: write failed", "error", err)
+			return
+		}
+	}
+
+}
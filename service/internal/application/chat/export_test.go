@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+)
+
+// newExportTestChat creates a chat with a user message carrying a text attachment.
+func newExportTestChat(t *testing.T, s *Service, userID uuid.UUID, title string, createdAt int64) (uuid.UUID, *Attachment) {
+	t.Helper()
+
+	chatID, messageID := uuid.New(), uuid.New()
+	_, err := s.db.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chatID, userID, title, "model", false, "done", createdAt, createdAt, createdAt, 0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		messageID, chatID, userID, "", uuid.UUID{}, "user", "done", "model", "Summarize the notes", "", createdAt, createdAt,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.saveAttachment(userID, messageID, "notes.txt", "text/plain", strings.NewReader("Meeting notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chatID, a
+}
+
+func TestExportChats(t *testing.T) {
+
+	s := newTestService(t)
+	userID := uuid.New()
+
+	chatID, a := newExportTestChat(t, s, userID, "Notes", 1)
+
+	// The attachment of the second chat cannot be read, so the chat fails to render and is skipped
+	_, broken := newExportTestChat(t, s, userID, "Broken", 2)
+	path := fmt.Sprintf("data/users/%s/attachments/%s", userID, broken.ID)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/v1/chats/export/?format=json", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "user_id", userID))
+	w := httptest.NewRecorder()
+	s.ExportChats(w, r)
+
+	body := w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 {
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		t.Fatalf("got files %v, want the notes chat only", names)
+	}
+
+	f := zr.File[0]
+	if want := "notes-" + chatID.String()[:8] + ".json"; f.Name != want {
+		t.Errorf("got file %s, want %s", f.Name, want)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var export ExportedChat
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.ID != chatID || len(export.Messages) != 1 {
+		t.Fatalf("got chat %s with %d messages", export.ID, len(export.Messages))
+	}
+	attachments := export.Messages[0].Attachments
+	if len(attachments) != 1 || attachments[0].ID != a.ID || string(attachments[0].Data) != "Meeting notes" {
+		t.Errorf("got attachments %+v", attachments)
+	}
+
+}
+
+func TestInterleave(t *testing.T) {
+
+	content := "Grüße 👋\nEnde"
+	blocks := []stream.Block{{Type: "code", Code: "x", Offset: len("Grüße 👋\n")}}
+
+	got := interleave(content, blocks, func(b stream.Block) string { return "[" + b.Code + "]" })
+	if want := "Grüße 👋\n[x]Ende"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+}
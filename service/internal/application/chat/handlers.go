@@ -10,14 +10,40 @@ func (s *Service) Handle(r *mux.Router) {
 
 	router = r.PathPrefix("/v1/models").Subrouter()
 	router.HandleFunc("/", s.ListModels).Methods("GET")
+	router.HandleFunc("", s.ListOpenAIModels).Methods("GET") // OpenAI compatible
+
+	// OpenAI compatible API
+	router = r.PathPrefix("/v1/chat").Subrouter()
+	router.HandleFunc("/completions", s.CreateChatCompletion).Methods("POST")
+
+	// Ollama compatible API
+	router = r.PathPrefix("/api").Subrouter()
+	router.HandleFunc("/chat", s.OllamaChat).Methods("POST")
+	router.HandleFunc("/tags", s.OllamaTags).Methods("GET")
+	router.HandleFunc("/version", s.OllamaVersion).Methods("GET")
 
 	router = r.PathPrefix("/v1/chats").Subrouter()
 	router.HandleFunc("/", s.ListChats).Methods("GET")
 	router.HandleFunc("/", s.SendMessage).Methods("POST")
+	router.HandleFunc("/export/", s.ExportChats).Methods("GET") // Before /{id}/, which would match it too
+	router.HandleFunc("/import/", s.ImportChats).Methods("POST")
 	router.HandleFunc("/{id}/", s.GetChat).Methods("GET")
 	router.HandleFunc("/{id}/", s.DeleteChat).Methods("DELETE")
 	router.HandleFunc("/{id}/", s.EditChat).Methods("PATCH")
 	router.HandleFunc("/{id}/", s.AddMessage).Methods("POST")
+	router.HandleFunc("/{id}/export/", s.ExportChat).Methods("GET")
+	router.HandleFunc("/{id}/messages/{message_id}/", s.EditMessage).Methods("PATCH")
+	router.HandleFunc("/{id}/messages/{message_id}/regenerate/", s.RegenerateMessage).Methods("POST")
+
+	router = r.PathPrefix("/v1/projects").Subrouter()
+	router.HandleFunc("/", s.ListProjects).Methods("GET")
+	router.HandleFunc("/", s.CreateProject).Methods("POST")
+	router.HandleFunc("/{id}/", s.GetProject).Methods("GET")
+	router.HandleFunc("/{id}/", s.EditProject).Methods("PATCH")
+	router.HandleFunc("/{id}/", s.DeleteProject).Methods("DELETE")
+
+	router = r.PathPrefix("/v1/search").Subrouter()
+	router.HandleFunc("/", s.Search).Methods("GET")
 
 	router = r.PathPrefix("/v1/attachments").Subrouter()
 	router.HandleFunc("/", s.ListAttachments).Methods("GET")
@@ -29,6 +55,12 @@ func (s *Service) Handle(r *mux.Router) {
 	router.HandleFunc("/{id}/", s.OpenStream).Methods("GET")
 	router.HandleFunc("/{id}/", s.CancelStream).Methods("DELETE")
 
+	router = r.PathPrefix("/v1/events").Subrouter()
+	router.HandleFunc("/", s.OpenEvents).Methods("GET")
+
+	router = r.PathPrefix("/v1/ws").Subrouter()
+	router.HandleFunc("/", s.OpenWebSocket).Methods("GET")
+
 	router = r.PathPrefix("/v1/profile").Subrouter()
 	router.HandleFunc("/", s.GetUserProfile).Methods("GET")
 	router.HandleFunc("/", s.UpsertUserProfile).Methods("PATCH")
@@ -36,4 +68,9 @@ func (s *Service) Handle(r *mux.Router) {
 	router = r.PathPrefix("/v1/share").Subrouter()
 	router.HandleFunc("/{id}/", s.GetSharedChat).Methods("GET")
 
+	router = r.PathPrefix("/v1/admin").Subrouter()
+	router.HandleFunc("/stats/models/", s.GetModelStats).Methods("GET")
+	router.HandleFunc("/stats/streams/", s.GetStreamStats).Methods("GET")
+	router.HandleFunc("/streams/", s.ListStreams).Methods("GET")
+
 }
@@ -0,0 +1,695 @@
+package chat
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/google/uuid"
+)
+
+// Conversations from other chat apps are imported from their data exports: ChatGPT's
+// conversations.json and Claude's export archive. Each conversation becomes a chat with the
+// original timestamps and branches, and remembers its origin so re-imports skip it.
+
+// importMaxSize is the largest export that can be uploaded, ChatGPT archives contain all images.
+const importMaxSize = 1 << 30
+
+// importFileMaxSize is the largest file of an export that is imported as an attachment,
+// the same size as uploads.
+const importFileMaxSize = 10 << 20
+
+var errAlreadyImported = errors.New("already imported")
+
+// ImportResult reports what happened to a single conversation of an import.
+type ImportResult struct {
+	SourceID string    `json:"source_id"` // ID of the conversation in the exporting app
+	Title    string    `json:"title"`
+	Status   string    `json:"status"` // "imported", "skipped" or "failed"
+	ChatID   uuid.UUID `json:"chat_id,omitzero"`
+	Messages int       `json:"messages"`
+	Reason   string    `json:"reason,omitempty"` // Why the conversation was skipped or failed
+}
+
+type ImportSummary struct {
+	Imported int            `json:"imported"`
+	Skipped  int            `json:"skipped"`
+	Failed   int            `json:"failed"`
+	Results  []ImportResult `json:"results"`
+}
+
+func (s *ImportSummary) add(result ImportResult) {
+	switch result.Status {
+	case "imported":
+		s.Imported++
+	case "skipped":
+		s.Skipped++
+	default:
+		s.Failed++
+	}
+	s.Results = append(s.Results, result)
+}
+
+// importedChat is a conversation converted to the structure of a chat.
+type importedChat struct {
+	source    string // Origin of the chat, e.g. "chatgpt:<conversation id>"
+	sourceID  string
+	provider  llm.ModelProvider // Provider of the exporting app's models
+	title     string
+	model     string
+	createdAt int64
+	updatedAt int64
+	messages  []importedMessage // Parents come before their replies
+	activeKey string            // Last message of the branch that was shown in the exporting app
+}
+
+type importedMessage struct {
+	key       string
+	parentKey string
+	role      string
+	model     string
+	content   string
+	reasoning string
+	createdAt int64
+	files     []importedFile
+}
+
+type importedFile struct {
+	name     string
+	mimeType string
+	data     []byte
+}
+
+// conversation holds the fields of both export formats. ChatGPT conversations have a mapping of
+// message nodes, Claude conversations a list of chat messages.
+type conversation struct {
+	// ChatGPT
+	ID             string             `json:"id"`
+	ConversationID string             `json:"conversation_id"`
+	Title          string             `json:"title"`
+	CreateTime     float64            `json:"create_time"` // Unix time in seconds
+	UpdateTime     float64            `json:"update_time"`
+	Mapping        map[string]gptNode `json:"mapping"`
+	CurrentNode    string             `json:"current_node"`
+
+	// Claude
+	UUID         string          `json:"uuid"`
+	Name         string          `json:"name"`
+	CreatedAt    string          `json:"created_at"` // RFC 3339
+	UpdatedAt    string          `json:"updated_at"`
+	ChatMessages []claudeMessage `json:"chat_messages"`
+}
+
+type gptNode struct {
+	ID       string      `json:"id"`
+	Message  *gptMessage `json:"message"`
+	Parent   string      `json:"parent"`
+	Children []string    `json:"children"`
+}
+
+type gptMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"` // "text", "multimodal_text" and "thoughts" are imported
+		Parts       []json.RawMessage `json:"parts"`        // Text or asset pointers
+		Thoughts    []struct {
+			Summary string `json:"summary"`
+			Content string `json:"content"`
+		} `json:"thoughts"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug        string `json:"model_slug"`
+		IsVisuallyHidden bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+type gptAssetPointer struct {
+	ContentType  string `json:"content_type"`
+	AssetPointer string `json:"asset_pointer"` // e.g. "file-service://file-abc", the file is named after the id
+}
+
+type claudeMessage struct {
+	UUID              string `json:"uuid"`
+	ParentMessageUUID string `json:"parent_message_uuid"` // Only in newer exports
+	Sender            string `json:"sender"`              // "human" or "assistant"
+	Text              string `json:"text"`
+	Content           []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
+	} `json:"content"`
+	CreatedAt   string `json:"created_at"`
+	Attachments []struct {
+		FileName         string `json:"file_name"`
+		FileType         string `json:"file_type"`
+		ExtractedContent string `json:"extracted_content"`
+	} `json:"attachments"`
+}
+
+// exportFiles are the files of an export archive besides the conversations.
+type exportFiles []*zip.File
+
+// find returns the file named after the given id, as ChatGPT names its image files, e.g.
+// "file-abc.png" or "file-abc-photo.jpg". Files larger than importFileMaxSize are not imported.
+func (f exportFiles) find(id string) (*importedFile, bool) {
+
+	if id == "" {
+		return nil, false
+	}
+
+	for _, file := range f {
+		name := path.Base(file.Name)
+		rest, ok := strings.CutPrefix(name, id)
+		if !ok || (rest != "" && !strings.ContainsAny(rest[:1], ".-_ ")) {
+			continue
+		}
+		if file.UncompressedSize64 > importFileMaxSize {
+			return nil, false
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, false
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, importFileMaxSize+1))
+		rc.Close()
+		if err != nil || len(data) > importFileMaxSize {
+			return nil, false
+		}
+		mimeType := mime.TypeByExtension(path.Ext(name))
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+		return &importedFile{name: name, mimeType: mimeType, data: data}, true
+	}
+
+	return nil, false
+
+}
+
+func unixSeconds(t float64) int64 {
+	return int64(math.Round(t * 1000))
+}
+
+func parseTime(value string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// chatGPT converts a ChatGPT conversation. Nodes that are not imported, like system prompts and tool
+// calls, are skipped by attaching their replies to the closest imported ancestor.
+func (c *conversation) chatGPT(files exportFiles) *importedChat {
+
+	id := c.ConversationID
+	if id == "" {
+		id = c.ID
+	}
+
+	ic := &importedChat{
+		source:    "chatgpt:" + id,
+		sourceID:  id,
+		provider:  llm.OpenAI,
+		title:     c.Title,
+		createdAt: unixSeconds(c.CreateTime),
+		updatedAt: unixSeconds(c.UpdateTime),
+	}
+
+	type visit struct {
+		node      string
+		parentKey string // Closest imported ancestor
+		reasoning string // Thoughts for the next assistant message
+		createdAt int64
+	}
+
+	var stack []visit
+	for key, node := range c.Mapping {
+		if _, ok := c.Mapping[node.Parent]; !ok {
+			stack = append(stack, visit{node: key, createdAt: ic.createdAt})
+		}
+	}
+
+	imported := make(map[string]string) // Node to closest imported node
+	for len(stack) > 0 {
+
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node := c.Mapping[v.node]
+		if _, seen := imported[v.node]; seen {
+			continue
+		}
+		imported[v.node] = v.parentKey
+
+		next := visit{parentKey: v.parentKey, reasoning: v.reasoning, createdAt: v.createdAt}
+
+		if m := node.Message; m != nil && !m.Metadata.IsVisuallyHidden {
+			if m.CreateTime > 0 {
+				next.createdAt = max(unixSeconds(m.CreateTime), v.createdAt)
+			}
+
+			switch m.Content.ContentType {
+			case "thoughts":
+				for _, thought := range m.Content.Thoughts {
+					next.reasoning = strings.TrimSpace(next.reasoning + "\n\n" + thought.Content)
+				}
+			case "text", "multimodal_text":
+				if m.Author.Role != "user" && m.Author.Role != "assistant" {
+					break
+				}
+				message := importedMessage{
+					key:       v.node,
+					parentKey: v.parentKey,
+					role:      m.Author.Role,
+					model:     m.Metadata.ModelSlug,
+					createdAt: next.createdAt,
+				}
+				var text []string
+				for _, part := range m.Content.Parts {
+					var s string
+					if err := json.Unmarshal(part, &s); err == nil {
+						text = append(text, s)
+						continue
+					}
+					var pointer gptAssetPointer
+					if err := json.Unmarshal(part, &pointer); err == nil && pointer.AssetPointer != "" {
+						_, fileID, _ := strings.Cut(pointer.AssetPointer, "://")
+						if file, ok := files.find(fileID); ok {
+							message.files = append(message.files, *file)
+						}
+					}
+				}
+				message.content = strings.Join(text, "\n")
+				if message.content == "" && len(message.files) == 0 {
+					break
+				}
+				if message.role == "assistant" {
+					if message.model == "" {
+						message.model = "chatgpt"
+					}
+					message.reasoning, next.reasoning = next.reasoning, ""
+				}
+				ic.messages = append(ic.messages, message)
+				imported[v.node] = v.node
+				next.parentKey = v.node
+			}
+		}
+
+		// Reversed, so the first child is visited first
+		for i := len(node.Children) - 1; i >= 0; i-- {
+			child := next
+			child.node = node.Children[i]
+			if _, ok := c.Mapping[child.node]; ok {
+				stack = append(stack, child)
+			}
+		}
+
+	}
+
+	ic.activeKey = imported[c.CurrentNode]
+
+	// The chat continues with the model of the branch that was shown
+	for _, m := range ic.messages {
+		if m.model != "" && (m.key == ic.activeKey || ic.model == "") {
+			ic.model = m.model
+		}
+	}
+
+	return ic
+
+}
+
+// claude converts a Claude conversation. Exports without parent references contain a single branch.
+// Messages without content are skipped by attaching their replies to the closest imported ancestor.
+func (c *conversation) claude() *importedChat {
+
+	ic := &importedChat{
+		source:    "claude:" + c.UUID,
+		sourceID:  c.UUID,
+		provider:  llm.Anthropic,
+		title:     c.Name,
+		model:     "claude",
+		createdAt: parseTime(c.CreatedAt),
+		updatedAt: parseTime(c.UpdatedAt),
+	}
+
+	imported := make(map[string]string) // Message to closest imported message
+	var previous string
+	for _, m := range c.ChatMessages {
+
+		message := importedMessage{
+			key:       m.UUID,
+			parentKey: previous,
+			role:      "user",
+			createdAt: parseTime(m.CreatedAt),
+		}
+		if m.ParentMessageUUID != "" {
+			message.parentKey = imported[m.ParentMessageUUID]
+		}
+		imported[m.UUID] = message.parentKey
+		if m.Sender == "assistant" {
+			message.role = "assistant"
+			message.model = "claude"
+		}
+
+		var text, reasoning []string
+		for _, block := range m.Content {
+			switch block.Type {
+			case "text":
+				text = append(text, block.Text)
+			case "thinking":
+				reasoning = append(reasoning, block.Thinking)
+			}
+		}
+		message.content = strings.Join(text, "\n\n")
+		if len(m.Content) == 0 {
+			message.content = m.Text
+		}
+		message.reasoning = strings.Join(reasoning, "\n\n")
+
+		for _, a := range m.Attachments {
+			if a.ExtractedContent == "" {
+				continue
+			}
+			message.files = append(message.files, importedFile{
+				name:     a.FileName,
+				mimeType: "text/plain; charset=utf-8",
+				data:     []byte(a.ExtractedContent),
+			})
+		}
+
+		if message.content == "" && len(message.files) == 0 {
+			continue
+		}
+
+		ic.messages = append(ic.messages, message)
+		imported[m.UUID] = m.UUID
+		previous = m.UUID
+
+	}
+
+	ic.activeKey = previous
+
+	return ic
+
+}
+
+// resolveModel returns the key of the configured model closest to a model of the exporting app:
+// the model with that key or provider model name, then one whose name starts with it, e.g.
+// "claude" or "gpt-4o", then any model of the provider. Keys are tried in order for stable results.
+func resolveModel(models map[string]llm.Model, name string, provider llm.ModelProvider) (string, bool) {
+
+	if _, ok := models[name]; ok && name != "" {
+		return name, true
+	}
+
+	keys := slices.Sorted(maps.Keys(models))
+	matches := []func(m llm.Model) bool{
+		func(m llm.Model) bool { return name != "" && m.Name == name },
+		func(m llm.Model) bool { return name != "" && strings.HasPrefix(m.Name, name) },
+		func(m llm.Model) bool { return m.Provider == provider },
+	}
+	for _, match := range matches {
+		for _, key := range keys {
+			if match(models[key]) {
+				return key, true
+			}
+		}
+	}
+
+	return "", false
+
+}
+
+// mapModels replaces the models of the exporting app with configured ones, so imported chats can
+// be continued. The chat keeps the model of the shown branch, messages whose model is not
+// configured fall back to the chat's model.
+func (ic *importedChat) mapModels(models map[string]llm.Model) {
+
+	if key, ok := resolveModel(models, ic.model, ic.provider); ok {
+		ic.model = key
+	} else if keys := slices.Sorted(maps.Keys(models)); len(keys) > 0 {
+		ic.model = keys[0]
+	}
+
+	for i, m := range ic.messages {
+		if m.role != "assistant" {
+			continue
+		}
+		key, ok := resolveModel(models, m.model, ic.provider)
+		if !ok {
+			key = ic.model
+		}
+		ic.messages[i].model = key
+	}
+
+}
+
+// importChat stores the imported chat with its messages and attachments in one transaction.
+// If it fails, the attachment files that were written are removed again.
+func (s *Service) importChat(userID uuid.UUID, ic *importedChat) (uuid.UUID, error) {
+
+	var existing uuid.UUID
+	err := s.db.QueryRow("SELECT id FROM chats WHERE user_id = ? AND import_source = ?", userID, ic.source).Scan(&existing)
+	if err == nil {
+		return existing, errAlreadyImported
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return uuid.UUID{}, err
+	}
+
+	title := strings.TrimSpace(ic.title)
+	if title == "" {
+		title = "Imported chat"
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	var files []string
+	fail := func(err error) (uuid.UUID, error) {
+		tx.Rollback()
+		for _, file := range files {
+			os.Remove(file)
+		}
+		return uuid.UUID{}, err
+	}
+
+	chatID := uuid.New()
+	_, err = tx.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at, import_source) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chatID, userID, title, ic.model, false, "done", ic.createdAt, max(ic.updatedAt, ic.createdAt), ic.createdAt, 0, ic.source,
+	)
+	if err != nil {
+		return fail(err)
+	}
+
+	ids := make(map[string]uuid.UUID, len(ic.messages))
+	lastMessageAt := ic.createdAt
+	for _, m := range ic.messages {
+
+		messageID := uuid.New()
+		ids[m.key] = messageID
+		lastMessageAt = max(lastMessageAt, m.createdAt)
+
+		_, err := tx.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			messageID, chatID, userID, parentString(ids[m.parentKey]), uuid.UUID{},
+			m.role, "done", m.model, m.content, m.reasoning,
+			m.createdAt, m.createdAt,
+		)
+		if err != nil {
+			return fail(err)
+		}
+
+		for _, f := range m.files {
+			attachment, err := s.saveAttachmentTx(tx, userID, messageID, f.name, f.mimeType, bytes.NewReader(f.data))
+			if attachment != nil {
+				files = append(files, fmt.Sprintf("data/users/%s/attachments/%s", userID, attachment.ID))
+			}
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+	}
+
+	// The insert trigger made the last inserted message active, which is not necessarily the right one
+	_, err = tx.Exec("UPDATE chats SET active_message_id = ?, last_message_at = ?, status = 'done' WHERE id = ?",
+		parentString(ids[ic.activeKey]), lastMessageAt, chatID,
+	)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	return chatID, nil
+
+}
+
+// importConversations imports the conversations of a conversations.json file one at a time,
+// so large exports are never decoded at once.
+func (s *Service) importConversations(userID uuid.UUID, r io.Reader, files exportFiles) (*ImportSummary, error) {
+
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, &requestError{http.StatusBadRequest, "invalid_export"}
+	}
+
+	summary := &ImportSummary{Results: []ImportResult{}}
+	for dec.More() {
+
+		var c conversation
+		if err := dec.Decode(&c); err != nil {
+			s.log.Debug("failed to decode conversation", "error", err)
+			summary.add(ImportResult{Status: "failed", Reason: "invalid_conversation"})
+			break // The rest of the file cannot be read
+		}
+
+		var ic *importedChat
+		switch {
+		case c.Mapping != nil:
+			ic = c.chatGPT(files)
+		case c.ChatMessages != nil:
+			ic = c.claude()
+		default:
+			summary.add(ImportResult{SourceID: c.ID + c.UUID, Status: "failed", Reason: "unknown_format"})
+			continue
+		}
+
+		ic.mapModels(s.mr.ListModels())
+
+		result := ImportResult{SourceID: ic.sourceID, Title: ic.title, Messages: len(ic.messages)}
+		if len(ic.messages) == 0 {
+			result.Status, result.Reason = "skipped", "empty_conversation"
+			summary.add(result)
+			continue
+		}
+
+		chatID, err := s.importChat(userID, ic)
+		switch {
+		case errors.Is(err, errAlreadyImported):
+			result.Status, result.Reason, result.ChatID = "skipped", "already_imported", chatID
+		case err != nil:
+			s.log.Warn("failed to import conversation", "source", ic.source, "error", err)
+			result.Status, result.Reason = "failed", "import_failed"
+		default:
+			result.Status, result.ChatID = "imported", chatID
+		}
+		summary.add(result)
+
+	}
+
+	return summary, nil
+
+}
+
+// ImportChats imports a ChatGPT or Claude export, either the conversations.json file or the whole
+// archive. Images are only imported from archives.
+func (s *Service) ImportChats(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	// Archives need random access, so the upload is stored in a temporary file
+	tmp, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var size int64
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			size, err = io.Copy(tmp, part)
+			if err != nil {
+				s.log.Debug("failed to read upload", "error", err)
+				http.Error(w, "Unable to get file from form", http.StatusBadRequest)
+				return
+			}
+			break
+		}
+	}
+	if size == 0 {
+		http.Error(w, "Unable to get file from form", http.StatusBadRequest)
+		return
+	}
+
+	var conversations io.Reader = io.NewSectionReader(tmp, 0, size)
+	var files exportFiles
+
+	if zr, err := zip.NewReader(tmp, size); err == nil {
+		var found *zip.File
+		for _, f := range zr.File {
+			if path.Base(f.Name) == "conversations.json" && (found == nil || len(f.Name) < len(found.Name)) {
+				found = f
+			} else if !f.FileInfo().IsDir() {
+				files = append(files, f)
+			}
+		}
+		if found == nil {
+			http.Error(w, "conversations_not_found", http.StatusBadRequest)
+			return
+		}
+		rc, err := found.Open()
+		if err != nil {
+			http.Error(w, "invalid_export", http.StatusBadRequest)
+			return
+		}
+		defer rc.Close()
+		conversations = rc
+	}
+
+	summary, err := s.importConversations(userID, conversations, files)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
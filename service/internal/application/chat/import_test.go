@@ -0,0 +1,322 @@
+package chat
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/google/uuid"
+)
+
+func TestFind(t *testing.T) {
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, size := range map[string]int{
+		"file-abcd.png":            1,
+		"dalle/file-abc-photo.jpg": 2,
+		"file-xyz.png":             importFileMaxSize + 1,
+		"file-big.png":             importFileMaxSize,
+	} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(make([]byte, size))
+	}
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := exportFiles(zr.File)
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"file-abc", "file-abc-photo.jpg"},
+		{"file-abcd", "file-abcd.png"},
+		{"file-ab", ""},
+		{"file-xyz", ""}, // Too large
+		{"file-big", "file-big.png"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if file, ok := files.find(tt.id); ok {
+			got = file.name
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+}
+
+func TestResolveModel(t *testing.T) {
+
+	models := map[string]llm.Model{
+		"claude-4-sonnet": {Name: "claude-sonnet-4-20250514", Provider: llm.Anthropic},
+		"claude-4-opus":   {Name: "claude-opus-4-20250514", Provider: llm.Anthropic},
+		"gpt-4o":          {Name: "gpt-4o", Provider: llm.OpenAI},
+		"gpt-4.1":         {Name: "gpt-4.1-2025-04-14", Provider: llm.OpenAI},
+		"llama":           {Name: "llama3", Provider: llm.Ollama},
+	}
+
+	tests := []struct {
+		name     string
+		model    string
+		provider llm.ModelProvider
+		want     string
+		ok       bool
+	}{
+		{"key", "gpt-4o", llm.OpenAI, "gpt-4o", true},
+		{"provider model name", "claude-opus-4-20250514", llm.Anthropic, "claude-4-opus", true},
+		{"name prefix", "gpt-4.1", llm.OpenAI, "gpt-4.1", true},
+		{"generic name", "claude", llm.Anthropic, "claude-4-opus", true},
+		{"unknown model of the provider", "text-davinci-002-render-sha", llm.OpenAI, "gpt-4.1", true},
+		{"no model", "", llm.Ollama, "llama", true},
+		{"provider not configured", "gemini-pro", llm.Gemini, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := resolveModel(models, tt.model, tt.provider)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+}
+
+func TestMapModels(t *testing.T) {
+
+	models := map[string]llm.Model{
+		"gpt-4o": {Name: "gpt-4o", Provider: llm.OpenAI},
+		"llama":  {Name: "llama3", Provider: llm.Ollama},
+	}
+
+	tests := []struct {
+		name     string
+		provider llm.ModelProvider
+		model    string
+		messages []string // Models of the assistant messages
+		want     string
+		wantMsgs []string
+	}{
+		{"configured", llm.OpenAI, "gpt-4o", []string{"gpt-4o", "gpt-4o-mini"}, "gpt-4o", []string{"gpt-4o", "gpt-4o"}},
+		{"fallback to the chat's model", llm.Anthropic, "claude", []string{"claude"}, "gpt-4o", []string{"gpt-4o"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ic := &importedChat{provider: tt.provider, model: tt.model}
+			ic.messages = append(ic.messages, importedMessage{role: "user"})
+			for _, m := range tt.messages {
+				ic.messages = append(ic.messages, importedMessage{role: "assistant", model: m})
+			}
+			ic.mapModels(models)
+
+			var got []string
+			for _, m := range ic.messages[1:] {
+				got = append(got, m.model)
+			}
+			if ic.model != tt.want || !slices.Equal(got, tt.wantMsgs) || ic.messages[0].model != "" {
+				t.Errorf("got chat model %q and message models %v, want %q and %v", ic.model, got, tt.want, tt.wantMsgs)
+			}
+
+		})
+	}
+
+}
+
+// messageTree describes the imported messages as `key<parent role "content"` for comparison.
+func messageTree(ic *importedChat) []string {
+	tree := make([]string, len(ic.messages))
+	for i, m := range ic.messages {
+		tree[i] = fmt.Sprintf("%s<%s %s %q", m.key, m.parentKey, m.role, m.content)
+	}
+	return tree
+}
+
+func TestChatGPT(t *testing.T) {
+
+	var c conversation
+	err := json.Unmarshal([]byte(`{
+		"conversation_id": "conv",
+		"title": "Branches",
+		"create_time": 1700000000.5,
+		"current_node": "a2",
+		"mapping": {
+			"root": {"id": "root", "children": ["sys"]},
+			"sys": {"id": "sys", "parent": "root", "children": ["u1"], "message": {
+				"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]},
+				"metadata": {"is_visually_hidden_from_conversation": true}}},
+			"u1": {"id": "u1", "parent": "sys", "children": ["a1", "t2"], "message": {
+				"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["Hi"]}}},
+			"a1": {"id": "a1", "parent": "u1", "message": {
+				"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Hello"]},
+				"metadata": {"model_slug": "gpt-4"}}},
+			"t2": {"id": "t2", "parent": "u1", "children": ["a2"], "message": {
+				"author": {"role": "assistant"}, "content": {"content_type": "thoughts", "thoughts": [{"content": "Greet back"}]}}},
+			"a2": {"id": "a2", "parent": "t2", "message": {
+				"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Hey"]},
+				"metadata": {"model_slug": "o3"}}}
+		}
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := c.chatGPT(nil)
+
+	want := []string{`u1< user "Hi"`, `a1<u1 assistant "Hello"`, `a2<u1 assistant "Hey"`}
+	if got := messageTree(ic); !slices.Equal(got, want) {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+	if ic.activeKey != "a2" || ic.model != "o3" || ic.source != "chatgpt:conv" || ic.createdAt != 1700000000500 {
+		t.Errorf("got active %q, model %q, source %q, created at %d", ic.activeKey, ic.model, ic.source, ic.createdAt)
+	}
+	if ic.messages[2].reasoning != "Greet back" {
+		t.Errorf("got reasoning %q", ic.messages[2].reasoning)
+	}
+
+}
+
+func TestClaude(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		messages string
+		want     []string
+		active   string
+	}{
+		{
+			name: "linear",
+			messages: `[
+				{"uuid": "u1", "sender": "human", "text": "Hi"},
+				{"uuid": "a1", "sender": "assistant", "content": [{"type": "thinking", "thinking": "Hm"}, {"type": "text", "text": "Hello"}]},
+				{"uuid": "e1", "sender": "human", "text": ""}
+			]`,
+			want:   []string{`u1< user "Hi"`, `a1<u1 assistant "Hello"`},
+			active: "a1",
+		},
+		{
+			name: "branches",
+			messages: `[
+				{"uuid": "u1", "parent_message_uuid": "00000000-0000-4000-8000-000000000000", "sender": "human", "text": "Hi"},
+				{"uuid": "a1", "parent_message_uuid": "u1", "sender": "assistant", "text": "Hello"},
+				{"uuid": "a2", "parent_message_uuid": "u1", "sender": "assistant", "text": "Hey"}
+			]`,
+			want:   []string{`u1< user "Hi"`, `a1<u1 assistant "Hello"`, `a2<u1 assistant "Hey"`},
+			active: "a2",
+		},
+		{
+			name: "skipped message",
+			messages: `[
+				{"uuid": "u1", "parent_message_uuid": "00000000-0000-4000-8000-000000000000", "sender": "human", "text": "Hi"},
+				{"uuid": "a1", "parent_message_uuid": "u1", "sender": "assistant", "text": "Hello"},
+				{"uuid": "e1", "parent_message_uuid": "a1", "sender": "human", "text": ""},
+				{"uuid": "e2", "parent_message_uuid": "e1", "sender": "assistant", "content": [{"type": "tool_use"}]},
+				{"uuid": "u2", "parent_message_uuid": "e2", "sender": "human", "text": "Thanks"}
+			]`,
+			want:   []string{`u1< user "Hi"`, `a1<u1 assistant "Hello"`, `u2<a1 user "Thanks"`},
+			active: "u2",
+		},
+		{
+			name: "attachment only",
+			messages: `[
+				{"uuid": "u1", "sender": "human", "attachments": [{"file_name": "a.txt", "extracted_content": "text"}]}
+			]`,
+			want:   []string{`u1< user ""`},
+			active: "u1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var c conversation
+			if err := json.Unmarshal([]byte(`{"uuid": "conv", "chat_messages": `+tt.messages+`}`), &c); err != nil {
+				t.Fatal(err)
+			}
+
+			ic := c.claude()
+			if got := messageTree(ic); !slices.Equal(got, tt.want) {
+				t.Errorf("got messages %q, want %q", got, tt.want)
+			}
+			if ic.activeKey != tt.active {
+				t.Errorf("got active message %q, want %q", ic.activeKey, tt.active)
+			}
+
+		})
+	}
+
+}
+
+func TestImportChat(t *testing.T) {
+
+	s := newTestService(t)
+	userID := uuid.New()
+
+	ic := &importedChat{
+		source: "claude:conv",
+		title:  "Imported",
+		model:  "claude",
+		messages: []importedMessage{
+			{key: "u1", role: "user", content: "Hi", createdAt: 1, files: []importedFile{{name: "a.txt", mimeType: "text/plain", data: []byte("text")}}},
+			{key: "a1", parentKey: "u1", role: "assistant", content: "Hello", model: "claude", createdAt: 2},
+			{key: "a2", parentKey: "u1", role: "assistant", content: "Hey", model: "claude", createdAt: 3},
+		},
+		activeKey: "a1",
+	}
+
+	// Attachments cannot be written, the chat must not be stored
+	if err := os.MkdirAll("data/users", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fmt.Sprintf("data/users/%s", userID), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.importChat(userID, ic); err == nil {
+		t.Fatal("import succeeded without attachments")
+	}
+	for _, table := range []string{"chats", "messages", "attachments"} {
+		var n int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil || n != 0 {
+			t.Errorf("failed import left %d rows in %s (%v)", n, table, err)
+		}
+	}
+	os.Remove(fmt.Sprintf("data/users/%s", userID))
+
+	chatID, err := s.importChat(userID, ic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.loadChat(chatID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Messages) != 3 || c.Messages[0].ParentID != uuid.Nil || c.Messages[2].ParentID != c.Messages[0].ID {
+		t.Errorf("got %d messages with the wrong parents", len(c.Messages))
+	}
+	if c.ActiveMessageID != c.Messages[1].ID {
+		t.Errorf("got active message %s, want %s", c.ActiveMessageID, c.Messages[1].ID)
+	}
+
+	if existing, err := s.importChat(userID, ic); !errors.Is(err, errAlreadyImported) || existing != chatID {
+		t.Errorf("second import: got %s, %v, want %s, %v", existing, err, chatID, errAlreadyImported)
+	}
+
+}
@@ -0,0 +1,296 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	chatPageMaxLimit    = 200
+	messagePageMaxLimit = 200
+)
+
+// chatSorts maps the sort options of ListChats to the columns they order by, all descending.
+// The id comes last, so the order is total and a cursor identifies a position unambiguously.
+var chatSorts = map[string][]string{
+	"last_message_at": {"last_message_at", "id"},
+	"created_at":      {"created_at", "id"},
+	"pinned":          {"is_pinned", "last_message_at", "id"}, // Pinned chats first, then the most recent
+}
+
+// chatQuery holds the filters and the page of a chat listing.
+type chatQuery struct {
+	Sort    string
+	Limit   int   // 0 returns all chats
+	After   []any // Values of the sort columns of the last chat of the previous page
+	Model   string
+	Status  string
+	Project string // Project id, "none" for chats outside of projects
+	From    int64  // Only chats with a message at or after this time, as Unix Timestamp
+	To      int64  // Only chats with a message before this time, as Unix Timestamp
+}
+
+// chatCursor is the position after the last chat of a page, encoded opaquely for clients.
+type chatCursor struct {
+	Sort   string `json:"s"`
+	Values []any  `json:"v"`
+}
+
+func encodeCursor(c chatCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (chatCursor, error) {
+	var c chatCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber() // Timestamps would lose precision as float64
+	if err := dec.Decode(&c); err != nil {
+		return c, err
+	}
+	for i, v := range c.Values {
+		switch v := v.(type) {
+		case json.Number:
+			if c.Values[i], err = v.Int64(); err != nil {
+				return c, err
+			}
+		case string:
+		default:
+			return c, fmt.Errorf("invalid cursor value %v", v)
+		}
+	}
+	return c, nil
+}
+
+// parseChatQuery reads the listing options from the query string.
+func parseChatQuery(values url.Values) (*chatQuery, error) {
+
+	q := &chatQuery{
+		Sort:    "last_message_at",
+		Model:   values.Get("model"),
+		Status:  values.Get("status"),
+		Project: values.Get("project_id"),
+	}
+
+	if q.Project != "" && q.Project != "none" {
+		if _, err := uuid.Parse(q.Project); err != nil {
+			return nil, &requestError{http.StatusBadRequest, "invalid_project_id"}
+		}
+	}
+
+	if v := values.Get("sort"); v != "" {
+		if _, ok := chatSorts[v]; !ok {
+			return nil, &requestError{http.StatusBadRequest, "invalid_sort"}
+		}
+		q.Sort = v
+	}
+
+	for name, dst := range map[string]*int64{"from": &q.From, "to": &q.To} {
+		if v := values.Get(name); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, &requestError{http.StatusBadRequest, "invalid_" + name}
+			}
+			*dst = t
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, &requestError{http.StatusBadRequest, "invalid_limit"}
+		}
+		q.Limit = min(limit, chatPageMaxLimit)
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil || c.Sort != q.Sort || len(c.Values) != len(chatSorts[q.Sort]) {
+			return nil, &requestError{http.StatusBadRequest, "invalid_cursor"}
+		}
+		q.After = c.Values
+	}
+
+	return q, nil
+
+}
+
+// listChats returns a page of the user's chats and the cursor of the next page, if there is one.
+func (s *Service) listChats(userID uuid.UUID, q *chatQuery) ([]ChatListItem, string, error) {
+
+	columns := chatSorts[q.Sort]
+
+	where := []string{"user_id = ?"}
+	args := []any{userID}
+	if q.Model != "" {
+		where = append(where, "model = ?")
+		args = append(args, q.Model)
+	}
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+	if q.Project == "none" {
+		where = append(where, "project_id = ''")
+	} else if q.Project != "" {
+		where = append(where, "project_id = ?")
+		args = append(args, q.Project)
+	}
+	if q.From > 0 {
+		where = append(where, "last_message_at >= ?")
+		args = append(args, q.From)
+	}
+	if q.To > 0 {
+		where = append(where, "last_message_at < ?")
+		args = append(args, q.To)
+	}
+	if q.After != nil {
+		// Row values compare like the descending order, so this continues after the cursor
+		where = append(where, fmt.Sprintf("(%s) < (%s)",
+			strings.Join(columns, ", "),
+			strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "),
+		))
+		args = append(args, q.After...)
+	}
+
+	query := fmt.Sprintf("SELECT id, project_id, title, model, is_pinned, status, last_message_at, created_at, shared_at FROM chats WHERE %s ORDER BY %s DESC",
+		strings.Join(where, " AND "), strings.Join(columns, " DESC, "),
+	)
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1) // One more to know if there is a next page
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	chats := make([]ChatListItem, 0)
+	for rows.Next() {
+		var chat ChatListItem
+		var projectID string
+		if err := rows.Scan(&chat.ID, &projectID, &chat.Title, &chat.Model, &chat.IsPinned, &chat.Status, &chat.LastMessageAt, &chat.CreatedAt, &chat.SharedAt); err != nil {
+			return nil, "", err
+		}
+		chat.ProjectID, _ = uuid.Parse(projectID)
+		chats = append(chats, chat)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if q.Limit == 0 || len(chats) <= q.Limit {
+		return chats, "", nil
+	}
+
+	chats = chats[:q.Limit]
+	last := chats[len(chats)-1]
+	var pinned int64
+	if last.IsPinned {
+		pinned = 1
+	}
+	values := map[string]any{
+		"last_message_at": last.LastMessageAt,
+		"created_at":      last.CreatedAt,
+		"is_pinned":       pinned,
+		"id":              last.ID.String(),
+	}
+	cursor := chatCursor{Sort: q.Sort}
+	for _, column := range columns {
+		cursor.Values = append(cursor.Values, values[column])
+	}
+
+	return chats, encodeCursor(cursor), nil
+
+}
+
+// getChatPage returns the chat with up to limit messages of its active branch that come before
+// the given message, or the latest messages if before is zero. Only the branch structure of the
+// chat is loaded in full, contents and attachments are loaded for the messages of the page.
+func (s *Service) getChatPage(chatID, userID, before uuid.UUID, limit int) (*Chat, error) {
+
+	rows, err := s.db.Query(`
+		SELECT c.active_message_id, m.id, m.parent_id
+		FROM chats c
+		LEFT JOIN messages m ON c.id = m.chat_id
+		WHERE c.id = ? AND c.user_id = ?
+		ORDER BY m.created_at ASC`,
+		chatID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tree *Chat
+	for rows.Next() {
+		var activeMessageID string
+		var mID, mParentID *string
+		if err := rows.Scan(&activeMessageID, &mID, &mParentID); err != nil {
+			return nil, err
+		}
+		if tree == nil {
+			tree = &Chat{}
+			tree.ActiveMessageID, _ = uuid.Parse(activeMessageID)
+		}
+		if mID != nil {
+			message := Message{ID: uuid.MustParse(*mID)}
+			message.ParentID, _ = uuid.Parse(*mParentID)
+			tree.Messages = append(tree.Messages, message)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if tree == nil {
+		return nil, errChatNotFound
+	}
+
+	branch := tree.branch(tree.activeLeaf())
+	end := len(branch)
+	if before != uuid.Nil {
+		end = slices.IndexFunc(branch, func(m Message) bool { return m.ID == before })
+		if end < 0 {
+			return nil, errMessageNotFound
+		}
+	}
+	page := branch[max(end-limit, 0):end]
+
+	ids := make([]uuid.UUID, len(page))
+	for i, m := range page {
+		ids[i] = m.ID
+	}
+
+	c, err := s.queryChat(chatID, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// Loaded messages are in creation order, like the branch
+	for i := range c.Messages {
+		if j := slices.IndexFunc(page, func(m Message) bool { return m.ID == c.Messages[i].ID }); j >= 0 {
+			c.Messages[i].SiblingIndex = page[j].SiblingIndex
+			c.Messages[i].SiblingCount = page[j].SiblingCount
+			c.Messages[i].Siblings = page[j].Siblings
+		}
+	}
+	c.HasMore = end-limit > 0
+
+	return c, nil
+
+}
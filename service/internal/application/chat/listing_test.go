@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCursor(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		value   string
+		want    chatCursor
+		wantErr bool
+	}{
+		{
+			name:  "round trip",
+			value: encodeCursor(chatCursor{Sort: "pinned", Values: []any{int64(1), int64(1<<53 + 1), "id"}}),
+			want:  chatCursor{Sort: "pinned", Values: []any{int64(1), int64(1<<53 + 1), "id"}},
+		},
+		{name: "invalid encoding", value: "not base64!", wantErr: true},
+		{name: "invalid json", value: base64.RawURLEncoding.EncodeToString([]byte("{")), wantErr: true},
+		{name: "fraction", value: base64.RawURLEncoding.EncodeToString([]byte(`{"s":"created_at","v":[1.5,"id"]}`)), wantErr: true},
+		{name: "object value", value: base64.RawURLEncoding.EncodeToString([]byte(`{"s":"created_at","v":[{},"id"]}`)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCursor(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.Sort != tt.want.Sort || !slices.Equal(got.Values, tt.want.Values)) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestParseChatQuery(t *testing.T) {
+
+	cursor := encodeCursor(chatCursor{Sort: "created_at", Values: []any{int64(5), "id"}})
+
+	tests := []struct {
+		query   string
+		want    chatQuery
+		wantErr string
+	}{
+		{"", chatQuery{Sort: "last_message_at"}, ""},
+		{"sort=pinned&limit=20&model=gpt-4o&status=done", chatQuery{Sort: "pinned", Limit: 20, Model: "gpt-4o", Status: "done"}, ""},
+		{"limit=1000", chatQuery{Sort: "last_message_at", Limit: chatPageMaxLimit}, ""},
+		{"from=10&to=20&project_id=none", chatQuery{Sort: "last_message_at", From: 10, To: 20, Project: "none"}, ""},
+		{"sort=created_at&cursor=" + cursor, chatQuery{Sort: "created_at", After: []any{int64(5), "id"}}, ""},
+		{"sort=title", chatQuery{}, "invalid_sort"},
+		{"limit=0", chatQuery{}, "invalid_limit"},
+		{"from=yesterday", chatQuery{}, "invalid_from"},
+		{"project_id=x", chatQuery{}, "invalid_project_id"},
+		{"cursor=" + cursor, chatQuery{}, "invalid_cursor"}, // Cursor of another sort
+		{"cursor=x", chatQuery{}, "invalid_cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+
+			values, _ := url.ParseQuery(tt.query)
+			q, err := parseChatQuery(values)
+
+			var reqErr *requestError
+			if tt.wantErr != "" {
+				if !errors.As(err, &reqErr) || reqErr.code != tt.wantErr {
+					t.Errorf("got error %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(*q, tt.want) {
+				t.Errorf("got %+v, want %+v", *q, tt.want)
+			}
+
+		})
+	}
+
+}
+
+func TestListChats(t *testing.T) {
+
+	s := newTestService(t)
+	userID := uuid.New()
+
+	// Timestamps repeat, so pages have to continue by id within the same time
+	for i := range 9 {
+		_, err := s.db.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			uuid.New(), userID, fmt.Sprint("Chat ", i), "model", i%4 == 0, "done", i/2, i/2, (9-i)/3, 0,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for sort := range chatSorts {
+		for _, limit := range []int{1, 2, 4, 9, 10} {
+			t.Run(fmt.Sprintf("%s by %d", sort, limit), func(t *testing.T) {
+
+				all, next, err := s.listChats(userID, &chatQuery{Sort: sort})
+				if err != nil || next != "" || len(all) != 9 {
+					t.Fatalf("got %d chats, cursor %q and error %v", len(all), next, err)
+				}
+
+				var paged []ChatListItem
+				q := &chatQuery{Sort: sort, Limit: limit}
+				for {
+					page, next, err := s.listChats(userID, q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(page) > limit {
+						t.Fatalf("got page of %d chats", len(page))
+					}
+					paged = append(paged, page...)
+					if next == "" {
+						break
+					}
+					values := url.Values{"sort": {sort}, "limit": {fmt.Sprint(limit)}, "cursor": {next}}
+					if q, err = parseChatQuery(values); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if !slices.EqualFunc(paged, all, func(a, b ChatListItem) bool { return a.ID == b.ID }) {
+					t.Errorf("pages differ from the full listing")
+				}
+
+			})
+		}
+	}
+
+}
+
+func TestGetChatPage(t *testing.T) {
+
+	s := newTestService(t)
+	userID, chatID := uuid.New(), uuid.New()
+
+	_, err := s.db.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chatID, userID, "Chat", "model", false, "done", 0, 0, 0, 0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Five messages on the active branch and an older version of the third one
+	var branch []uuid.UUID
+	parent := uuid.Nil
+	for i := range 6 {
+		id := uuid.New()
+		_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			id, chatID, userID, parentString(parent), uuid.UUID{}, "user", "done", "model", fmt.Sprint(i), "", i, i,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			continue // Replaced by the next message
+		}
+		branch = append(branch, id)
+		parent = id
+	}
+
+	for _, limit := range []int{1, 2, 5, 6} {
+
+		var paged []uuid.UUID
+		before := uuid.Nil
+		for {
+			c, err := s.getChatPage(chatID, userID, before, limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]uuid.UUID, len(c.Messages))
+			for i, m := range c.Messages {
+				ids[i] = m.ID
+			}
+			paged = append(ids, paged...)
+			if !c.HasMore {
+				break
+			}
+			before = ids[0]
+		}
+
+		if !slices.Equal(paged, branch) {
+			t.Errorf("limit %d: pages differ from the active branch", limit)
+		}
+
+	}
+
+	if _, err := s.getChatPage(chatID, userID, uuid.New(), 2); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("unknown message: got error %v, want %v", err, errMessageNotFound)
+	}
+
+}
@@ -3,10 +3,12 @@ package chat
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -24,6 +26,8 @@ type ChatCompletionRequest struct {
 	// Options
 	Model           string `json:"model"`
 	ReasoningEffort int32  `json:"reasoning_effort"`
+	// Only used for new chats
+	ProjectID uuid.UUID `json:"project_id,omitzero"`
 }
 
 func (s *Service) newChat(userID uuid.UUID, request ChatCompletionRequest) (*Chat, error) {
@@ -32,7 +36,8 @@ func (s *Service) newChat(userID uuid.UUID, request ChatCompletionRequest) (*Cha
 	newChat := Chat{
 		ID:            uuid.New(),
 		UserID:        userID,
-		Title:         fmt.Sprintf("New Chat %d", time.Now().Unix()), // TODO: Generate title based on the first message using a lightweight model
+		ProjectID:     request.ProjectID,
+		Title:         fmt.Sprintf("New Chat %d", time.Now().Unix()), // Replaced by generateTitle after the first exchange
 		Model:         request.Model,
 		IsPinned:      false,
 		Status:        "streaming",
@@ -42,8 +47,8 @@ func (s *Service) newChat(userID uuid.UUID, request ChatCompletionRequest) (*Cha
 		SharedAt:      0,
 	}
 
-	_, err := s.db.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		newChat.ID, newChat.UserID,
+	_, err := s.db.Exec("INSERT INTO chats (id, user_id, project_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newChat.ID, newChat.UserID, parentString(newChat.ProjectID),
 		newChat.Title, newChat.Model,
 		newChat.IsPinned, newChat.Status,
 		newChat.CreatedAt, newChat.UpdatedAt,
@@ -59,13 +64,14 @@ func (s *Service) newChat(userID uuid.UUID, request ChatCompletionRequest) (*Cha
 
 }
 
-func (s *Service) newUserMessage(chatID, userID uuid.UUID, request ChatCompletionRequest) (*chat.Message, error) {
+func (s *Service) newUserMessage(chatID, userID, parentID uuid.UUID, request ChatCompletionRequest) (uuid.UUID, *chat.Message, error) {
 
 	now := time.Now()
 	message := Message{
 		ID:        uuid.New(),
 		ChatID:    chatID,
 		UserID:    userID,
+		ParentID:  parentID,
 		Role:      "user",
 		Status:    "done",
 		Model:     request.Model,
@@ -74,15 +80,15 @@ func (s *Service) newUserMessage(chatID, userID uuid.UUID, request ChatCompletio
 		UpdatedAt: now.UnixMilli(),
 	}
 
-	_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		message.ID, message.ChatID, message.UserID, message.StreamID,
+	_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		message.ID, message.ChatID, message.UserID, parentString(message.ParentID), message.StreamID,
 		message.Role, message.Status, message.Model,
 		message.Content, message.Reasoning,
 		message.CreatedAt, message.UpdatedAt,
 	)
 	if err != nil {
 		s.log.Warn("failed to insert message into database", "error", err)
-		return nil, err
+		return uuid.UUID{}, nil, err
 	}
 
 	attachments, err := s.loadAndUpdateAttachments(request.Attachments, message.ID, userID)
@@ -91,7 +97,7 @@ func (s *Service) newUserMessage(chatID, userID uuid.UUID, request ChatCompletio
 		// Note: Consider whether this should be a fatal error or just logged
 	}
 
-	return &chat.Message{
+	return message.ID, &chat.Message{
 		Role:        "user",
 		Content:     request.Content,
 		Attachments: attachments,
@@ -99,23 +105,24 @@ func (s *Service) newUserMessage(chatID, userID uuid.UUID, request ChatCompletio
 
 }
 
-func (s *Service) createAssistantMessage(chatID, userID, streamID uuid.UUID, request ChatCompletionRequest, isPremium bool) (uuid.UUID, error) {
+func (s *Service) createAssistantMessage(messageID, chatID, userID, parentID, streamID uuid.UUID, request ChatCompletionRequest, isPremium bool) (uuid.UUID, error) {
 
 	now := time.Now()
 	message := Message{
-		ID:        uuid.New(),
+		ID:        messageID,
 		ChatID:    chatID,
 		UserID:    userID,
+		ParentID:  parentID,
 		StreamID:  streamID,
 		Role:      "assistant",
-		Status:    "streaming",
+		Status:    "queued", // Set to "streaming" once the generation starts
 		Model:     request.Model,
 		CreatedAt: now.UnixMilli(),
 		UpdatedAt: now.UnixMilli(),
 	}
 
-	_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		message.ID, message.ChatID, message.UserID, message.StreamID,
+	_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		message.ID, message.ChatID, message.UserID, parentString(message.ParentID), message.StreamID,
 		message.Role, message.Status, message.Model,
 		message.Content, message.Reasoning,
 		message.CreatedAt, message.UpdatedAt,
@@ -126,6 +133,15 @@ func (s *Service) createAssistantMessage(chatID, userID, streamID uuid.UUID, req
 		return uuid.UUID{}, err
 	}
 
+	s.countUsage(userID, isPremium)
+
+	return message.ID, nil
+
+}
+
+// countUsage counts a message against the user's premium or standard message limit.
+func (s *Service) countUsage(userID uuid.UUID, isPremium bool) {
+	var err error
 	if isPremium {
 		_, err = s.db.Exec("UPDATE user_profile SET usage_premium = usage_premium + 1 WHERE user_id = ?", userID)
 	} else {
@@ -135,26 +151,140 @@ func (s *Service) createAssistantMessage(chatID, userID, streamID uuid.UUID, req
 		s.log.Warn("unable to update message usage", "user_id", userID, "error", err)
 		fmt.Println("unable to update message usage:", err)
 	}
+}
 
-	return message.ID, nil
+// storeStream returns a close func that stores the final content and metrics of a stream on its assistant message.
+func (s *Service) storeStream(compl *stream.Stream, streamID, messageID uuid.UUID) stream.CloseFunc {
+	return func(chunk stream.Chunk, serr error) {
+
+		status := stream.Status(serr)
+		var ierr *stream.InterceptError
+		if errors.As(serr, &ierr) {
+			s.log.Info("stream was terminated by interceptor", "stream_id", streamID, "interceptor", ierr.Interceptor, "reason", ierr.Reason)
+		} else if status == "error" {
+			s.log.Error("stream failed", "stream_id", streamID, "error", serr)
+		}
+
+		var blocks, reasoningBlocks []byte
+		if len(chunk.Blocks) > 0 {
+			var err error
+			if blocks, err = json.Marshal(chunk.Blocks); err != nil {
+				s.log.Warn("failed to encode blocks", "stream_id", streamID, "error", err)
+			}
+		}
+		if len(chunk.ReasoningBlocks) > 0 {
+			var err error
+			if reasoningBlocks, err = json.Marshal(chunk.ReasoningBlocks); err != nil {
+				s.log.Warn("failed to encode reasoning blocks", "stream_id", streamID, "error", err)
+			}
+		}
+
+		metrics := compl.Metrics()
+		_, err := s.db.Exec(`
+			UPDATE messages SET
+				content = ?, reasoning = ?, blocks = ?, reasoning_blocks = ?, status = ?, updated_at = ?,
+				ttft_ms = ?, ttfc_ms = ?, duration_ms = ?, output_tokens = ?, tokens_per_second = ?
+			WHERE id = ?`,
+			chunk.Content, chunk.Reasoning, string(blocks), string(reasoningBlocks), status, time.Now().UnixMilli(),
+			metrics.TimeToFirstToken().Milliseconds(), metrics.TimeToFirstContent().Milliseconds(),
+			metrics.Duration().Milliseconds(), metrics.OutputTokens, metrics.TokensPerSecond(),
+			messageID,
+		)
+		if err != nil {
+			s.log.Error("storing stream content failed", "stream_id", streamID, "error", err)
+			return
+		}
+
+	}
+}
+
+// checkpointStream returns a checkpoint func that stores the content streamed so far on its assistant message,
+// so that it survives a crash of the service.
+func (s *Service) checkpointStream(streamID, messageID uuid.UUID) stream.CheckpointFunc {
+	return func(chunk stream.Chunk) {
+
+		var blocks []byte
+		if len(chunk.Blocks) > 0 {
+			var err error
+			if blocks, err = json.Marshal(chunk.Blocks); err != nil {
+				s.log.Warn("failed to encode blocks", "stream_id", streamID, "error", err)
+			}
+		}
+
+		_, err := s.db.Exec("UPDATE messages SET content = ?, reasoning = ?, blocks = ?, updated_at = ? WHERE id = ? AND status = 'streaming'",
+			chunk.Content, chunk.Reasoning, string(blocks), time.Now().UnixMilli(), messageID,
+		)
+		if err != nil {
+			s.log.Warn("storing stream checkpoint failed", "stream_id", streamID, "error", err)
+		}
+
+	}
+}
+
+// recoverStreams marks assistant messages that were still queued or streaming when the service stopped as interrupted.
+// They keep the content of their last checkpoint.
+func (s *Service) recoverStreams() error {
+
+	res, err := s.db.Exec("UPDATE messages SET status = 'interrupted', updated_at = ? WHERE status IN ('queued', 'streaming')", time.Now().UnixMilli())
+	if err != nil {
+		s.log.Error("failed to recover interrupted streams", "error", err)
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		s.log.Info("marked interrupted streams", "messages", n)
+	}
+
+	return nil
 
 }
 
+// getChat returns the chat with the messages of its active branch.
 func (s *Service) getChat(chatID, userID uuid.UUID) (*Chat, error) {
 
+	c, err := s.loadChat(chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Messages = c.branch(c.activeLeaf())
+
+	return c, nil
+
+}
+
+// loadChat returns the chat with the messages of all branches, ordered by creation.
+func (s *Service) loadChat(chatID, userID uuid.UUID) (*Chat, error) {
+	return s.queryChat(chatID, userID, nil)
+}
+
+// queryChat returns the chat with the given messages, or all messages if messageIDs is nil.
+func (s *Service) queryChat(chatID, userID uuid.UUID, messageIDs []uuid.UUID) (*Chat, error) {
+
+	args := []any{}
+	filter := ""
+	if messageIDs != nil {
+		// The empty id keeps the list valid if no messages are requested
+		filter = "AND m.id IN (''" + strings.Repeat(", ?", len(messageIDs)) + ")"
+		for _, id := range messageIDs {
+			args = append(args, id)
+		}
+	}
+	args = append(args, chatID, userID)
+
 	query := `
         SELECT
-            c.id, c.user_id, c.title, c.model, c.is_pinned, c.status, c.last_message_at, c.created_at, c.updated_at,
-            m.id, m.stream_id, m.role, m.model, m.content, m.reasoning, m.status, m.created_at, m.updated_at,
+            c.id, c.user_id, c.title, c.model, c.is_pinned, c.status, c.last_message_at, c.created_at, c.updated_at, c.active_message_id, c.project_id,
+            m.id, m.parent_id, m.stream_id, m.role, m.model, m.content, m.reasoning, m.blocks, m.reasoning_blocks, m.status, m.created_at, m.updated_at,
             a.id, a.name, a.type, a.src, a.created_at
         FROM chats c
-        LEFT JOIN messages m ON c.id = m.chat_id
+        LEFT JOIN messages m ON c.id = m.chat_id ` + filter + `
         LEFT JOIN attachments a ON m.id = a.message_id
         WHERE c.id = ? AND c.user_id = ?
         ORDER BY m.created_at ASC, a.created_at ASC
     `
 
-	rows, err := s.db.Query(query, chatID, userID)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		s.log.Debug("failed to query chat", "chat_id", chatID, "error", err)
 		return nil, err
@@ -167,19 +297,19 @@ func (s *Service) getChat(chatID, userID uuid.UUID) (*Chat, error) {
 	for rows.Next() {
 		var (
 			// Chat fields
-			cID, cUserID, cTitle, cModel, cStatus  string
-			cIsPinned                              int
-			cLastMessageAt, cCreatedAt, cUpdatedAt int64
+			cID, cUserID, cTitle, cModel, cStatus, cActiveMessageID, cProjectID string
+			cIsPinned                                                           int
+			cLastMessageAt, cCreatedAt, cUpdatedAt                              int64
 			// Message fields (nullable)
-			mID, mStreamID, mRole, mModel, mContent, mReasoning, mStatus sql.NullString
-			mCreatedAt, mUpdatedAt, aCreatedAt                           sql.NullInt64
+			mID, mParentID, mStreamID, mRole, mModel, mContent, mReasoning, mBlocks, mReasoningBlocks, mStatus sql.NullString
+			mCreatedAt, mUpdatedAt, aCreatedAt                                                                 sql.NullInt64
 			// Attachment fields (nullable)
 			aID, aName, aType, aSrc sql.NullString
 		)
 
 		err := rows.Scan(
-			&cID, &cUserID, &cTitle, &cModel, &cIsPinned, &cStatus, &cLastMessageAt, &cCreatedAt, &cUpdatedAt,
-			&mID, &mStreamID, &mRole, &mModel, &mContent, &mReasoning, &mStatus, &mCreatedAt, &mUpdatedAt,
+			&cID, &cUserID, &cTitle, &cModel, &cIsPinned, &cStatus, &cLastMessageAt, &cCreatedAt, &cUpdatedAt, &cActiveMessageID, &cProjectID,
+			&mID, &mParentID, &mStreamID, &mRole, &mModel, &mContent, &mReasoning, &mBlocks, &mReasoningBlocks, &mStatus, &mCreatedAt, &mUpdatedAt,
 			&aID, &aName, &aType, &aSrc, &aCreatedAt,
 		)
 		if err != nil {
@@ -201,6 +331,8 @@ func (s *Service) getChat(chatID, userID uuid.UUID) (*Chat, error) {
 				UpdatedAt:     cUpdatedAt,
 				Messages:      []Message{},
 			}
+			chat.ActiveMessageID, _ = uuid.Parse(cActiveMessageID) // Empty until the first message
+			chat.ProjectID, _ = uuid.Parse(cProjectID)             // Empty if not part of a project
 		}
 
 		// Process message if it exists
@@ -219,6 +351,17 @@ func (s *Service) getChat(chatID, userID uuid.UUID) (*Chat, error) {
 					UpdatedAt:   mUpdatedAt.Int64,
 					Attachments: []Attachment{},
 				}
+				message.ParentID, _ = uuid.Parse(mParentID.String) // Empty for the first message
+				if mBlocks.String != "" {
+					if err := json.Unmarshal([]byte(mBlocks.String), &message.Blocks); err != nil {
+						s.log.Warn("failed to decode blocks", "message_id", mID.String, "error", err)
+					}
+				}
+				if mReasoningBlocks.String != "" {
+					if err := json.Unmarshal([]byte(mReasoningBlocks.String), &message.ReasoningBlocks); err != nil {
+						s.log.Warn("failed to decode reasoning blocks", "message_id", mID.String, "error", err)
+					}
+				}
 				messages[mID.String] = message
 				chat.Messages = append(chat.Messages, *message)
 			}
@@ -250,14 +393,16 @@ func (s *Service) getChat(chatID, userID uuid.UUID) (*Chat, error) {
 	}
 
 	if chat == nil {
-		return nil, fmt.Errorf("chat not found")
+		return nil, errChatNotFound
 	}
 
 	return chat, nil
 
 }
 
-func (c *Chat) ModelMessages(mf llm.ModelFeatures) ([]*chat.Message, error) {
+// ModelMessages converts the chat history to the model format. Reasoning blocks are
+// only included for messages that were created by a model of the same provider.
+func (c *Chat) ModelMessages(model llm.Model, mr *llm.ModelRouter) ([]*chat.Message, error) {
 
 	var messages []*chat.Message
 
@@ -269,12 +414,26 @@ func (c *Chat) ModelMessages(mf llm.ModelFeatures) ([]*chat.Message, error) {
 			Attachments: []*chat.Attachment{},
 		}
 
-		if mf.HasReasoning {
+		origin, ok := mr.GetModel(msg.Model)
+		sameProvider := ok && origin.Provider == model.Provider
+
+		if model.Features.HasReasoning {
 			message.Reasoning = msg.Reasoning
+			if sameProvider {
+				message.ReasoningBlocks = msg.ReasoningBlocks
+			}
 		}
 
 		for _, att := range msg.Attachments {
 
+			// Generated images are only accepted in assistant turns by the provider that generated them
+			if msg.Role == "assistant" && !sameProvider && msg.generated(att.ID) {
+				continue
+			}
+			if !supportsAttachment(model, att.Type) {
+				continue
+			}
+
 			attachment, err := att.ModelAttachment(c.UserID)
 			if err != nil {
 				fmt.Println("ERROR: ", err)
@@ -293,6 +452,30 @@ func (c *Chat) ModelMessages(mf llm.ModelFeatures) ([]*chat.Message, error) {
 
 }
 
+// generated reports whether the attachment is an image generated by the model, as opposed to a file
+// attached by the user.
+func (m *Message) generated(attachmentID uuid.UUID) bool {
+	return slices.ContainsFunc(m.Blocks, func(b stream.Block) bool {
+		return b.Type == "image" && b.AttachmentID == attachmentID.String()
+	})
+}
+
+// supportsAttachment reports whether the model accepts an attachment of the given type, e.g. when the
+// chat switched from a model with vision to one without. Text based attachments are sent as text.
+func supportsAttachment(model llm.Model, mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	switch {
+	case chat.IsText(mimeType):
+		return true
+	case strings.HasPrefix(mimeType, "image/"):
+		return model.Features.HasVision
+	case mimeType == "application/pdf":
+		return model.Features.HasPDF
+	default:
+		return true
+	}
+}
+
 func (a *Attachment) ModelAttachment(userID uuid.UUID) (*chat.Attachment, error) {
 
 	filePath := fmt.Sprintf("data/users/%s/attachments/%s", userID, a.ID)
@@ -308,87 +491,100 @@ func (a *Attachment) ModelAttachment(userID uuid.UUID) (*chat.Attachment, error)
 		return nil, fmt.Errorf("failed to read image file: %w", err)
 	}
 
-	return &chat.Attachment{
-		MimeType: a.Type,
-		Data:     attachmentData,
-	}, nil
+	return newModelAttachment(a.Name, a.Type, attachmentData), nil
 
 }
 
-func (s *Service) AddMessage(w http.ResponseWriter, r *http.Request) {
-
-	// Get userID from auth middleware, ok if authenticated
-	userID, ok := r.Context().Value("user_id").(uuid.UUID)
-	if !ok {
-		s.log.Debug("User is not authenticated")
-		http.Error(w, "not_authenticated", http.StatusUnauthorized)
-		return
+// newModelAttachment converts attachment data to the model format,
+// extracting the text of text based attachments.
+func newModelAttachment(name, mimeType string, data []byte) *chat.Attachment {
+	attachment := &chat.Attachment{
+		Name:     name,
+		MimeType: mimeType,
 	}
+	if chat.IsText(mimeType) {
+		attachment.Text = string(data)
+	} else {
+		attachment.Data = data
+	}
+	return attachment
+}
 
-	// Get chatID from URL params
-	chatID, err := uuid.Parse(mux.Vars(r)["id"])
-	if err != nil {
-		s.log.Debug("invalid uuid", "error", err)
-		http.Error(w, "invalid_id", http.StatusBadRequest)
+// requestError is returned by the message functions shared between transports.
+// Its code is sent to the client.
+type requestError struct {
+	status int
+	code   string
+}
+
+func (e *requestError) Error() string {
+	return e.code
+}
+
+// writeError writes err as an HTTP error response.
+func writeError(w http.ResponseWriter, err error) {
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		http.Error(w, rerr.code, rerr.status)
 		return
 	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
 
-	// Decode request body
-	var body ChatCompletionRequest
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		s.log.Debug("failed to decode request body", "error", err)
-		http.Error(w, "failed to decode request body", http.StatusBadRequest)
-		return
+// prepareCompletion resolves the requested model and checks the user's message limits.
+// Messages that start a new chat are not counted against the limits if the user has their own
+// key for the provider, but models requiring a key cannot be used without it. Messages in
+// existing chats always count.
+func (s *Service) prepareCompletion(userID uuid.UUID, body ChatCompletionRequest, newChat bool) (llm.Model, *UserProfile, error) {
+
+	// Streams started now would be aborted right away
+	if s.draining.Load() {
+		s.log.Debug("rejecting message during shutdown", "user_id", userID)
+		return llm.Model{}, nil, &requestError{http.StatusServiceUnavailable, "server_shutting_down"}
 	}
 
 	// Get used model from model router
 	model, ok := s.mr.GetModel(body.Model)
 	if !ok {
 		s.log.Debug("model not supported", "model", body.Model)
-		http.Error(w, "model_not_supported", http.StatusBadRequest)
-		return
+		return model, nil, &requestError{http.StatusBadRequest, "model_not_supported"}
 	}
 
 	profile, err := s.getUserProfile(userID)
 	if err != nil {
 		s.log.Warn("failed to get user profile", "error", err)
-		fmt.Println("failed to get user profile:", err)
+	}
+
+	if newChat {
+		if (model.Provider == "anthropic" && profile.AnthropicAPIKey != "") ||
+			(model.Provider == "gemini" && profile.GeminiAPIKey != "") ||
+			(model.Provider == "ollama" && profile.OllamaBaseURL != "") {
+			return model, profile, nil
+		}
+		if model.Flags.IsKeyRequired {
+			s.log.Debug("model requires bring your own key", "user_id", userID)
+			return model, nil, &requestError{http.StatusForbidden, "model_requires_key"}
+		}
 	}
 
 	if model.Flags.IsPremium {
 		if profile.UsagePremium >= profile.LimitPremium {
 			s.log.Debug("premium message limit reached", "user_id", userID)
-			http.Error(w, "premium_message_limit_reached", http.StatusForbidden)
-			return
+			return model, nil, &requestError{http.StatusForbidden, "premium_message_limit_reached"}
 		}
 	} else {
 		if profile.UsageStandard >= profile.LimitStandard {
 			s.log.Debug("standard message limit reached", "user_id", userID)
-			http.Error(w, "standard_message_limit_reached", http.StatusForbidden)
-			return
+			return model, nil, &requestError{http.StatusForbidden, "standard_message_limit_reached"}
 		}
 	}
 
-	c, err := s.getChat(chatID, userID)
-	if err != nil {
-		s.log.Debug("failed to get chat", "chat_id", chatID, "error", err)
-		http.Error(w, "get_chat_failed", http.StatusInternalServerError)
-		return
-	}
+	return model, profile, nil
 
-	messages, err := c.ModelMessages(model.Features)
-	if err != nil {
-		s.log.Debug("failed to get chat messages", "chat_id", chatID, "error", err)
-		http.Error(w, "get_messages_failed", http.StatusInternalServerError)
-		return
-	}
+}
 
-	message, err := s.newUserMessage(chatID, userID, body)
-	if err != nil {
-		s.log.Warn("failed to create user message", "error", err)
-		http.Error(w, "create_user_message_failed", http.StatusInternalServerError)
-		return
-	}
+// startCompletion starts streaming the assistant's response to messages and adds the stream to the pool.
+func (s *Service) startCompletion(chatID, userID, parentID uuid.UUID, body ChatCompletionRequest, model llm.Model, profile *UserProfile, messages []*chat.Message) (uuid.UUID, error) {
 
 	req := chat.Request{
 		Model:               body.Model,
@@ -398,54 +594,204 @@ func (s *Service) AddMessage(w http.ResponseWriter, r *http.Request) {
 		Stream:              true,
 		ReasoningEffort:     body.ReasoningEffort,
 		Stop:                nil,
-		Messages:            append(messages, message), // TODO: Consider to split history and new message for better compatibility
+		Messages:            messages, // TODO: Consider to split history and new message for better compatibility
 		System:              profile.SystemPrompt(),
 	}
 
-	compl, err := s.mr.StreamCompletion(req, profile.Options())
+	project, err := s.chatProject(chatID, userID)
 	if err != nil {
-		s.log.Warn("failed to start a stream", "error", err)
-		http.Error(w, "failed to start a stream", http.StatusInternalServerError)
-		return
+		s.log.Warn("failed to get project of chat", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_project_failed"}
+	}
+	if project != nil {
+		if err := project.applyProject(&req, model); err != nil {
+			s.log.Warn("failed to apply project", "project_id", project.ID, "error", err)
+			return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_project_failed"}
+		}
+	}
+
+	// The stream is created upfront, so clients can subscribe while the generation is queued
+	messageID, streamID := uuid.New(), uuid.New()
+	compl := stream.New()
+
+	messageID, err = s.createAssistantMessage(messageID, chatID, userID, parentID, streamID, body, model.Flags.IsPremium)
+	if err != nil {
+		compl.Fail(err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "create_assistant_message_failed"}
+	}
+
+	// Add stream to stream pool
+	s.sp.Add(streamID.String(), compl, stream.Info{
+		UserID: userID.String(),
+		ChatID: chatID.String(),
+		Model:  body.Model,
+	})
+	compl.OnClose(s.storeStream(compl, streamID, messageID))
+	compl.OnCheckpoint(s.cfg.Streams.CheckpointInterval, s.cfg.Streams.CheckpointBytes, s.checkpointStream(streamID, messageID))
+
+	g := &generation{
+		stream: compl,
+		keys:   generationKeys(userID.String(), body.Model, string(model.Provider)),
+		start: func() error {
+			_, err := s.db.Exec("UPDATE messages SET status = 'streaming', updated_at = ? WHERE id = ? AND status = 'queued'", time.Now().UnixMilli(), messageID)
+			if err != nil {
+				s.log.Warn("failed to update message status", "message_id", messageID, "error", err)
+			}
+			compl.Notify(stream.Event{Type: stream.EventStatus, Status: "streaming"})
+			compl.ResetStartTime() // Time spent in the queue does not count towards the model's metrics
+			// Generated images are stored as attachments of the assistant message
+			if err := s.mr.Start(compl, req, profile.Options(), s.storeImages(userID, messageID)); err != nil {
+				s.log.Warn("failed to start a stream", "stream_id", streamID, "error", err)
+				return err
+			}
+			s.log.Debug("stream was started sucessfully", "chat_id", chatID, "stream_id", streamID)
+			return nil
+		},
+	}
+
+	position, err := s.sc.submit(g)
+	if err != nil {
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "failed to start a stream"}
 	}
+	if position > 0 {
+		s.log.Debug("stream was queued", "chat_id", chatID, "stream_id", streamID, "position", position)
+	}
+
+	return streamID, nil
+
+}
+
+// startRequest starts a completion that is not stored in a chat, as served by the API facades.
+// It counts against the user's limits and is queued like any other generation.
+func (s *Service) startRequest(userID uuid.UUID, model llm.Model, profile *UserProfile, req chat.Request) (uuid.UUID, *stream.Stream, error) {
 
 	streamID := uuid.New()
-	messageID, err := s.createAssistantMessage(chatID, userID, streamID, body, model.Flags.IsPremium)
+	compl := stream.New()
 
-	// Add stream to stream pool and return id
-	s.sp.Add(streamID.String(), compl)
-	compl.OnClose(func(chunk stream.Chunk, serr error) {
+	s.countUsage(userID, model.Flags.IsPremium)
 
-		var err error
-		if serr != nil {
-			s.log.Error("stream failed", "stream_id", streamID, "error", serr)
-			_, err = s.db.Exec("UPDATE messages SET content = ?, reasoning = ?, status = ?, updated_at = ? WHERE id = ?",
-				chunk.Content, chunk.Reasoning, "error", time.Now().UnixMilli(), messageID,
-			)
-		} else {
-			_, err = s.db.Exec("UPDATE messages SET content = ?, reasoning = ?, status = ?, updated_at = ? WHERE id = ?",
-				chunk.Content, chunk.Reasoning, "done", time.Now().UnixMilli(), messageID,
-			)
+	// Add stream to stream pool, so it shows up in the admin endpoints and is aborted on shutdown
+	s.sp.Add(streamID.String(), compl, stream.Info{
+		UserID: userID.String(),
+		Model:  req.Model,
+	})
+
+	g := &generation{
+		stream: compl,
+		keys:   generationKeys(userID.String(), req.Model, string(model.Provider)),
+		start: func() error {
+			compl.Notify(stream.Event{Type: stream.EventStatus, Status: "streaming"})
+			compl.ResetStartTime()
+			if err := s.mr.Start(compl, req, profile.Options()); err != nil {
+				s.log.Warn("failed to start a stream", "stream_id", streamID, "error", err)
+				return err
+			}
+			return nil
+		},
+	}
+
+	if _, err := s.sc.submit(g); err != nil {
+		return uuid.UUID{}, nil, &requestError{http.StatusInternalServerError, "failed to start a stream"}
+	}
+
+	return streamID, compl, nil
+
+}
+
+// addMessage adds a user message to an existing chat and starts the assistant's response.
+func (s *Service) addMessage(chatID, userID uuid.UUID, body ChatCompletionRequest) (uuid.UUID, error) {
+
+	if body.Model == "" {
+		project, err := s.chatProject(chatID, userID)
+		if errors.Is(err, errChatNotFound) {
+			return uuid.UUID{}, &requestError{http.StatusNotFound, "chat_not_found"}
+		} else if err != nil {
+			s.log.Warn("failed to get project of chat", "chat_id", chatID, "error", err)
+			return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_project_failed"}
 		}
-		if err != nil {
-			s.log.Error("storing stream content failed", "stream_id", streamID, "error", err)
-			return
+		if project != nil {
+			body.Model = project.Model
 		}
+	}
 
-	})
+	model, profile, err := s.prepareCompletion(userID, body, false)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
 
-	s.log.Debug("stream was started sucessfully", "chat_id", chatID, "stream_id", streamID)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(map[string]any{
-		"stream_id": streamID,
-	}); err != nil {
-		s.log.Error("failed to encode response", "error", err)
+	c, err := s.getChat(chatID, userID)
+	if err != nil {
+		s.log.Debug("failed to get chat", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_chat_failed"}
+	}
+
+	messages, err := c.ModelMessages(model, s.mr)
+	if err != nil {
+		s.log.Debug("failed to get chat messages", "chat_id", chatID, "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_messages_failed"}
 	}
 
+	// The message continues the active branch
+	var parentID uuid.UUID
+	if len(c.Messages) > 0 {
+		parentID = c.Messages[len(c.Messages)-1].ID
+	}
+
+	messageID, message, err := s.newUserMessage(chatID, userID, parentID, body)
+	if err != nil {
+		s.log.Warn("failed to create user message", "error", err)
+		return uuid.UUID{}, &requestError{http.StatusInternalServerError, "create_user_message_failed"}
+	}
+
+	return s.startCompletion(chatID, userID, messageID, body, model, profile, append(messages, message))
+
 }
 
-func (s *Service) SendMessage(w http.ResponseWriter, r *http.Request) {
+// sendMessage creates a new chat with a user message and starts the assistant's response.
+func (s *Service) sendMessage(userID uuid.UUID, body ChatCompletionRequest) (uuid.UUID, uuid.UUID, error) {
+
+	if body.ProjectID != uuid.Nil {
+		project, err := s.getProject(body.ProjectID, userID)
+		if errors.Is(err, errProjectNotFound) {
+			return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusNotFound, "project_not_found"}
+		} else if err != nil {
+			s.log.Warn("failed to get project", "project_id", body.ProjectID, "error", err)
+			return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "get_project_failed"}
+		}
+		if body.Model == "" {
+			body.Model = project.Model
+		}
+	}
+
+	model, profile, err := s.prepareCompletion(userID, body, true)
+	if err != nil {
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+
+	c, err := s.newChat(userID, body)
+	if err != nil {
+		s.log.Warn("failed to create a new chat", "user_id", userID)
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "create_chat_failed"}
+	}
+
+	messageID, message, err := s.newUserMessage(c.ID, userID, uuid.UUID{}, body)
+	if err != nil {
+		s.log.Warn("failed to create user message", "error", err)
+		return uuid.UUID{}, uuid.UUID{}, &requestError{http.StatusInternalServerError, "create_user_message_failed"}
+	}
+
+	streamID, err := s.startCompletion(c.ID, userID, messageID, body, model, profile, []*chat.Message{message})
+	if err != nil {
+		return c.ID, streamID, err
+	}
+
+	go s.generateTitle(c.ID, userID, c.Title, streamID)
+
+	return c.ID, streamID, nil
+
+}
+
+func (s *Service) AddMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Get userID from auth middleware, ok if authenticated
 	userID, ok := r.Context().Value("user_id").(uuid.UUID)
@@ -455,6 +801,15 @@ func (s *Service) SendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get chatID from URL params
+	chatID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.log.Debug("invalid uuid", "error", err)
+		http.Error(w, "invalid_id", http.StatusBadRequest)
+		return
+	}
+
+	// Decode request body
 	var body ChatCompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		s.log.Debug("failed to decode request body", "error", err)
@@ -462,104 +817,49 @@ func (s *Service) SendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get used model from model router
-	model, ok := s.mr.GetModel(body.Model)
-	if !ok {
-		s.log.Debug("model not supported", "model", body.Model)
-		http.Error(w, "model_not_supported", http.StatusBadRequest)
+	streamID, err := s.addMessage(chatID, userID, body)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	profile, err := s.getUserProfile(userID)
-	if err != nil {
-		s.log.Warn("failed to get user profile", "error", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"stream_id": streamID,
+	}); err != nil {
+		s.log.Error("failed to encode response", "error", err)
 	}
 
-	if (model.Provider == "anthropic" && profile.AnthropicAPIKey == "") ||
-		(model.Provider == "gemini" && profile.GeminiAPIKey == "") ||
-		(model.Provider == "ollama" && profile.OllamaBaseURL == "") {
-		if model.Flags.IsKeyRequired {
-			s.log.Debug("model requires bring your own key", "user_id", userID)
-			http.Error(w, "model_requires_key", http.StatusForbidden)
-			return
-		} else if model.Flags.IsPremium {
-			if profile.UsagePremium >= profile.LimitPremium {
-				s.log.Debug("premium message limit reached", "user_id", userID)
-				http.Error(w, "premium_message_limit_reached", http.StatusForbidden)
-				return
-			}
-		} else {
-			if profile.UsageStandard >= profile.LimitStandard {
-				s.log.Debug("standard message limit reached", "user_id", userID)
-				http.Error(w, "standard_message_limit_reached", http.StatusForbidden)
-				return
-			}
-		}
-	}
+}
 
-	c, err := s.newChat(userID, body)
-	if err != nil {
-		s.log.Warn("failed to create a new chat", "user_id", userID)
-		http.Error(w, "create_chat_failed", http.StatusInternalServerError)
-		return
-	}
+func (s *Service) SendMessage(w http.ResponseWriter, r *http.Request) {
 
-	message, err := s.newUserMessage(c.ID, userID, body)
-	if err != nil {
-		s.log.Warn("failed to create user message", "error", err)
-		http.Error(w, "create_user_message_failed", http.StatusInternalServerError)
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
 		return
 	}
 
-	req := chat.Request{
-		Model:               body.Model,
-		Temperature:         0.7,
-		MaxCompletionTokens: 8192,
-		TopP:                1.0,
-		Stream:              true,
-		ReasoningEffort:     body.ReasoningEffort,
-		Stop:                nil,
-		Messages:            []*chat.Message{message}, // TODO: Consider to split history and new message for better compatibility
-		System:              profile.SystemPrompt(),
+	var body ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		http.Error(w, "failed to decode request body", http.StatusBadRequest)
+		return
 	}
 
-	compl, err := s.mr.StreamCompletion(req, profile.Options())
+	chatID, streamID, err := s.sendMessage(userID, body)
 	if err != nil {
-		s.log.Warn("failed to start a stream", "error", err)
-		http.Error(w, "failed to start a stream", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	streamID := uuid.New()
-	messageID, err := s.createAssistantMessage(c.ID, userID, streamID, body, model.Flags.IsPremium)
-
-	// Add stream to stream pool and return id
-	s.sp.Add(streamID.String(), compl)
-	compl.OnClose(func(chunk stream.Chunk, serr error) {
-
-		var err error
-		if serr != nil {
-			s.log.Error("stream failed", "stream_id", streamID, "error", serr)
-			_, err = s.db.Exec("UPDATE messages SET content = ?, reasoning = ?, status = ?, updated_at = ? WHERE id = ?",
-				chunk.Content, chunk.Reasoning, "error", time.Now().UnixMilli(), messageID,
-			)
-		} else {
-			_, err = s.db.Exec("UPDATE messages SET content = ?, reasoning = ?, status = ?, updated_at = ? WHERE id = ?",
-				chunk.Content, chunk.Reasoning, "done", time.Now().UnixMilli(), messageID,
-			)
-		}
-		if err != nil {
-			s.log.Error("storing stream content failed", "stream_id", streamID, "error", err)
-			return
-		}
-
-	})
-
-	s.log.Debug("stream was started sucessfully", "chat_id", c.ID, "stream_id", streamID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(map[string]any{
-		"chat_id":   c.ID,
+		"chat_id":   chatID,
 		"stream_id": streamID,
 	}); err != nil {
 		s.log.Error("failed to encode response", "error", err)
@@ -574,6 +874,11 @@ func (s *Service) loadAndUpdateAttachments(attachmentIDs []uuid.UUID, messageID,
 		return []*chat.Attachment{}, nil
 	}
 
+	attachmentIDs, err := s.copyLinkedAttachments(attachmentIDs, messageID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("copy linked attachments: %w", err)
+	}
+
 	// 1) Build the IN-clause placeholders and args:
 	placeholders := make([]string, len(attachmentIDs))
 	args := make([]any, 0, len(attachmentIDs)+2)
@@ -589,7 +894,7 @@ func (s *Service) loadAndUpdateAttachments(attachmentIDs []uuid.UUID, messageID,
 	args = append(args, userID)
 
 	// Update the attachments to link to the message and return src+mime_type:
-	query := fmt.Sprintf("UPDATE attachments SET message_id = ? WHERE id IN (%s) AND user_id = ? RETURNING id, type", strings.Join(placeholders, ","))
+	query := fmt.Sprintf("UPDATE attachments SET message_id = ? WHERE id IN (%s) AND user_id = ? RETURNING id, name, type", strings.Join(placeholders, ","))
 
 	rows, err := s.db.Query(query, args...)
 	if err != nil {
@@ -601,7 +906,7 @@ func (s *Service) loadAndUpdateAttachments(attachmentIDs []uuid.UUID, messageID,
 	var attachments []Attachment
 	for rows.Next() {
 		var attachment Attachment
-		if err := rows.Scan(&attachment.ID, &attachment.Type); err != nil {
+		if err := rows.Scan(&attachment.ID, &attachment.Name, &attachment.Type); err != nil {
 			return nil, fmt.Errorf("scan returned attachment: %w", err)
 		}
 		attachments = append(attachments, attachment)
@@ -617,10 +922,7 @@ func (s *Service) loadAndUpdateAttachments(attachmentIDs []uuid.UUID, messageID,
 			s.log.Error("failed to get attachment data", "error", err)
 			continue
 		}
-		output = append(output, &chat.Attachment{
-			MimeType: attachments[i].Type,
-			Data:     data,
-		})
+		output = append(output, newModelAttachment(attachments[i].Name, attachments[i].Type, data))
 	}
 
 	// 4) (optional) warn if we didn't get back as many as we asked for
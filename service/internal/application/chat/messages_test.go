@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/google/uuid"
+)
+
+func TestPrepareCompletion(t *testing.T) {
+
+	s := newTestService(t)
+	s.mr.AddModel("standard", llm.Model{Provider: llm.Anthropic})
+	s.mr.AddModel("premium", llm.Model{Provider: llm.Anthropic, Flags: llm.ModelFlags{IsPremium: true}})
+	s.mr.AddModel("byok", llm.Model{Provider: llm.Anthropic, Flags: llm.ModelFlags{IsKeyRequired: true}})
+
+	tests := []struct {
+		name    string
+		model   string
+		newChat bool
+		key     string // The user's Anthropic key
+		usage   int    // Used standard and premium messages, the limits are 1500 and 100
+		want    string
+	}{
+		{"within limits", "premium", false, "", 10, ""},
+		{"standard limit", "standard", false, "", 1500, "standard_message_limit_reached"},
+		{"premium limit", "premium", true, "", 100, "premium_message_limit_reached"},
+		{"own key in a new chat", "premium", true, "sk-ant", 100, ""},
+		{"own key in an existing chat", "premium", false, "sk-ant", 100, "premium_message_limit_reached"},
+		{"key required in a new chat", "byok", true, "", 0, "model_requires_key"},
+		{"key required in an existing chat", "byok", false, "", 0, ""},
+		{"unknown model", "other", false, "", 0, "model_not_supported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			userID := newTestUser(t, s)
+			_, err := s.db.Exec("UPDATE user_profile SET anthropic_api_key = ?, usage_standard = ?, usage_premium = ? WHERE user_id = ?",
+				tt.key, tt.usage, tt.usage, userID,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = s.prepareCompletion(userID, ChatCompletionRequest{Model: tt.model}, tt.newChat)
+			var got string
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				got = reqErr.code
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+		})
+	}
+
+}
+
+func TestAddMessageProjectErrors(t *testing.T) {
+
+	s := newTestService(t)
+	userID := newTestUser(t, s)
+
+	chatID := uuid.New()
+	_, err := s.db.Exec("INSERT INTO chats (id, user_id, project_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		chatID, userID, uuid.New(), "Chat", "model", false, "done", 0, 0, 0, 0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The project cannot be read, the chat's default model is unknown then
+	if _, err := s.db.Exec("DROP TABLE projects"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		chatID uuid.UUID
+		want   string
+	}{
+		{"unknown chat", uuid.New(), "chat_not_found"},
+		{"project fails to load", chatID, "get_project_failed"},
+	}
+
+	for _, tt := range tests {
+		_, err := s.addMessage(tt.chatID, userID, ChatCompletionRequest{Content: "Hi"})
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.code != tt.want {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.want)
+		}
+	}
+
+}
@@ -0,0 +1,296 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+	"github.com/ollama/ollama/api"
+)
+
+// The Ollama compatible API lets tools that only speak Ollama reach every model of the router,
+// with the server's address as their Ollama host. Like the OpenAI compatible API, completions are
+// not stored in a chat but count against the user's limits. Tools are not supported.
+
+// ollamaVersion is reported to clients that check the version of the Ollama server.
+const ollamaVersion = "0.9.0"
+
+// writeOllamaError writes err in the error format of the Ollama API.
+func writeOllamaError(w http.ResponseWriter, err error) {
+
+	status, message := http.StatusInternalServerError, err.Error()
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		status, message = rerr.status, rerr.code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+
+}
+
+// ollamaChatRequest converts the request to the model format.
+func ollamaChatRequest(r *api.ChatRequest) (chat.Request, error) {
+
+	req := chat.Request{
+		Model:               r.Model,
+		Temperature:         0.7,
+		MaxCompletionTokens: 8192,
+		TopP:                1.0,
+		Stream:              true,
+	}
+	if v, ok := r.Options["temperature"].(float64); ok {
+		req.Temperature = v
+	}
+	if v, ok := r.Options["top_p"].(float64); ok {
+		req.TopP = v
+	}
+	if v, ok := r.Options["num_predict"].(float64); ok && v > 0 {
+		req.MaxCompletionTokens = int(v)
+	}
+	if v, ok := r.Options["stop"]; ok {
+		req.Stop = v
+	}
+	if r.Think != nil && *r.Think {
+		req.ReasoningEffort = 1024 // Same budget as the web app uses
+	}
+
+	var system []string
+	for _, m := range r.Messages {
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+		case "user", "assistant":
+			message := &chat.Message{
+				Role:        m.Role,
+				Content:     m.Content,
+				Reasoning:   m.Thinking,
+				Attachments: []*chat.Attachment{},
+			}
+			for i, image := range m.Images {
+				mimeType := http.DetectContentType(image)
+				if !strings.HasPrefix(mimeType, "image/") {
+					return req, &requestError{http.StatusBadRequest, "invalid_image_data"}
+				}
+				message.Attachments = append(message.Attachments, newModelAttachment(fmt.Sprintf("image-%d", i+1), mimeType, image))
+			}
+			req.Messages = append(req.Messages, message)
+		default:
+			return req, &requestError{http.StatusBadRequest, "unsupported_role"}
+		}
+	}
+	req.System = strings.Join(system, "\n\n")
+
+	return req, nil
+
+}
+
+// ollamaMetrics returns the metrics of a finished stream in the Ollama format.
+func ollamaMetrics(m stream.Metrics) api.Metrics {
+	return api.Metrics{
+		TotalDuration: m.Duration(),
+		EvalCount:     m.OutputTokens,
+		EvalDuration:  m.Duration() - m.TimeToFirstToken(),
+	}
+}
+
+func (s *Service) OllamaChat(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		writeOllamaError(w, &requestError{http.StatusUnauthorized, "not_authenticated"})
+		return
+	}
+
+	var body api.ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		writeOllamaError(w, &requestError{http.StatusBadRequest, "invalid_request_body"})
+		return
+	}
+
+	if len(body.Tools) > 0 {
+		writeOllamaError(w, &requestError{http.StatusBadRequest, "tools_not_supported"})
+		return
+	}
+
+	req, err := ollamaChatRequest(&body)
+	if err != nil {
+		s.log.Debug("invalid chat request", "error", err)
+		writeOllamaError(w, err)
+		return
+	}
+
+	model, profile, err := s.prepareCompletion(userID, ChatCompletionRequest{Model: body.Model}, false)
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	// Ollama loads a model when it receives no messages, there is nothing to load here
+	if len(req.Messages) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.ChatResponse{
+			Model:      body.Model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    api.Message{Role: "assistant"},
+			DoneReason: "load",
+			Done:       true,
+		})
+		return
+	}
+
+	streamID, compl, err := s.startRequest(userID, model, profile, req)
+	if err != nil {
+		writeOllamaError(w, err)
+		return
+	}
+
+	// Ollama streams unless it is disabled explicitly
+	if body.Stream == nil || *body.Stream {
+		s.streamOllamaChat(w, r, streamID, compl, body.Model)
+		return
+	}
+
+	chunk, reason, err := s.awaitCompletion(r.Context(), streamID, compl)
+	if err != nil {
+		if r.Context().Err() == nil {
+			writeOllamaError(w, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(api.ChatResponse{
+		Model:     body.Model,
+		CreatedAt: time.Now().UTC(),
+		Message: api.Message{
+			Role:     "assistant",
+			Content:  chunk.Content,
+			Thinking: chunk.Reasoning,
+		},
+		DoneReason: reason,
+		Done:       true,
+		Metrics:    ollamaMetrics(compl.Metrics()),
+	}); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
+
+// streamOllamaChat sends the stream as newline delimited chat responses, the last one has done set.
+func (s *Service) streamOllamaChat(w http.ResponseWriter, r *http.Request, streamID uuid.UUID, compl *stream.Stream, model string) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		compl.Fail(stream.ErrCanceled)
+		writeOllamaError(w, &requestError{http.StatusInternalServerError, "streaming_not_supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	s.subscribeDeltas(r.Context(), streamID, compl, &ollamaStream{
+		enc:     json.NewEncoder(w),
+		flusher: flusher,
+		compl:   compl,
+		model:   model,
+	})
+
+}
+
+// ollamaStream encodes a completion stream as newline delimited chat responses.
+type ollamaStream struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+	compl   *stream.Stream
+	model   string
+}
+
+func (e *ollamaStream) write(v any) bool {
+	if err := e.enc.Encode(v); err != nil {
+		return false
+	}
+	e.flusher.Flush()
+	return true
+}
+
+func (e *ollamaStream) delta(content, reasoning string) bool {
+	return e.write(api.ChatResponse{
+		Model:     e.model,
+		CreatedAt: time.Now().UTC(),
+		Message:   api.Message{Role: "assistant", Content: content, Thinking: reasoning},
+	})
+}
+
+func (e *ollamaStream) finish(reason string) bool {
+	return e.write(api.ChatResponse{
+		Model:      e.model,
+		CreatedAt:  time.Now().UTC(),
+		Message:    api.Message{Role: "assistant"},
+		DoneReason: reason,
+		Done:       true,
+		Metrics:    ollamaMetrics(e.compl.Metrics()),
+	})
+}
+
+func (e *ollamaStream) fail(code, message string) bool {
+	return e.write(map[string]string{"error": message})
+}
+
+func (e *ollamaStream) end(err error) {
+	if err != nil {
+		e.write(map[string]string{"error": "slow_subscriber"})
+	}
+}
+
+// OllamaTags lists the models in the format of the Ollama API.
+func (s *Service) OllamaTags(w http.ResponseWriter, r *http.Request) {
+
+	models := s.mr.ListModels()
+
+	list := api.ListResponse{Models: make([]api.ListModelResponse, 0, len(models))}
+	for key, model := range models {
+		list.Models = append(list.Models, api.ListModelResponse{
+			Name:  key,
+			Model: key,
+			Details: api.ModelDetails{
+				Format: string(model.Provider),
+				Family: model.Icon,
+			},
+		})
+	}
+	slices.SortFunc(list.Models, func(a, b api.ListModelResponse) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+func (s *Service) OllamaVersion(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"version": ollamaVersion,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
@@ -0,0 +1,417 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+)
+
+// The OpenAI compatible API lets OpenAI clients use "<host>/v1" as their base URL.
+// Completions are not stored in a chat, but count against the user's limits and use their keys.
+// Only text and images are supported, tool calls, citations and blocks are left out.
+
+type openAIRequest struct {
+	Model         string          `json:"model"`
+	Messages      []openAIMessage `json:"messages"`
+	Stream        bool            `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Temperature         *float64 `json:"temperature"`
+	TopP                *float64 `json:"top_p"`
+	MaxTokens           int      `json:"max_tokens"` // Deprecated in favor of max_completion_tokens, but still used by many clients
+	MaxCompletionTokens int      `json:"max_completion_tokens"`
+	Stop                any      `json:"stop"`
+	ReasoningEffort     string   `json:"reasoning_effort"` // "minimal", "low", "medium" or "high"
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // Either a string or a list of content parts
+}
+
+type openAIContentPart struct {
+	Type     string `json:"type"` // "text" or "image_url"
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+type openAICompletion struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"` // "chat.completion" or "chat.completion.chunk"
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+type openAIChoice struct {
+	Index        int           `json:"index"`
+	Message      *openAIOutput `json:"message,omitempty"`
+	Delta        *openAIOutput `json:"delta,omitempty"`
+	FinishReason *string       `json:"finish_reason"`
+}
+
+type openAIOutput struct {
+	Role             string `json:"role,omitempty"`
+	Content          string `json:"content,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"` // Not part of the OpenAI API, but understood by many clients
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"` // Not reported by the providers yet
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type openAIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+// reasoningBudgets maps the OpenAI reasoning efforts to thinking budgets in tokens.
+var reasoningBudgets = map[string]int32{
+	"minimal": 1024,
+	"low":     1024,
+	"medium":  4096,
+	"high":    16384,
+}
+
+// writeOpenAIError writes err in the error format of the OpenAI API.
+func writeOpenAIError(w http.ResponseWriter, err error) {
+
+	status, code := http.StatusInternalServerError, err.Error()
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		status, code = rerr.status, rerr.code
+	}
+
+	typ := "invalid_request_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		typ = "authentication_error"
+	case status == http.StatusForbidden:
+		typ = "permission_error"
+	case status >= 500:
+		typ = "server_error"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]openAIError{
+		"error": {Message: code, Type: typ, Code: code},
+	})
+
+}
+
+// chatRequest converts the request to the model format. System and developer
+// messages are joined to the system prompt, the user's custom prompt is not applied.
+func (r *openAIRequest) chatRequest() (chat.Request, error) {
+
+	req := chat.Request{
+		Model:               r.Model,
+		Temperature:         0.7,
+		MaxCompletionTokens: 8192,
+		TopP:                1.0,
+		Stream:              true,
+		Stop:                r.Stop,
+	}
+	if r.Temperature != nil {
+		req.Temperature = *r.Temperature
+	}
+	if r.TopP != nil {
+		req.TopP = *r.TopP
+	}
+	if r.MaxCompletionTokens > 0 {
+		req.MaxCompletionTokens = r.MaxCompletionTokens
+	} else if r.MaxTokens > 0 {
+		req.MaxCompletionTokens = r.MaxTokens
+	}
+	if r.ReasoningEffort != "" && r.ReasoningEffort != "none" {
+		budget, ok := reasoningBudgets[r.ReasoningEffort]
+		if !ok {
+			return req, &requestError{http.StatusBadRequest, "invalid_reasoning_effort"}
+		}
+		req.ReasoningEffort = budget
+	}
+
+	var system []string
+	for _, m := range r.Messages {
+		content, attachments, err := m.parse()
+		if err != nil {
+			return req, err
+		}
+		switch m.Role {
+		case "system", "developer":
+			system = append(system, content)
+		case "user", "assistant":
+			req.Messages = append(req.Messages, &chat.Message{
+				Role:        m.Role,
+				Content:     content,
+				Attachments: attachments,
+			})
+		default:
+			return req, &requestError{http.StatusBadRequest, "unsupported_role"}
+		}
+	}
+	req.System = strings.Join(system, "\n\n")
+
+	return req, nil
+
+}
+
+// parse returns the text and images of the message content.
+func (m *openAIMessage) parse() (string, []*chat.Attachment, error) {
+
+	attachments := []*chat.Attachment{}
+
+	// Assistant messages with tool calls have no content
+	if len(m.Content) == 0 || bytes.Equal(m.Content, []byte("null")) {
+		return "", attachments, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(m.Content, &text); err == nil {
+		return text, attachments, nil
+	}
+
+	var parts []openAIContentPart
+	if err := json.Unmarshal(m.Content, &parts); err != nil {
+		return "", nil, &requestError{http.StatusBadRequest, "invalid_message_content"}
+	}
+
+	var texts []string
+	for i, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			// Only inline images are accepted, remote images would have to be fetched by the server
+			header, data, ok := strings.Cut(strings.TrimPrefix(part.ImageURL.URL, "data:"), ",")
+			mimeType, isBase64 := strings.CutSuffix(header, ";base64")
+			if !ok || !isBase64 || !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return "", nil, &requestError{http.StatusBadRequest, "unsupported_image_url"}
+			}
+			decoded, err := base64.StdEncoding.DecodeString(data)
+			if err != nil {
+				return "", nil, &requestError{http.StatusBadRequest, "invalid_image_data"}
+			}
+			attachments = append(attachments, newModelAttachment(fmt.Sprintf("image-%d", i+1), mimeType, decoded))
+		default:
+			return "", nil, &requestError{http.StatusBadRequest, "unsupported_content_type"}
+		}
+	}
+
+	return strings.Join(texts, "\n"), attachments, nil
+
+}
+
+func (s *Service) CreateChatCompletion(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		writeOpenAIError(w, &requestError{http.StatusUnauthorized, "not_authenticated"})
+		return
+	}
+
+	var body openAIRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		writeOpenAIError(w, &requestError{http.StatusBadRequest, "invalid_request_body"})
+		return
+	}
+
+	if len(body.Messages) == 0 {
+		writeOpenAIError(w, &requestError{http.StatusBadRequest, "messages_required"})
+		return
+	}
+
+	req, err := body.chatRequest()
+	if err != nil {
+		s.log.Debug("invalid completion request", "error", err)
+		writeOpenAIError(w, err)
+		return
+	}
+
+	model, profile, err := s.prepareCompletion(userID, ChatCompletionRequest{Model: body.Model}, false)
+	if err != nil {
+		writeOpenAIError(w, err)
+		return
+	}
+
+	streamID, compl, err := s.startRequest(userID, model, profile, req)
+	if err != nil {
+		writeOpenAIError(w, err)
+		return
+	}
+
+	completion := openAICompletion{
+		ID:      "chatcmpl-" + streamID.String(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   body.Model,
+	}
+
+	if body.Stream {
+		s.streamOpenAICompletion(w, r, streamID, compl, completion, body.StreamOptions.IncludeUsage)
+		return
+	}
+
+	chunk, reason, err := s.awaitCompletion(r.Context(), streamID, compl)
+	if err != nil {
+		if r.Context().Err() == nil {
+			writeOpenAIError(w, err)
+		}
+		return
+	}
+
+	tokens := compl.Metrics().OutputTokens
+	completion.Choices = []openAIChoice{{
+		Message: &openAIOutput{
+			Role:             "assistant",
+			Content:          chunk.Content,
+			ReasoningContent: chunk.Reasoning,
+		},
+		FinishReason: &reason,
+	}}
+	completion.Usage = &openAIUsage{CompletionTokens: tokens, TotalTokens: tokens}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(completion); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
+
+// streamOpenAICompletion sends the stream as completion chunks, terminated by "data: [DONE]".
+func (s *Service) streamOpenAICompletion(w http.ResponseWriter, r *http.Request, streamID uuid.UUID, compl *stream.Stream, completion openAICompletion, includeUsage bool) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		compl.Fail(stream.ErrCanceled)
+		writeOpenAIError(w, &requestError{http.StatusInternalServerError, "streaming_not_supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	completion.Object = "chat.completion.chunk"
+	enc := &openAIStream{w: w, flusher: flusher, compl: compl, completion: completion, includeUsage: includeUsage}
+	if !enc.output(openAIOutput{Role: "assistant"}, nil) {
+		compl.Fail(stream.ErrCanceled)
+		return
+	}
+
+	s.subscribeDeltas(r.Context(), streamID, compl, enc)
+
+}
+
+// openAIStream encodes a completion stream as server-sent completion chunks.
+type openAIStream struct {
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	compl        *stream.Stream
+	completion   openAICompletion
+	includeUsage bool
+}
+
+func (e *openAIStream) write(v any) bool {
+	data, err := json.Marshal(v)
+	if err == nil {
+		_, err = fmt.Fprintf(e.w, "data: %s\n\n", data)
+	}
+	if err != nil {
+		return false
+	}
+	e.flusher.Flush()
+	return true
+}
+
+func (e *openAIStream) output(output openAIOutput, reason *string) bool {
+	chunk := e.completion
+	chunk.Choices = []openAIChoice{{Delta: &output, FinishReason: reason}}
+	return e.write(chunk)
+}
+
+func (e *openAIStream) delta(content, reasoning string) bool {
+	return e.output(openAIOutput{Content: content, ReasoningContent: reasoning}, nil)
+}
+
+func (e *openAIStream) finish(reason string) bool {
+	if !e.output(openAIOutput{}, &reason) {
+		return false
+	}
+	if !e.includeUsage {
+		return true
+	}
+	tokens := e.compl.Metrics().OutputTokens
+	chunk := e.completion
+	chunk.Choices = []openAIChoice{}
+	chunk.Usage = &openAIUsage{CompletionTokens: tokens, TotalTokens: tokens}
+	return e.write(chunk)
+}
+
+func (e *openAIStream) fail(code, message string) bool {
+	return e.write(map[string]openAIError{"error": {Message: message, Type: "server_error", Code: code}})
+}
+
+func (e *openAIStream) end(err error) {
+	if err != nil {
+		e.write(map[string]openAIError{"error": {Message: "slow_subscriber", Type: "server_error", Code: "slow_subscriber"}})
+	}
+	fmt.Fprint(e.w, "data: [DONE]\n\n")
+	e.flusher.Flush()
+}
+
+// ListOpenAIModels lists the models in the format of the OpenAI API.
+func (s *Service) ListOpenAIModels(w http.ResponseWriter, r *http.Request) {
+
+	models := s.mr.ListModels()
+
+	data := make([]openAIModel, 0, len(models))
+	for key, model := range models {
+		data = append(data, openAIModel{
+			ID:      key,
+			Object:  "model",
+			OwnedBy: string(model.Provider),
+		})
+	}
+	slices.SortFunc(data, func(a, b openAIModel) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"object": "list",
+		"data":   data,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
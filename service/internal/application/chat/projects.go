@@ -0,0 +1,518 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var errProjectNotFound = errors.New("project not found")
+
+// Project groups chats that share instructions, a default model and reference files.
+type Project struct {
+	ID     uuid.UUID `json:"id,omitzero"`
+	UserID uuid.UUID `json:"user_id,omitzero"`
+
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	SystemPrompt string `json:"system_prompt"` // Added to the user's system prompt in the project's chats
+	Model        string `json:"model"`         // Default model of the project's chats, empty to use the client's choice
+
+	Attachments []Attachment `json:"attachments"` // Included in every chat of the project
+	ChatCount   int          `json:"chat_count"`
+
+	CreatedAt int64 `json:"created_at"`
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+type ProjectRequest struct {
+	Name         *string      `json:"name,omitempty"`
+	Description  *string      `json:"description,omitempty"`
+	SystemPrompt *string      `json:"system_prompt,omitempty"`
+	Model        *string      `json:"model,omitempty"`
+	Attachments  *[]uuid.UUID `json:"attachments,omitempty"` // Replaces the reference attachments
+}
+
+// getProject returns the project with its reference attachments.
+func (s *Service) getProject(projectID, userID uuid.UUID) (*Project, error) {
+
+	p := Project{Attachments: []Attachment{}}
+	err := s.db.QueryRow(`
+		SELECT id, user_id, name, description, system_prompt, model, created_at, updated_at,
+			(SELECT COUNT(*) FROM chats WHERE project_id = p.id)
+		FROM projects p
+		WHERE id = ? AND user_id = ?`,
+		projectID, userID,
+	).Scan(&p.ID, &p.UserID, &p.Name, &p.Description, &p.SystemPrompt, &p.Model, &p.CreatedAt, &p.UpdatedAt, &p.ChatCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errProjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT a.id, a.user_id, a.message_id, a.name, a.type, a.src, a.created_at
+		FROM project_attachments pa
+		JOIN attachments a ON a.id = pa.attachment_id
+		WHERE pa.project_id = ?
+		ORDER BY pa.created_at ASC`,
+		projectID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.UserId, &a.MessageID, &a.Name, &a.Type, &a.Src, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.Attachments = append(p.Attachments, a)
+	}
+
+	return &p, rows.Err()
+
+}
+
+// chatProject returns the project of the chat, or nil if it does not belong to one.
+func (s *Service) chatProject(chatID, userID uuid.UUID) (*Project, error) {
+
+	var projectID string
+	err := s.db.QueryRow("SELECT project_id FROM chats WHERE id = ? AND user_id = ?", chatID, userID).Scan(&projectID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errChatNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.Parse(projectID)
+	if err != nil {
+		return nil, nil // Empty, the chat is not part of a project
+	}
+
+	p, err := s.getProject(id, userID)
+	if errors.Is(err, errProjectNotFound) {
+		return nil, nil
+	}
+	return p, err
+
+}
+
+// applyProject layers the project's instructions onto the system prompt and includes its
+// reference attachments with the first message, so the model sees them in every chat.
+// Attachments the model does not support are left out, like in the chat's messages.
+func (p *Project) applyProject(req *chat.Request, model llm.Model) error {
+
+	if prompt := strings.TrimSpace(p.SystemPrompt); prompt != "" {
+		req.System += "\n\n# Project Instructions\nThe following instructions were given for all conversations of the project \"" +
+			p.Name + "\". They take precedence over the general instructions above.\n\n" + prompt
+	}
+
+	if len(p.Attachments) == 0 || len(req.Messages) == 0 {
+		return nil
+	}
+
+	attachments := make([]*chat.Attachment, 0, len(p.Attachments))
+	for _, a := range p.Attachments {
+		if !supportsAttachment(model, a.Type) {
+			continue
+		}
+		attachment, err := a.ModelAttachment(p.UserID)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	first := *req.Messages[0] // Copied, the history may be shared with other requests
+	first.Attachments = append(attachments, first.Attachments...)
+	req.Messages = append([]*chat.Message{&first}, req.Messages[1:]...)
+
+	return nil
+
+}
+
+// validateProject checks the fields of a create or update request.
+func (s *Service) validateProject(req *ProjectRequest, userID uuid.UUID) error {
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return &requestError{http.StatusBadRequest, "missing_name"}
+	}
+	if req.Model != nil && *req.Model != "" {
+		if _, ok := s.mr.GetModel(*req.Model); !ok {
+			return &requestError{http.StatusBadRequest, "model_not_supported"}
+		}
+	}
+	if req.Attachments != nil {
+		return s.checkAttachments(userID, *req.Attachments)
+	}
+	return nil
+}
+
+// checkAttachments verifies that the attachments exist and belong to the user, before a request
+// changes anything.
+func (s *Service) checkAttachments(userID uuid.UUID, attachmentIDs []uuid.UUID) error {
+
+	for _, id := range attachmentIDs {
+		var exists bool
+		err := s.db.QueryRow("SELECT COUNT(*) > 0 FROM attachments WHERE id = ? AND user_id = ?", id, userID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &requestError{http.StatusBadRequest, "attachment_not_found"}
+		}
+	}
+
+	return nil
+
+}
+
+// setProjectAttachments replaces the reference attachments of the project. Only the user's own
+// attachments are referenced, the request has to be checked with checkAttachments first.
+func setProjectAttachments(tx *sql.Tx, projectID, userID uuid.UUID, attachmentIDs []uuid.UUID) error {
+
+	if _, err := tx.Exec("DELETE FROM project_attachments WHERE project_id = ?", projectID); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	for i, id := range attachmentIDs {
+		_, err := tx.Exec(`
+			INSERT OR IGNORE INTO project_attachments (project_id, attachment_id, created_at)
+			SELECT ?, id, ? FROM attachments WHERE id = ? AND user_id = ?`,
+			projectID, now+int64(i), id, userID, // Offset keeps the order of the request
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// moveChat adds the chat to the project, or removes it from its project if projectID is zero.
+func (s *Service) moveChat(chatID, userID, projectID uuid.UUID) error {
+
+	if projectID != uuid.Nil {
+		if _, err := s.getProject(projectID, userID); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.db.Exec("UPDATE chats SET project_id = ?, updated_at = ? WHERE id = ? AND user_id = ?",
+		parentString(projectID), time.Now().UnixMilli(), chatID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errChatNotFound
+	}
+
+	return nil
+
+}
+
+func (s *Service) ListProjects(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, name, description, system_prompt, model, created_at, updated_at,
+			(SELECT COUNT(*) FROM chats WHERE project_id = p.id)
+		FROM projects p
+		WHERE user_id = ?
+		ORDER BY updated_at DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Attachments are only included when a single project is requested
+	projects := make([]Project, 0)
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.SystemPrompt, &p.Model, &p.CreatedAt, &p.UpdatedAt, &p.ChatCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		projects = append(projects, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(projects); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+func (s *Service) CreateProject(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	var req ProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		http.Error(w, "failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == nil {
+		http.Error(w, "missing_name", http.StatusBadRequest)
+		return
+	}
+	if err := s.validateProject(&req, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	p := Project{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      strings.TrimSpace(*req.Name),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.Description != nil {
+		p.Description = *req.Description
+	}
+	if req.SystemPrompt != nil {
+		p.SystemPrompt = *req.SystemPrompt
+	}
+	if req.Model != nil {
+		p.Model = *req.Model
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO projects (id, user_id, name, description, system_prompt, model, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		p.ID, p.UserID, p.Name, p.Description, p.SystemPrompt, p.Model, p.CreatedAt, p.UpdatedAt,
+	)
+	if err != nil {
+		s.log.Warn("failed to insert project into database", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Attachments != nil {
+		if err := setProjectAttachments(tx, p.ID, userID, *req.Attachments); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	project, err := s.getProject(p.ID, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(project); err != nil {
+		s.log.Error("failed to encode response", "error", err)
+	}
+
+}
+
+func (s *Service) GetProject(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	projectID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	}
+
+	project, err := s.getProject(projectID, userID)
+	if errors.Is(err, errProjectNotFound) {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(project); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
+
+func (s *Service) EditProject(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	projectID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	}
+
+	var req ProjectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.log.Debug("failed to decode request body", "error", err)
+		http.Error(w, "failed to decode request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.validateProject(&req, userID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, err := s.getProject(projectID, userID); errors.Is(err, errProjectNotFound) {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var set []string
+	var args []any
+	if req.Name != nil {
+		set, args = append(set, "name = ?"), append(args, strings.TrimSpace(*req.Name))
+	}
+	if req.Description != nil {
+		set, args = append(set, "description = ?"), append(args, *req.Description)
+	}
+	if req.SystemPrompt != nil {
+		set, args = append(set, "system_prompt = ?"), append(args, *req.SystemPrompt)
+	}
+	if req.Model != nil {
+		set, args = append(set, "model = ?"), append(args, *req.Model)
+	}
+	set, args = append(set, "updated_at = ?"), append(args, time.Now().UnixMilli())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE projects SET "+strings.Join(set, ", ")+" WHERE id = ? AND user_id = ?", append(args, projectID, userID)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Attachments != nil {
+		if err := setProjectAttachments(tx, projectID, userID, *req.Attachments); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// DeleteProject deletes the project. Its chats are kept outside of any project, unless
+// delete_chats is set in the query.
+func (s *Service) DeleteProject(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	projectID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := s.getProject(projectID, userID); errors.Is(err, errProjectNotFound) {
+		http.Error(w, "project_not_found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("delete_chats") == "true" {
+		if _, err := s.db.Exec("DELETE FROM chats WHERE project_id = ? AND user_id = ?", projectID, userID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The remaining chats and the reference attachments are released by a trigger
+	if _, err := s.db.Exec("DELETE FROM projects WHERE id = ? AND user_id = ?", projectID, userID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestSupportsAttachment(t *testing.T) {
+
+	vision := llm.Model{Features: llm.ModelFeatures{HasVision: true}}
+	pdf := llm.Model{Features: llm.ModelFeatures{HasPDF: true}}
+
+	tests := []struct {
+		mimeType string
+		model    llm.Model
+		want     bool
+	}{
+		{"text/plain; charset=utf-8", llm.Model{}, true},
+		{"application/json", llm.Model{}, true},
+		{"image/png", vision, true},
+		{"image/png", pdf, false},
+		{"application/pdf", pdf, true},
+		{"application/pdf", vision, false},
+		{"application/zip", llm.Model{}, true}, // Left to the provider
+	}
+
+	for _, tt := range tests {
+		if got := supportsAttachment(tt.model, tt.mimeType); got != tt.want {
+			t.Errorf("%s with %+v: got %v, want %v", tt.mimeType, tt.model.Features, got, tt.want)
+		}
+	}
+
+}
+
+func TestApplyProject(t *testing.T) {
+
+	t.Chdir(t.TempDir())
+
+	p := &Project{UserID: uuid.New(), Name: "Docs", SystemPrompt: "Answer briefly."}
+	for _, a := range []Attachment{
+		{ID: uuid.New(), Name: "notes.md", Type: "text/markdown"},
+		{ID: uuid.New(), Name: "diagram.png", Type: "image/png"},
+		{ID: uuid.New(), Name: "spec.pdf", Type: "application/pdf"},
+	} {
+		dir := fmt.Sprintf("data/users/%s/attachments", p.UserID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dir+"/"+a.ID.String(), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p.Attachments = append(p.Attachments, a)
+	}
+
+	tests := []struct {
+		name  string
+		model llm.Model
+		want  []string
+	}{
+		{"text only", llm.Model{}, []string{"notes.md", "own.txt"}},
+		{"vision", llm.Model{Features: llm.ModelFeatures{HasVision: true}}, []string{"notes.md", "diagram.png", "own.txt"}},
+		{"vision and pdf", llm.Model{Features: llm.ModelFeatures{HasVision: true, HasPDF: true}}, []string{"notes.md", "diagram.png", "spec.pdf", "own.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			first := &chat.Message{Role: "user", Attachments: []*chat.Attachment{{Name: "own.txt"}}}
+			req := chat.Request{System: "Be helpful.", Messages: []*chat.Message{first, {Role: "assistant"}}}
+			if err := p.applyProject(&req, tt.model); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range req.Messages[0].Attachments {
+				got = append(got, a.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got attachments %v, want %v", got, tt.want)
+			}
+			if len(first.Attachments) != 1 {
+				t.Errorf("the original message was changed")
+			}
+			if !strings.HasPrefix(req.System, "Be helpful.") || !strings.HasSuffix(req.System, "Answer briefly.") {
+				t.Errorf("got system prompt %q", req.System)
+			}
+
+		})
+	}
+
+}
+
+func TestEditProjectAttachments(t *testing.T) {
+
+	s := newTestService(t)
+	userID, otherID := uuid.New(), uuid.New()
+
+	var attachments []uuid.UUID
+	for _, owner := range []uuid.UUID{userID, userID, otherID} {
+		a, err := s.saveAttachment(owner, uuid.UUID{}, "notes.txt", "text/plain", strings.NewReader("notes"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachments = append(attachments, a.ID)
+	}
+
+	projectID := uuid.New()
+	_, err := s.db.Exec("INSERT INTO projects (id, user_id, name, created_at, updated_at) VALUES (?, ?, ?, ?, ?)", projectID, userID, "Project", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("INSERT INTO project_attachments (project_id, attachment_id, created_at) VALUES (?, ?, ?)", projectID, attachments[0], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		status      int
+		wantName    string
+		attachments []uuid.UUID
+	}{
+		{
+			name:        "attachment of another user",
+			body:        fmt.Sprintf(`{"name": "Renamed", "attachments": [%q, %q]}`, attachments[1], attachments[2]),
+			status:      http.StatusBadRequest,
+			wantName:    "Project",
+			attachments: attachments[:1],
+		},
+		{
+			name:        "unknown attachment",
+			body:        fmt.Sprintf(`{"name": "Renamed", "attachments": [%q]}`, uuid.New()),
+			status:      http.StatusBadRequest,
+			wantName:    "Project",
+			attachments: attachments[:1],
+		},
+		{
+			name:        "replaced",
+			body:        fmt.Sprintf(`{"name": "Renamed", "attachments": [%q, %q, %q]}`, attachments[1], attachments[0], attachments[1]),
+			status:      http.StatusNoContent,
+			wantName:    "Renamed",
+			attachments: []uuid.UUID{attachments[1], attachments[0]},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			r := httptest.NewRequest("PATCH", "/v1/projects/"+projectID.String()+"/", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r.WithContext(context.WithValue(r.Context(), "user_id", userID)), map[string]string{"id": projectID.String()})
+			w := httptest.NewRecorder()
+			s.EditProject(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.status)
+			}
+
+			p, err := s.getProject(projectID, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uuid.UUID
+			for _, a := range p.Attachments {
+				got = append(got, a.ID)
+			}
+			if p.Name != tt.wantName || !slices.Equal(got, tt.attachments) {
+				t.Errorf("got project %q with attachments %v, want %q with %v", p.Name, got, tt.wantName, tt.attachments)
+			}
+
+		})
+	}
+
+}
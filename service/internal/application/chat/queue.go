@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+)
+
+// scheduler limits the number of concurrent generations per user, model and provider.
+// Generations exceeding a limit are queued and started in order of arrival once they fit,
+// a queued generation does not hold back later ones that fit already.
+type scheduler struct {
+	mu      sync.Mutex
+	cfg     application.ConcurrencyConfig
+	running map[string]int // Running generations per key, see generationKeys
+	queue   []*generation
+}
+
+type generation struct {
+	stream   *stream.Stream
+	keys     []string
+	start    func() error
+	started  bool
+	position int
+}
+
+func newScheduler(cfg application.ConcurrencyConfig) *scheduler {
+	return &scheduler{
+		cfg:     cfg,
+		running: make(map[string]int),
+	}
+}
+
+// generationKeys returns the keys a generation counts against.
+func generationKeys(userID, model, provider string) []string {
+	return []string{"total", "user:" + userID, "model:" + model, "provider:" + provider}
+}
+
+// limit returns the limit of a key, 0 means unlimited.
+func (sc *scheduler) limit(key string) int {
+	kind, name, _ := strings.Cut(key, ":")
+	switch kind {
+	case "total":
+		return sc.cfg.Total
+	case "user":
+		return sc.cfg.PerUser
+	case "model":
+		return sc.cfg.Models[name]
+	case "provider":
+		return sc.cfg.Providers[name]
+	default:
+		return 0
+	}
+}
+
+func (sc *scheduler) fits(g *generation) bool {
+	for _, key := range g.keys {
+		if limit := sc.limit(key); limit > 0 && sc.running[key] >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *scheduler) acquire(g *generation) {
+	g.started = true
+	for _, key := range g.keys {
+		sc.running[key]++
+	}
+}
+
+func (sc *scheduler) release(g *generation) {
+	for _, key := range g.keys {
+		if sc.running[key]--; sc.running[key] <= 0 {
+			delete(sc.running, key)
+		}
+	}
+}
+
+// submit starts the generation if it fits within the limits and returns the error of its start.
+// Otherwise the generation is queued and submit returns its position in the queue.
+func (sc *scheduler) submit(g *generation) (int, error) {
+
+	sc.mu.Lock()
+	if sc.fits(g) {
+		sc.acquire(g)
+	} else {
+		sc.queue = append(sc.queue, g)
+		g.position = len(sc.queue)
+		g.stream.Notify(stream.Event{Type: stream.EventPosition, Position: g.position})
+	}
+	// A queued generation may be started by done from now on, so the state is read under the lock
+	started, position := g.started, g.position
+	sc.mu.Unlock()
+
+	// Free the slot or leave the queue once the stream is done, e.g. because it was canceled while queued
+	go func() {
+		g.stream.Wait()
+		sc.done(g)
+	}()
+
+	if !started {
+		return position, nil
+	}
+	return 0, g.start()
+
+}
+
+func (sc *scheduler) done(g *generation) {
+
+	sc.mu.Lock()
+	if g.started {
+		sc.release(g)
+	} else if i := slices.Index(sc.queue, g); i >= 0 {
+		sc.queue = slices.Delete(sc.queue, i, i+1)
+	}
+	ready := sc.dequeue()
+	sc.mu.Unlock()
+
+	for _, g := range ready {
+		g.start() // errors fail the stream and are stored with the message
+	}
+
+}
+
+// dequeue acquires the slots of queued generations that fit now and notifies
+// the others of their new position. It returns the generations to start.
+// The caller must hold the lock.
+func (sc *scheduler) dequeue() []*generation {
+	var ready []*generation
+	queue := sc.queue[:0]
+	for _, g := range sc.queue {
+		if sc.fits(g) {
+			sc.acquire(g)
+			ready = append(ready, g)
+			continue
+		}
+		queue = append(queue, g)
+		if position := len(queue); position != g.position {
+			g.position = position
+			g.stream.Notify(stream.Event{Type: stream.EventPosition, Position: position})
+		}
+	}
+	clear(sc.queue[len(queue):])
+	sc.queue = queue
+	return ready
+}
@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+)
+
+func TestScheduler(t *testing.T) {
+
+	type submission struct {
+		user, model, provider string
+	}
+
+	tests := []struct {
+		name        string
+		cfg         application.ConcurrencyConfig
+		submissions []submission
+		positions   []int // Position returned by submit, 0 if started
+		finish      int   // Generation that finishes after all were submitted
+		startedNext []int // Generations started because it finished
+	}{
+		{
+			name:        "unlimited",
+			submissions: []submission{{"a", "m", "p"}, {"a", "m", "p"}},
+			positions:   []int{0, 0},
+			finish:      0,
+		},
+		{
+			name:        "per user",
+			cfg:         application.ConcurrencyConfig{PerUser: 1},
+			submissions: []submission{{"a", "m", "p"}, {"a", "m", "p"}, {"b", "m", "p"}, {"a", "m", "p"}},
+			positions:   []int{0, 1, 0, 2},
+			finish:      0,
+			startedNext: []int{1},
+		},
+		{
+			name:        "queued generation does not hold back others",
+			cfg:         application.ConcurrencyConfig{Models: map[string]int{"big": 1}},
+			submissions: []submission{{"a", "big", "p"}, {"b", "big", "p"}, {"c", "small", "p"}},
+			positions:   []int{0, 1, 0},
+			finish:      2,
+		},
+		{
+			name:        "provider and total",
+			cfg:         application.ConcurrencyConfig{Total: 3, Providers: map[string]int{"p": 1}},
+			submissions: []submission{{"a", "m", "p"}, {"b", "m", "p"}, {"c", "m", "q"}, {"d", "m", "q"}, {"e", "m", "q"}},
+			positions:   []int{0, 1, 0, 0, 2},
+			finish:      3,
+			startedNext: []int{4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			sc := newScheduler(tt.cfg)
+			started := make(chan int, len(tt.submissions))
+			streams := make([]*stream.Stream, len(tt.submissions))
+
+			for i, sub := range tt.submissions {
+				streams[i] = stream.New()
+				defer streams[i].Close()
+				g := &generation{
+					stream: streams[i],
+					keys:   generationKeys(sub.user, sub.model, sub.provider),
+					start:  func() error { started <- i; return nil },
+				}
+				position, err := sc.submit(g)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if position != tt.positions[i] {
+					t.Errorf("generation %d: got position %d, want %d", i, position, tt.positions[i])
+				}
+			}
+			for range countStarted(tt.positions) {
+				<-started
+			}
+
+			streams[tt.finish].Close()
+
+			var next []int
+			timeout := time.After(100 * time.Millisecond)
+		wait:
+			for {
+				select {
+				case i := <-started:
+					next = append(next, i)
+				case <-timeout:
+					break wait
+				}
+			}
+			if !slices.Equal(next, tt.startedNext) {
+				t.Errorf("started %v after generation %d finished, want %v", next, tt.finish, tt.startedNext)
+			}
+
+		})
+	}
+
+}
+
+// A generation that is queued while the running one finishes may be started by either
+// submit or done, but only once.
+func TestSchedulerStartsOnce(t *testing.T) {
+
+	for range 200 {
+
+		sc := newScheduler(application.ConcurrencyConfig{Total: 1})
+		running := stream.New()
+		if _, err := sc.submit(&generation{stream: running, keys: generationKeys("a", "m", "p"), start: func() error { return nil }}); err != nil {
+			t.Fatal(err)
+		}
+
+		var starts atomic.Int32
+		queued := stream.New()
+		started := make(chan struct{}, 2)
+		g := &generation{stream: queued, keys: generationKeys("b", "m", "p"), start: func() error {
+			starts.Add(1)
+			started <- struct{}{}
+			return nil
+		}}
+
+		go running.Close()
+		if _, err := sc.submit(g); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("queued generation was not started")
+		}
+		time.Sleep(time.Millisecond)
+		if n := starts.Load(); n != 1 {
+			t.Fatalf("generation started %d times", n)
+		}
+		queued.Close()
+
+	}
+
+}
+
+func countStarted(positions []int) int {
+	var n int
+	for _, p := range positions {
+		if p == 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+// attachmentTextLimit is the number of characters of a text attachment that are indexed.
+const attachmentTextLimit = 1 << 20
+
+// SearchHit is a chat title, message or attachment matching a search query.
+type SearchHit struct {
+	Kind         string    `json:"kind"` // "chat", "message" or "attachment"
+	ChatID       uuid.UUID `json:"chat_id"`
+	ChatTitle    string    `json:"chat_title"`
+	MessageID    uuid.UUID `json:"message_id,omitzero"`    // Anchor of message and attachment hits
+	AttachmentID uuid.UUID `json:"attachment_id,omitzero"` // Set for attachment hits
+	Snippet      string    `json:"snippet"`                // Matched text with the terms wrapped in <mark> tags
+	Score        float64   `json:"score"`                  // Lower is better
+}
+
+// ftsQuery turns user input into an FTS5 query matching all terms, the last one as a prefix.
+// Terms are quoted, so the FTS5 query syntax cannot be used to cause errors.
+func ftsQuery(input string) string {
+	terms := strings.Fields(input)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	if len(terms) > 0 {
+		terms[len(terms)-1] += "*"
+	}
+	return strings.Join(terms, " ")
+}
+
+func (s *Service) Search(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	query := ftsQuery(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "missing_query", http.StatusBadRequest)
+		return
+	}
+
+	limit := searchDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "invalid_limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, searchMaxLimit)
+	}
+
+	var offset int
+	if v := r.URL.Query().Get("offset"); v != "" {
+		var err error
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid_offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.Query(`
+		SELECT
+			search_index.kind, search_index.chat_id, search_index.message_id, search_index.source_id, c.title,
+			snippet(search_index, 0, '<mark>', '</mark>', '…', 16), search_index.rank
+		FROM search_index
+		JOIN chats c ON c.id = search_index.chat_id
+		WHERE search_index MATCH ? AND search_index.user_id = ?
+		ORDER BY search_index.rank
+		LIMIT ? OFFSET ?`,
+		query, userID, limit, offset,
+	)
+	if err != nil {
+		s.log.Warn("failed to search", "user_id", userID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hits := make([]SearchHit, 0)
+	for rows.Next() {
+		var hit SearchHit
+		var messageID, sourceID string
+		if err := rows.Scan(&hit.Kind, &hit.ChatID, &messageID, &sourceID, &hit.ChatTitle, &hit.Snippet, &hit.Score); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hit.MessageID, _ = uuid.Parse(messageID) // Empty for chat hits
+		if hit.Kind == "attachment" {
+			hit.AttachmentID, _ = uuid.Parse(sourceID)
+		}
+		hits = append(hits, hit)
+	}
+
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+}
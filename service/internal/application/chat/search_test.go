@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestFTSQuery(t *testing.T) {
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"kyoto", `"kyoto"*`},
+		{"  spring   in kyoto ", `"spring" "in" "kyoto"*`},
+		{`say "hi"`, `"say" """hi"""*`},
+		{"title:x OR y NEAR(", `"title:x" "OR" "y" "NEAR("*`},
+		{"...", `"..."*`},
+	}
+
+	for _, tt := range tests {
+		if got := ftsQuery(tt.input); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.input, got, tt.want)
+		}
+	}
+
+}
+
+// search runs the Search handler and returns the ids of the sources found.
+func search(t *testing.T, s *Service, userID uuid.UUID, query string) []string {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/v1/search/?q="+url.QueryEscape(query), nil)
+	r = r.WithContext(context.WithValue(r.Context(), "user_id", userID))
+	w := httptest.NewRecorder()
+	s.Search(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("%q: got status %d (%s)", query, w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	var hits []SearchHit
+	if err := json.NewDecoder(w.Body).Decode(&hits); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, hit := range hits {
+		switch hit.Kind {
+		case "chat":
+			ids = append(ids, hit.ChatID.String())
+		case "message":
+			ids = append(ids, hit.MessageID.String())
+		case "attachment":
+			ids = append(ids, hit.AttachmentID.String())
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+
+	s := newTestService(t)
+	userID, otherID := uuid.New(), uuid.New()
+
+	chatID, otherChatID := uuid.New(), uuid.New()
+	for _, c := range []struct {
+		id, user uuid.UUID
+	}{{chatID, userID}, {otherChatID, otherID}} {
+		_, err := s.db.Exec("INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			c.id, c.user, "Travel plans", "model", false, "done", 0, 0, 0, 0,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messageID, streamingID, otherMessageID := uuid.New(), uuid.New(), uuid.New()
+	for _, m := range []struct {
+		id, chat, user  uuid.UUID
+		status, content string
+	}{
+		{messageID, chatID, userID, "done", `Kyoto is lovely in "spring"`},
+		{streamingID, chatID, userID, "streaming", "Lisbon"},
+		{otherMessageID, otherChatID, otherID, "done", "Kyoto in autumn"},
+	} {
+		_, err := s.db.Exec("INSERT INTO messages (id, chat_id, user_id, parent_id, stream_id, role, status, model, content, reasoning, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			m.id, m.chat, m.user, "", "", "assistant", m.status, "model", m.content, "", 0, 0,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := s.saveAttachment(userID, uuid.UUID{}, "itinerary.txt", "text/plain", strings.NewReader("Day one: Fushimi Inari"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"title", "travel", []string{chatID.String()}},
+		{"prefix", "kyo", []string{messageID.String()}}, // The other user's message is not found
+		{"quotes", `"spring"`, []string{messageID.String()}},
+		{"query syntax", "kyoto OR lisbon", nil},
+		{"punctuation only", "...", nil},
+		{"streaming", "lisbon", nil},
+		{"unlinked attachment", "fushimi", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := search(t, s, userID, tt.query); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The triggers keep the index in sync with the changes
+	steps := []struct {
+		name  string
+		sql   string
+		args  []any
+		query string
+		want  []string
+	}{
+		{"attachment linked", "UPDATE attachments SET message_id = ? WHERE id = ?", []any{messageID, a.ID}, "fushimi", []string{a.ID.String()}},
+		{"message done", "UPDATE messages SET status = 'done' WHERE id = ?", []any{streamingID}, "lisbon", []string{streamingID.String()}},
+		{"message changed", "UPDATE messages SET content = 'Porto' WHERE id = ?", []any{streamingID}, "lisbon", nil},
+		{"title changed", "UPDATE chats SET title = 'Spring trip' WHERE id = ?", []any{chatID}, "trip", []string{chatID.String()}},
+		{"old title", "", nil, "travel", nil},
+		{"attachment deleted", "DELETE FROM attachments WHERE id = ?", []any{a.ID}, "fushimi", nil},
+		{"message deleted", "DELETE FROM messages WHERE id = ?", []any{streamingID}, "porto", nil},
+		{"chat deleted", "DELETE FROM chats WHERE id = ?", []any{chatID}, "kyoto", nil},
+	}
+
+	for _, step := range steps {
+		if step.sql != "" {
+			if _, err := s.db.Exec(step.sql, step.args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := search(t, s, userID, step.query); !slices.Equal(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// Only the other user's chat is left
+	var sources, rows int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM search_sources").Scan(&sources); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM search_index").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if sources != 2 || rows != 2 {
+		t.Errorf("got %d sources and %d index rows, want 2", sources, rows)
+	}
+	if got := search(t, s, otherID, "kyoto"); !slices.Equal(got, []string{otherMessageID.String()}) {
+		t.Errorf("other user: got %v", got)
+	}
+
+}
@@ -1,11 +1,14 @@
 package chat
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
+	"sync/atomic"
 
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/redact"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
 )
 
@@ -15,18 +18,59 @@ type Service struct {
 	db  *sql.DB
 	mr  *llm.ModelRouter
 	sp  *stream.StreamPool
+	sc  *scheduler
+	hub *userHub
+
+	draining atomic.Bool // Set on shutdown, new messages are rejected
 }
 
 // NewService creates a new Chat service according to the provided config
 func NewService(app *application.App) (*Service, error) {
 
-	// Return initialized service
-	return &Service{
+	mr := llm.NewModelRouter()
+
+	// Redact secrets and personal data from prompts sent to third-party providers
+	redactor, err := redact.New(app.Config.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	if redactor != nil {
+		mr.SetRedactor(redactor)
+	}
+
+	s := &Service{
 		cfg: &app.Config,
 		log: app.Logger,
 		db:  app.Database,
-		mr:  llm.NewModelRouter(),
-		sp:  stream.NewStreamPool(),
-	}, nil
+		mr:  mr,
+		sp:  stream.NewStreamPool(app.Config.Streams.RetentionPeriod),
+		sc:  newScheduler(app.Config.Streams.Concurrency),
+		hub: newUserHub(),
+	}
+
+	// Streams do not survive a restart, mark the messages they left behind
+	if err := s.recoverStreams(); err != nil {
+		return nil, err
+	}
+
+	app.OnShutdown(s.shutdown)
+
+	// Return initialized service
+	return s, nil
+
+}
+
+// shutdown stops accepting new messages and lets active streams finish until ctx expires.
+// Streams still running then are aborted, their partial content is stored by storeStream.
+func (s *Service) shutdown(ctx context.Context) {
+
+	s.draining.Store(true)
+
+	stats := s.sp.Stats()
+	s.log.Info("waiting for active streams", "streams", stats.Running)
+
+	if aborted := s.sp.Shutdown(ctx); aborted > 0 {
+		s.log.Warn("aborted active streams", "streams", aborted)
+	}
 
 }
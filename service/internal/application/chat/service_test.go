@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/application"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestService returns a service on a new database in a temporary working directory.
+// The schema needs FTS5, tests are skipped unless built with -tags sqlite_fts5.
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	t.Chdir(t.TempDir())
+	app, err := application.NewApp(application.Config{Logging: application.LoggingConfig{LogFilePath: "app.log"}})
+	if err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skip("database tests need -tags sqlite_fts5")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+
+	return &Service{
+		cfg: &app.Config,
+		log: app.Logger,
+		db:  app.Database,
+		mr:  llm.NewModelRouter(),
+		sp:  stream.NewStreamPool(0),
+		sc:  newScheduler(app.Config.Streams.Concurrency),
+		hub: newUserHub(),
+	}
+}
+
+// newTestUser creates a user, the trigger creates its profile with the default limits.
+func newTestUser(t *testing.T, s *Service) uuid.UUID {
+	t.Helper()
+
+	userID := uuid.New()
+	_, err := s.db.Exec("INSERT INTO users (id, username, email, password_hash, created_at, updated_at, is_verified, mfa_active) VALUES (?, ?, ?, '', 0, 0, 0, 0)",
+		userID, userID.String(), userID.String()+"@example.com",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
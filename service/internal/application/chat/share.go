@@ -37,7 +37,14 @@ func (s *Service) GetSharedChat(w http.ResponseWriter, r *http.Request) {
 
 	id := mux.Vars(r)["id"]
 
+	// Only the active branch is shared, chats without one predate branches and are shared in full
 	query := `
+        WITH RECURSIVE branch(id, parent_id) AS (
+            SELECT m.id, m.parent_id FROM messages m JOIN chats c ON c.id = m.chat_id
+            WHERE c.id = ? AND m.id = c.active_message_id
+            UNION
+            SELECT m.id, m.parent_id FROM messages m JOIN branch b ON m.id = b.parent_id
+        )
         SELECT
             c.id, c.user_id, c.title, c.model,
             m.id, m.role, m.model, m.content, m.reasoning,
@@ -46,10 +53,11 @@ func (s *Service) GetSharedChat(w http.ResponseWriter, r *http.Request) {
         LEFT JOIN messages m ON c.id = m.chat_id
         LEFT JOIN attachments a ON m.id = a.message_id
         WHERE c.id = ? AND c.created_at <= c.shared_at AND m.created_at <= c.shared_at
+            AND (c.active_message_id = '' OR m.id IN (SELECT id FROM branch))
         ORDER BY m.created_at ASC, a.created_at ASC
     `
 
-	rows, err := s.db.Query(query, id)
+	rows, err := s.db.Query(query, id, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,23 +3,27 @@ package chat
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 func (s *Service) OpenStream(w http.ResponseWriter, r *http.Request) {
 
-	// // Get userID from auth middleware, ok if authenticated
-	// userID, ok := r.Context().Value("user_id").(uuid.UUID)
-	// if !ok {
-	// 	s.log.Debug("User is not authenticated")
-	// 	http.Error(w, "not_authenticated", http.StatusUnauthorized)
-	// 	return
-	// }
-	// _ = userID // TODO: Handle auth for streams
+	// Get userID from auth middleware, viewers of shared chats may not be authenticated
+	userID, _ := r.Context().Value("user_id").(uuid.UUID)
 
 	streamID := mux.Vars(r)["id"]
+	if err := s.authorizeStream(streamID, userID, false); err != nil {
+		s.log.Debug("stream access denied", "stream_id", streamID, "user_id", userID, "error", err)
+		writeError(w, err)
+		return
+	}
 
 	// Set headers for Server-Sent Events
 	w.Header().Set("Content-Type", "text/event-stream")
@@ -33,11 +37,38 @@ func (s *Service) OpenStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The backpressure policy can be chosen per subscription
+	opts := s.subscribeOptions()
+	if name := r.URL.Query().Get("policy"); name != "" {
+		policy, ok := stream.ParsePolicy(name)
+		if !ok {
+			s.log.Debug("invalid backpressure policy", "policy", name)
+			http.Error(w, "invalid_policy", http.StatusBadRequest)
+			return
+		}
+		opts.Policy = policy
+	}
+
+	// Resume after the last event the client received, browsers send it when reconnecting
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		after, err := strconv.Atoi(lastEventID)
+		if err != nil {
+			s.log.Debug("invalid last event id", "last_event_id", lastEventID)
+			http.Error(w, "invalid_last_event_id", http.StatusBadRequest)
+			return
+		}
+		opts.After = after
+	}
+
 	// Subscribe to the stream
-	sub, ok := s.sp.Subscribe(streamID)
+	sub, ok := s.sp.Subscribe(streamID, opts)
 	if !ok {
-		s.log.Debug("stream not found", "stream_id", streamID)
-		http.Error(w, "stream not found", http.StatusNotFound)
+		// The stream may have finished already, replay it from the stored message
+		s.replayStream(w, flusher, streamID)
 		return
 	}
 	defer sub.Cancel()
@@ -50,34 +81,28 @@ func (s *Service) OpenStream(w http.ResponseWriter, r *http.Request) {
 			s.log.Debug("stream: client closed connection", "stream_id", streamID)
 			return
 
-		case chunk, more := <-sub.Read():
+		case event, more := <-sub.Read():
+			if !more && sub.Err() != nil {
+				// subscriber was disconnected by its backpressure policy, the client may reconnect
+				s.log.Debug("stream: subscriber did not keep up", "stream_id", streamID)
+				if err := writeEvent(w, stream.Event{Type: stream.EventError, Error: "slow_subscriber"}); err != nil {
+					s.log.Debug("stream: write failed", "err", err)
+					return
+				}
+				flusher.Flush()
+				return
+			}
 			if !more {
 				// publisher closed the stream
 				s.log.Debug("stream: provider closed the stream", "stream_id", streamID)
-				// write the SSE event
-				if _, err := fmt.Fprint(w,
-					"event: message_end\n",
-					"data: {}\n\n",
-				); err != nil {
+				if err := writeEnd(w); err != nil {
 					s.log.Debug("stream: write failed", "err", err)
 					return
 				}
 				flusher.Flush()
 				return
 			}
-			// write the SSE event
-			if _, err := fmt.Fprint(w,
-				"event: message_delta\n",
-				"data: ",
-			); err != nil {
-				s.log.Debug("stream: write failed", "err", err)
-				return
-			}
-			if err := json.NewEncoder(w).Encode(chunk); err != nil {
-				s.log.Debug("stream: json encoding failed", "err", err)
-				return
-			}
-			if _, err := fmt.Fprint(w, "\n"); err != nil {
+			if err := writeEvent(w, event); err != nil {
 				s.log.Debug("stream: write failed", "err", err)
 				return
 			}
@@ -87,18 +112,146 @@ func (s *Service) OpenStream(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// TODO: Consider creating a database table to keep track of ongoing streams
+// subscribeOptions returns the configured default options for stream subscriptions.
+func (s *Service) subscribeOptions() stream.SubscribeOptions {
+	return stream.SubscribeOptions{
+		Buffer:  s.cfg.Streams.SubscriberBuffer,
+		Policy:  stream.Policy(s.cfg.Streams.SubscriberPolicy),
+		Timeout: s.cfg.Streams.SubscriberTimeout,
+	}
+}
+
+// replayStream sends the stored content of a finished stream as a snapshot, so clients that
+// were disconnected when it ended can still reopen it within the replay grace period.
+func (s *Service) replayStream(w http.ResponseWriter, flusher http.Flusher, streamID string) {
+
+	var (
+		snapshot  stream.Chunk
+		blocks    string
+		status    string
+		updatedAt int64
+	)
+	err := s.db.QueryRow("SELECT content, reasoning, blocks, status, updated_at FROM messages WHERE stream_id = ? AND role = 'assistant'", streamID).
+		Scan(&snapshot.Content, &snapshot.Reasoning, &blocks, &status, &updatedAt)
+	if err != nil || status == "queued" || status == "streaming" || time.Since(time.UnixMilli(updatedAt)) > s.cfg.Streams.ReplayGracePeriod {
+		s.log.Debug("stream not found", "stream_id", streamID)
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	if blocks != "" {
+		if err := json.Unmarshal([]byte(blocks), &snapshot.Blocks); err != nil {
+			s.log.Warn("failed to decode blocks", "stream_id", streamID, "error", err)
+		}
+	}
+
+	s.log.Debug("stream: replaying finished stream", "stream_id", streamID)
+	w.WriteHeader(http.StatusOK)
+	events := []stream.Event{
+		{Type: stream.EventSnapshot, Seq: 1, Snapshot: &snapshot},
+		{Type: stream.EventStatus, Seq: 2, Status: status},
+	}
+	for _, event := range events {
+		if err := writeEvent(w, event); err != nil {
+			s.log.Debug("stream: write failed", "err", err)
+			return
+		}
+	}
+	if err := writeEnd(w); err != nil {
+		s.log.Debug("stream: write failed", "err", err)
+		return
+	}
+	flusher.Flush()
+
+}
+
+// writeEvent writes an SSE event named after the event type.
+// Its sequence number is sent as the event id, so clients can resume after it.
+func writeEvent(w io.Writer, event stream.Event) error {
+	if event.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Seq); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "event: ", event.Type, "\n", "data: "); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(event); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w, "\n")
+	return err
+}
+
+// writeEnd writes the event that tells the client to close the connection.
+func writeEnd(w io.Writer) error {
+	_, err := fmt.Fprint(w,
+		"event: message_end\n",
+		"data: {}\n\n",
+	)
+	return err
+}
+
 func (s *Service) CancelStream(w http.ResponseWriter, r *http.Request) {
 
-	// // Get userID from auth middleware, ok if authenticated
-	// userID, ok := r.Context().Value("user_id").(uuid.UUID)
-	// if !ok {
-	// 	s.log.Debug("User is not authenticated")
-	// 	http.Error(w, "not_authenticated", http.StatusUnauthorized)
-	// 	return
-	// }
-	// _ = userID // TODO: Handle auth for streams
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
 
 	streamID := mux.Vars(r)["id"]
+	if err := s.authorizeStream(streamID, userID, true); err != nil {
+		s.log.Debug("stream access denied", "stream_id", streamID, "user_id", userID, "error", err)
+		writeError(w, err)
+		return
+	}
+
 	s.sp.Cancel(streamID)
+
+}
+
+// authorizeStream checks whether the user may access a stream. The owner may subscribe
+// and cancel, everyone else may only subscribe to streams of messages in a shared chat.
+func (s *Service) authorizeStream(streamID string, userID uuid.UUID, cancel bool) error {
+
+	// Messages without a stream store the zero UUID, it must not match any of them
+	if id, err := uuid.Parse(streamID); err != nil || id == uuid.Nil {
+		return &requestError{http.StatusNotFound, "stream not found"}
+	}
+
+	var owner string
+	if info, ok := s.sp.Info(streamID); ok {
+		owner = info.UserID
+	} else {
+		// Finished streams that were evicted from the pool are replayed from the stored message
+		err := s.db.QueryRow("SELECT user_id FROM messages WHERE stream_id = ? AND role = 'assistant'", streamID).Scan(&owner)
+		if err != nil {
+			return &requestError{http.StatusNotFound, "stream not found"}
+		}
+	}
+
+	if userID != (uuid.UUID{}) && owner == userID.String() {
+		return nil
+	}
+	if cancel {
+		return &requestError{http.StatusForbidden, "not_authorized"}
+	}
+
+	// Same visibility rule as GetSharedChat
+	var shared bool
+	err := s.db.QueryRow(`
+		SELECT c.created_at <= c.shared_at AND m.created_at <= c.shared_at
+		FROM messages m
+		JOIN chats c ON c.id = m.chat_id
+		WHERE m.stream_id = ? AND m.role = 'assistant'`,
+		streamID,
+	).Scan(&shared)
+	if err != nil || !shared {
+		return &requestError{http.StatusForbidden, "not_authorized"}
+	}
+
+	return nil
+
 }
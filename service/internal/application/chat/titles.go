@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+)
+
+const titlePrompt = `You write titles for conversations. Reply with a short title of at most six words
+that summarizes the conversation below. Use the language of the conversation. Reply with the title only,
+without quotes, markdown or punctuation at the end.`
+
+// titleExcerpt is the number of characters of each message the title model sees.
+const titleExcerpt = 2000
+
+// generateTitle replaces the placeholder title of a new chat once the first exchange is complete.
+// The title is kept if the user renamed the chat in the meantime.
+func (s *Service) generateTitle(chatID, userID uuid.UUID, placeholder string, streamID uuid.UUID) {
+
+	key := s.cfg.Titles.Model
+	if key == "" {
+		return
+	}
+
+	model, ok := s.mr.GetModel(key)
+	if !ok {
+		s.log.Warn("title model not supported", "model", key)
+		return
+	}
+
+	// Wait for the first response, it is stored once the stream is done
+	if compl, ok := s.sp.Get(streamID.String()); ok {
+		if err := compl.Wait(); err != nil {
+			return
+		}
+	}
+
+	var prompt, response string
+	err := s.db.QueryRow(`
+		SELECT
+			(SELECT content FROM messages WHERE chat_id = ? AND role = 'user' ORDER BY created_at ASC LIMIT 1),
+			(SELECT content FROM messages WHERE chat_id = ? AND role = 'assistant' AND status = 'done' ORDER BY created_at ASC LIMIT 1)`,
+		chatID, chatID,
+	).Scan(&prompt, &response)
+	if err != nil {
+		s.log.Debug("failed to get first exchange", "chat_id", chatID, "error", err)
+		return
+	}
+
+	profile, err := s.getUserProfile(userID)
+	if err != nil {
+		s.log.Warn("failed to get user profile", "error", err)
+		return
+	}
+
+	req := chat.Request{
+		Model:               key,
+		Temperature:         0.3,
+		MaxCompletionTokens: 256,
+		TopP:                1.0,
+		Stream:              true,
+		System:              titlePrompt,
+		Messages: []*chat.Message{{
+			Role:        "user",
+			Content:     fmt.Sprintf("User: %s\n\nAssistant: %s", excerpt(prompt, titleExcerpt), excerpt(response, titleExcerpt)),
+			Attachments: []*chat.Attachment{},
+		}},
+	}
+
+	// Titles are queued with the other generations, so they respect the concurrency limits.
+	// The stream is added to the pool like completion streams, so it is aborted on shutdown.
+	compl := stream.New()
+	s.sp.Add(uuid.NewString(), compl, stream.Info{
+		UserID: userID.String(),
+		ChatID: chatID.String(),
+		Model:  key,
+	})
+	var title string
+	compl.OnClose(func(chunk stream.Chunk, err error) {
+		if err == nil {
+			title = chunk.Content
+		}
+	})
+	if _, err := s.sc.submit(&generation{
+		stream: compl,
+		keys:   generationKeys(userID.String(), key, string(model.Provider)),
+		start: func() error {
+			return s.mr.Start(compl, req, profile.Options())
+		},
+	}); err != nil {
+		s.log.Warn("failed to start title generation", "chat_id", chatID, "error", err)
+		return
+	}
+	if err := compl.Wait(); err != nil {
+		s.log.Warn("title generation failed", "chat_id", chatID, "error", err)
+		return
+	}
+
+	title = cleanTitle(title, s.cfg.Titles.MaxLength)
+	if title == "" {
+		return
+	}
+
+	result, err := s.db.Exec("UPDATE chats SET title = ?, updated_at = ? WHERE id = ? AND title = ?", title, time.Now().UnixMilli(), chatID, placeholder)
+	if err != nil {
+		s.log.Warn("failed to update chat title", "chat_id", chatID, "error", err)
+		return
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		s.log.Debug("chat was renamed before the title was generated", "chat_id", chatID)
+		return
+	}
+
+	s.hub.publish(userID, UserEvent{
+		Type: "chat_updated",
+		Chat: &ChatUpdate{ID: chatID, Title: title},
+	})
+
+}
+
+// excerpt returns the first n characters of text.
+func excerpt(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}
+
+// cleanTitle removes what models tend to add around a title and cuts it to maxLength characters.
+func cleanTitle(title string, maxLength int) string {
+	title = strings.TrimSpace(title)
+	title, _, _ = strings.Cut(title, "\n")
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(title, " \t\"'`*#.")
+	if runes := []rune(title); maxLength > 0 && len(runes) > maxLength {
+		title = strings.TrimSpace(string(runes[:maxLength]))
+	}
+	return title
+}
@@ -0,0 +1,246 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second    // Time allowed to write a message to the peer
+	wsPongWait   = 60 * time.Second    // Time allowed to read the next pong message from the peer
+	wsPingPeriod = wsPongWait * 9 / 10 // Send pings to the peer with this period, must be less than wsPongWait
+)
+
+var upgrader = websocket.Upgrader{
+	// Browsers cannot set the Authorization header on WebSockets, so the session
+	// token is offered as a second subprotocol next to "bearer" (see AuthMiddleware).
+	Subprotocols: []string{"bearer"},
+	// TODO: use proper origin checks in production, the session token is not sent
+	// automatically by browsers, so cross-site connections are not authenticated
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message sent by the client over the WebSocket.
+type wsRequest struct {
+	Type        string                `json:"type"`                 // "subscribe", "unsubscribe", "cancel" or "send"
+	RequestID   string                `json:"request_id,omitempty"` // Echoed in the response to "send" and in errors
+	StreamID    string                `json:"stream_id,omitempty"`
+	LastEventID int                   `json:"last_event_id,omitempty"` // Resume a subscription after this event
+	ChatID      uuid.UUID             `json:"chat_id,omitzero"`        // Chat to add the message to, a new chat is created if empty
+	Message     ChatCompletionRequest `json:"message"`
+}
+
+// wsResponse is a message sent by the server over the WebSocket.
+type wsResponse struct {
+	Type      string        `json:"type"` // "event", "end", "started", "error" or the type of a user event
+	RequestID string        `json:"request_id,omitempty"`
+	StreamID  string        `json:"stream_id,omitempty"`
+	ChatID    uuid.UUID     `json:"chat_id,omitzero"`
+	Event     *stream.Event `json:"event,omitempty"`
+	Chat      *ChatUpdate   `json:"chat,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// wsConn multiplexes stream subscriptions of one user over a WebSocket connection.
+type wsConn struct {
+	s      *Service
+	conn   *websocket.Conn
+	userID uuid.UUID
+
+	writeMu sync.Mutex // Serializes writes, the connection supports only one concurrent writer
+
+	mu   sync.Mutex
+	subs map[string]*stream.Subscription
+	wg   sync.WaitGroup
+}
+
+func (s *Service) OpenWebSocket(w http.ResponseWriter, r *http.Request) {
+
+	// Get userID from auth middleware, ok if authenticated
+	userID, ok := r.Context().Value("user_id").(uuid.UUID)
+	if !ok {
+		s.log.Debug("User is not authenticated")
+		http.Error(w, "not_authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Debug("websocket upgrade failed", "error", err)
+		return // Upgrade already wrote the error response
+	}
+
+	c := &wsConn{
+		s:      s,
+		conn:   conn,
+		userID: userID,
+		subs:   make(map[string]*stream.Subscription),
+	}
+	c.serve()
+
+}
+
+// serve reads client requests until the connection is closed.
+func (c *wsConn) serve() {
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.mu.Lock()
+		for _, sub := range c.subs {
+			sub.Cancel()
+		}
+		c.mu.Unlock()
+		c.wg.Wait()
+		c.conn.Close()
+	}()
+
+	// Forward the user's events, e.g. generated chat titles
+	events, unsubscribe := c.s.hub.subscribe(c.userID)
+	defer unsubscribe()
+	go func() {
+		for event := range events {
+			c.write(wsResponse{Type: event.Type, Chat: event.Chat})
+		}
+	}()
+
+	// Keep the connection alive and detect dead peers
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.writeMu.Lock()
+				err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+				c.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.s.log.Debug("websocket: read failed", "user_id", c.userID, "error", err)
+			}
+			return
+		}
+		c.handle(req)
+	}
+
+}
+
+func (c *wsConn) handle(req wsRequest) {
+	switch req.Type {
+	case "subscribe":
+		c.subscribe(req.StreamID, req.LastEventID)
+	case "unsubscribe":
+		c.unsubscribe(req.StreamID)
+	case "cancel":
+		if err := c.s.authorizeStream(req.StreamID, c.userID, true); err != nil {
+			c.write(wsResponse{Type: "error", RequestID: req.RequestID, StreamID: req.StreamID, Error: err.Error()})
+			return
+		}
+		c.s.sp.Cancel(req.StreamID)
+	case "send":
+		var chatID, streamID uuid.UUID
+		var err error
+		if req.ChatID == (uuid.UUID{}) {
+			chatID, streamID, err = c.s.sendMessage(c.userID, req.Message)
+		} else {
+			chatID = req.ChatID
+			streamID, err = c.s.addMessage(chatID, c.userID, req.Message)
+		}
+		if err != nil {
+			c.write(wsResponse{Type: "error", RequestID: req.RequestID, Error: err.Error()})
+			return
+		}
+		c.write(wsResponse{Type: "started", RequestID: req.RequestID, ChatID: chatID, StreamID: streamID.String()})
+		c.subscribe(streamID.String(), 0)
+	default:
+		c.write(wsResponse{Type: "error", RequestID: req.RequestID, Error: "unknown_request_type"})
+	}
+}
+
+// subscribe forwards the events of a stream to the client until it ends or is unsubscribed.
+func (c *wsConn) subscribe(streamID string, after int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[streamID]; ok {
+		return // already subscribed
+	}
+
+	if err := c.s.authorizeStream(streamID, c.userID, false); err != nil {
+		c.write(wsResponse{Type: "error", StreamID: streamID, Error: err.Error()})
+		return
+	}
+
+	opts := c.s.subscribeOptions()
+	opts.After = after
+	sub, ok := c.s.sp.Subscribe(streamID, opts)
+	if !ok {
+		c.write(wsResponse{Type: "error", StreamID: streamID, Error: "stream_not_found"})
+		return
+	}
+	c.subs[streamID] = sub
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for event := range sub.Read() {
+			c.write(wsResponse{Type: "event", StreamID: streamID, Event: &event})
+		}
+		c.mu.Lock()
+		if c.subs[streamID] == sub {
+			delete(c.subs, streamID)
+		}
+		c.mu.Unlock()
+		if sub.Err() != nil {
+			c.write(wsResponse{Type: "error", StreamID: streamID, Error: "slow_subscriber"})
+			return
+		}
+		c.write(wsResponse{Type: "end", StreamID: streamID})
+	}()
+
+}
+
+func (c *wsConn) unsubscribe(streamID string) {
+	c.mu.Lock()
+	sub, ok := c.subs[streamID]
+	delete(c.subs, streamID)
+	c.mu.Unlock()
+	if ok {
+		sub.Cancel()
+	}
+}
+
+func (c *wsConn) write(res wsResponse) {
+	data, err := json.Marshal(res)
+	if err != nil {
+		c.s.log.Error("websocket: json encoding failed", "error", err)
+		return
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.s.log.Debug("websocket: write failed", "user_id", c.userID, "error", err)
+	}
+}
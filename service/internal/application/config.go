@@ -2,8 +2,10 @@ package application
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/redact"
 	"github.com/spf13/viper"
 )
 
@@ -13,9 +15,18 @@ func LoadConfig(cfgFile string) (*Config, error) {
 
 	// Define default config values
 	v.SetDefault("server|host", ":3141")
+	v.SetDefault("server|shutdown_timeout", "30s")
 	v.SetDefault("logging|log_file_path", "data/app.log")
 	v.SetDefault("logging|log_format", "text")
 	v.SetDefault("logging|log_level", "debug")
+	v.SetDefault("streams|checkpoint_interval", "2s")
+	v.SetDefault("streams|checkpoint_bytes", 2048)
+	v.SetDefault("streams|subscriber_buffer", 64)
+	v.SetDefault("streams|subscriber_policy", "resync")
+	v.SetDefault("streams|subscriber_timeout", "5s")
+	v.SetDefault("streams|replay_grace_period", "5m")
+	v.SetDefault("streams|retention_period", "1m")
+	v.SetDefault("titles|max_length", 80)
 
 	// Tell viper where to look for the config file
 	v.SetConfigFile(cfgFile)
@@ -40,11 +51,18 @@ type Config struct {
 	Server  ServerConfig         `mapstructure:"server" yaml:"server"`
 	Logging LoggingConfig        `mapstructure:"logging" yaml:"logging"`
 	Users   []UserConfig         `mapstructure:"users" yaml:"users"`
+	Admins  []string             `mapstructure:"admins" yaml:"admins"` // Usernames allowed to access the admin endpoints
 	Models  map[string]llm.Model `mapstructure:"models" yaml:"models"`
+	Streams StreamsConfig        `mapstructure:"streams" yaml:"streams"`
+	Titles  TitlesConfig         `mapstructure:"titles" yaml:"titles"`
+
+	Redaction  redact.Config   `mapstructure:"redaction" yaml:"redaction"`
+	RateLimits RateLimitConfig `mapstructure:"rate_limits" yaml:"rate_limits"`
 }
 
 type ServerConfig struct {
-	Host string `mapstructure:"host" yaml:"host"` // Hostname of the application
+	Host            string        `mapstructure:"host" yaml:"host"`                         // Hostname of the application
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" yaml:"shutdown_timeout"` // How long active streams may finish on shutdown before they are aborted
 	// ReadTimeout  int    `mapstructure:"read_timeout" yaml:"read_timeout` // Time a request must take at most in seconds
 	// WriteTimeout int  `mapstructure:"write_timeout" yaml:"write_timeout`  // Time a response must take at most in seconds
 }
@@ -56,6 +74,49 @@ type LoggingConfig struct {
 	LogVerbose  bool   // Output log messages to stdout in addition to the log file
 }
 
+type StreamsConfig struct {
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval" yaml:"checkpoint_interval"` // Store the content of a running stream at least this often (0 disables)
+	CheckpointBytes    int           `mapstructure:"checkpoint_bytes" yaml:"checkpoint_bytes"`       // Store the content of a running stream every this many bytes (0 disables)
+	SubscriberBuffer   int           `mapstructure:"subscriber_buffer" yaml:"subscriber_buffer"`     // Number of events buffered per subscriber
+	SubscriberPolicy   string        `mapstructure:"subscriber_policy" yaml:"subscriber_policy"`     // Default policy for slow subscribers ("resync", "block", "disconnect")
+	SubscriberTimeout  time.Duration `mapstructure:"subscriber_timeout" yaml:"subscriber_timeout"`   // How long the "block" policy waits for a slow subscriber
+	ReplayGracePeriod  time.Duration `mapstructure:"replay_grace_period" yaml:"replay_grace_period"` // How long a finished stream can be reopened from the stored message
+	RetentionPeriod    time.Duration `mapstructure:"retention_period" yaml:"retention_period"`       // How long a finished stream is kept in memory for late subscribers
+
+	Concurrency ConcurrencyConfig `mapstructure:"concurrency" yaml:"concurrency"`
+}
+
+// ConcurrencyConfig limits the number of generations running at the same time, 0 means unlimited.
+// Generations exceeding a limit are queued.
+type ConcurrencyConfig struct {
+	Total     int            `mapstructure:"total" yaml:"total"`         // Generations on the whole server
+	PerUser   int            `mapstructure:"per_user" yaml:"per_user"`   // Generations per user
+	Models    map[string]int `mapstructure:"models" yaml:"models"`       // Generations per model, by model key
+	Providers map[string]int `mapstructure:"providers" yaml:"providers"` // Generations per provider, e.g. "ollama"
+}
+
+// TitlesConfig configures the titles generated for new chats after the first exchange.
+type TitlesConfig struct {
+	Model     string `mapstructure:"model" yaml:"model"`           // Key of the model generating titles, no titles are generated if empty
+	MaxLength int    `mapstructure:"max_length" yaml:"max_length"` // Generated titles are cut to this number of characters
+}
+
+// RateLimitConfig limits the request rate per user, or per IP address for unauthenticated requests.
+type RateLimitConfig struct {
+	TrustProxy bool            `mapstructure:"trust_proxy" yaml:"trust_proxy"` // Identify unauthenticated clients by the X-Forwarded-For header
+	ProxyHops  int             `mapstructure:"proxy_hops" yaml:"proxy_hops"`   // Number of trusted proxies appending to X-Forwarded-For, defaults to 1
+	Default    RateLimitRule   `mapstructure:"default" yaml:"default"`         // Applied to routes without a rule of their own
+	Routes     []RateLimitRule `mapstructure:"routes" yaml:"routes"`           // The rule with the longest matching path is applied
+}
+
+type RateLimitRule struct {
+	Path   string        `mapstructure:"path" yaml:"path"`     // Path prefix, e.g. "/v1/auth/login/"
+	Method string        `mapstructure:"method" yaml:"method"` // Only apply to this method if set
+	Limit  int           `mapstructure:"limit" yaml:"limit"`   // Requests per period, 0 disables the limit
+	Period time.Duration `mapstructure:"period" yaml:"period"` // Period in which the limit refills
+	Burst  int           `mapstructure:"burst" yaml:"burst"`   // Maximum requests at once, defaults to limit
+}
+
 type UserConfig struct {
 	Username string `mapstructure:"username" yaml:"username"`
 	Email    string `mapstructure:"email" yaml:"email"`
@@ -23,6 +23,20 @@ CREATE TABLE
         FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
     );
 
+CREATE TABLE
+    IF NOT EXISTS api_tokens (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        prefix TEXT NOT NULL,
+        token_hash TEXT UNIQUE NOT NULL,
+        scopes TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL DEFAULT 0,
+        last_used_at INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    );
+
 -- Chat Data
 CREATE TABLE
     IF NOT EXISTS user_profile (
@@ -56,6 +70,9 @@ CREATE TABLE
         updated_at INTEGER NOT NULL,
         last_message_at INTEGER NOT NULL,
         shared_at INTEGER NOT NULL,
+        active_message_id TEXT NOT NULL DEFAULT "", -- Last message of the branch shown to the user
+        import_source TEXT NOT NULL DEFAULT "", -- Origin of imported chats, e.g. "chatgpt:<conversation id>"
+        project_id TEXT NOT NULL DEFAULT "", -- Project the chat belongs to, empty if none
         FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
     );
 
@@ -64,14 +81,23 @@ CREATE TABLE
         id TEXT PRIMARY KEY,
         user_id TEXT NOT NULL,
         chat_id TEXT NOT NULL,
+        parent_id TEXT NOT NULL DEFAULT "", -- Previous message on the branch, empty for the first message
         stream_id TEXT NOT NULL,
         role TEXT NOT NULL,
         model TEXT NOT NULL,
         content TEXT NOT NULL,
         reasoning TEXT NOT NULL,
+        blocks TEXT NOT NULL DEFAULT "", -- JSON encoded code, execution result and image blocks
+        reasoning_blocks TEXT NOT NULL DEFAULT "", -- JSON encoded provider reasoning blocks
         status TEXT NOT NULL,
         created_at INTEGER NOT NULL,
         updated_at INTEGER NOT NULL,
+        -- stream metrics (assistant messages only)
+        ttft_ms INTEGER NOT NULL DEFAULT 0,
+        ttfc_ms INTEGER NOT NULL DEFAULT 0,
+        duration_ms INTEGER NOT NULL DEFAULT 0,
+        output_tokens INTEGER NOT NULL DEFAULT 0,
+        tokens_per_second REAL NOT NULL DEFAULT 0,
         FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
         FOREIGN KEY (chat_id) REFERENCES chats (id) ON DELETE CASCADE
     );
@@ -84,31 +110,98 @@ CREATE TABLE
         name TEXT NOT NULL,
         type TEXT NOT NULL,
         src TEXT NOT NULL,
+        text TEXT NOT NULL DEFAULT "", -- Extracted text of text based attachments, used for search
         created_at INTEGER NOT NULL,
         FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
         FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE
     );
 
+CREATE TABLE
+    IF NOT EXISTS projects (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        description TEXT NOT NULL DEFAULT "",
+        system_prompt TEXT NOT NULL DEFAULT "", -- Added to the user's system prompt in the project's chats
+        model TEXT NOT NULL DEFAULT "", -- Default model of the project's chats
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    );
+
+-- Reference attachments included in every chat of a project
+CREATE TABLE
+    IF NOT EXISTS project_attachments (
+        project_id TEXT NOT NULL,
+        attachment_id TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        PRIMARY KEY (project_id, attachment_id),
+        FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+        FOREIGN KEY (attachment_id) REFERENCES attachments (id) ON DELETE CASCADE
+    );
+
+-- Full-text index over chat titles, messages and attachments, requires the sqlite_fts5 build tag.
+-- source_id is the id of the indexed chat, message or attachment.
+CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5 (
+    content,
+    kind UNINDEXED, -- "chat", "message" or "attachment"
+    user_id UNINDEXED,
+    chat_id UNINDEXED,
+    message_id UNINDEXED,
+    source_id UNINDEXED,
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+-- Maps the indexed chats, messages and attachments to their rows in search_index, so the
+-- triggers can remove them by rowid instead of scanning the index for the unindexed source_id.
+CREATE TABLE
+    IF NOT EXISTS search_sources (
+        id INTEGER PRIMARY KEY, -- rowid in search_index
+        source_id TEXT NOT NULL UNIQUE,
+        chat_id TEXT NOT NULL
+    );
+
 -- Create indexes for more efficient querying
 CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
 
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
+
 CREATE INDEX IF NOT EXISTS idx_chats_user_id ON chats (user_id);
 
+CREATE INDEX IF NOT EXISTS idx_chats_user_id_last_message_at ON chats (user_id, last_message_at);
+
+CREATE INDEX IF NOT EXISTS idx_chats_project_id ON chats (project_id);
+
+CREATE INDEX IF NOT EXISTS idx_projects_user_id ON projects (user_id);
+
+CREATE INDEX IF NOT EXISTS idx_project_attachments_attachment_id ON project_attachments (attachment_id);
+
+CREATE INDEX IF NOT EXISTS idx_search_sources_chat_id ON search_sources (chat_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_chats_import_source ON chats (user_id, import_source) WHERE import_source != '';
+
 CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages (user_id);
 
 CREATE INDEX IF NOT EXISTS idx_messages_chat_id ON messages (chat_id);
 
+CREATE INDEX IF NOT EXISTS idx_messages_stream_id ON messages (stream_id);
+
 CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
 
 CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at ON messages (chat_id, created_at);
 
+CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages (parent_id);
+
+CREATE INDEX IF NOT EXISTS idx_messages_model_created_at ON messages (model, created_at);
+
 -- Create triggers for automatic updates
 
 CREATE TRIGGER update_chat_on_message_create AFTER INSERT ON messages FOR EACH ROW BEGIN
 UPDATE chats
 SET
     last_message_at = NEW.created_at,
-    status = NEW.status
+    status = NEW.status,
+    active_message_id = NEW.id
 WHERE
     id = NEW.chat_id;
 
@@ -124,6 +217,110 @@ WHERE
 
 END;
 
+-- Triggers to keep the search index in sync. Messages are indexed once they stopped streaming,
+-- attachments once they are linked to a message.
+
+CREATE TRIGGER index_chat_on_create AFTER INSERT ON chats FOR EACH ROW BEGIN
+INSERT INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.id);
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT id, NEW.title, 'chat', NEW.user_id, NEW.id, '', NEW.id
+FROM search_sources WHERE source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_chat_on_change AFTER
+UPDATE OF title ON chats FOR EACH ROW WHEN OLD.title != NEW.title BEGIN
+DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT id, NEW.title, 'chat', NEW.user_id, NEW.id, '', NEW.id
+FROM search_sources WHERE source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_chat_on_delete AFTER DELETE ON chats FOR EACH ROW BEGIN
+DELETE FROM search_index WHERE rowid IN (SELECT id FROM search_sources WHERE chat_id = OLD.id);
+
+DELETE FROM search_sources WHERE chat_id = OLD.id;
+
+END;
+
+CREATE TRIGGER index_message_on_create AFTER INSERT ON messages FOR EACH ROW WHEN NEW.status NOT IN ('queued', 'streaming') BEGIN
+INSERT INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.chat_id);
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT id, NEW.content, 'message', NEW.user_id, NEW.chat_id, NEW.id, NEW.id
+FROM search_sources WHERE source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_message_on_change AFTER
+UPDATE OF content, status ON messages FOR EACH ROW WHEN NEW.status NOT IN ('queued', 'streaming') BEGIN
+DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+
+INSERT OR IGNORE INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.chat_id);
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT id, NEW.content, 'message', NEW.user_id, NEW.chat_id, NEW.id, NEW.id
+FROM search_sources WHERE source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_message_on_delete AFTER DELETE ON messages FOR EACH ROW BEGIN
+DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+
+DELETE FROM search_sources WHERE source_id = OLD.id;
+
+END;
+
+CREATE TRIGGER index_attachment_on_create AFTER INSERT ON attachments FOR EACH ROW BEGIN
+INSERT INTO search_sources (source_id, chat_id)
+SELECT NEW.id, m.chat_id FROM messages m WHERE m.id = NEW.message_id;
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT s.id, NEW.name || char(10) || NEW.text, 'attachment', NEW.user_id, s.chat_id, NEW.message_id, NEW.id
+FROM search_sources s WHERE s.source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_attachment_on_change AFTER
+UPDATE OF message_id ON attachments FOR EACH ROW BEGIN
+DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+
+DELETE FROM search_sources WHERE source_id = OLD.id;
+
+INSERT INTO search_sources (source_id, chat_id)
+SELECT NEW.id, m.chat_id FROM messages m WHERE m.id = NEW.message_id;
+
+INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+SELECT s.id, NEW.name || char(10) || NEW.text, 'attachment', NEW.user_id, s.chat_id, NEW.message_id, NEW.id
+FROM search_sources s WHERE s.source_id = NEW.id;
+
+END;
+
+CREATE TRIGGER index_attachment_on_delete AFTER DELETE ON attachments FOR EACH ROW BEGIN
+DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+
+DELETE FROM search_sources WHERE source_id = OLD.id;
+
+END;
+
+-- Foreign keys are not enforced, so projects are cleaned up by triggers. Chats of a deleted project
+-- are kept and moved out of it, the handler deletes them first if requested.
+
+CREATE TRIGGER remove_project_on_delete AFTER DELETE ON projects FOR EACH ROW BEGIN
+UPDATE chats SET project_id = '' WHERE project_id = OLD.id;
+
+DELETE FROM project_attachments WHERE project_id = OLD.id;
+
+END;
+
+CREATE TRIGGER remove_project_attachment_on_delete AFTER DELETE ON attachments FOR EACH ROW BEGIN
+DELETE FROM project_attachments WHERE attachment_id = OLD.id;
+
+END;
+
 -- Trigger to automatically create user_profile when user is added
 CREATE TRIGGER IF NOT EXISTS create_user_profile_trigger
     AFTER INSERT ON users
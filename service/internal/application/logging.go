@@ -2,9 +2,18 @@ package application
 
 import (
 	"net/http"
+	"net/url"
 	"time"
 )
 
+// redactQuery encodes the query without the values of parameters carrying credentials.
+func redactQuery(query url.Values) string {
+	if query.Has("access_token") {
+		query.Set("access_token", "REDACTED")
+	}
+	return query.Encode()
+}
+
 func (app *App) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -14,7 +23,7 @@ func (app *App) loggingMiddleware(next http.Handler) http.Handler {
 			"path", r.URL.Path,
 			"remote_addr", r.RemoteAddr,
 			"user_agent", r.UserAgent(),
-			"query", r.URL.RawQuery,
+			"query", redactQuery(r.URL.Query()),
 		)
 
 		next.ServeHTTP(w, r)
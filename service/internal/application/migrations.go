@@ -0,0 +1,378 @@
+package application
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade databases created from an older init.sql, in order. A database's
+// user_version is the number of migrations applied to it. init.sql always holds the full
+// schema, so new databases start at the latest version without running them.
+//
+// Databases created before versioning have user_version 0 even if their init.sql already had
+// some of the changes, so migrations only add missing columns and must be safe to run again.
+var migrations = []func(tx *sql.Tx) error{
+	migrateStreamMetrics,
+	migrateReasoningBlocks,
+	migrateBlocks,
+	migrateStreamIndex,
+	migrateAPITokens,
+	migrateBranches,
+	migrateSearch,
+	migrateImportSource,
+	migrateChatListing,
+	migrateProjects,
+}
+
+// migrate applies the migrations the database is missing, each in its own transaction.
+func migrate(db *sql.DB) error {
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to set schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+
+}
+
+// addColumn adds a column to the table unless it already exists and reports whether it was added.
+func addColumn(tx *sql.Tx, table, column, definition string) (bool, error) {
+
+	var exists bool
+	err := tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+	if err != nil || exists {
+		return false, err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err == nil, err
+
+}
+
+// addColumns adds the missing columns of a table and reports whether any was added.
+func addColumns(tx *sql.Tx, table string, columns [][2]string) (bool, error) {
+	var added bool
+	for _, c := range columns {
+		ok, err := addColumn(tx, table, c[0], c[1])
+		if err != nil {
+			return added, err
+		}
+		added = added || ok
+	}
+	return added, nil
+}
+
+func migrateStreamMetrics(tx *sql.Tx) error {
+
+	_, err := addColumns(tx, "messages", [][2]string{
+		{"ttft_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"ttfc_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"duration_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"output_tokens", "INTEGER NOT NULL DEFAULT 0"},
+		{"tokens_per_second", "REAL NOT NULL DEFAULT 0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_messages_model_created_at ON messages (model, created_at)")
+	return err
+
+}
+
+func migrateReasoningBlocks(tx *sql.Tx) error {
+	_, err := addColumn(tx, "messages", "reasoning_blocks", `TEXT NOT NULL DEFAULT ""`)
+	return err
+}
+
+func migrateBlocks(tx *sql.Tx) error {
+	_, err := addColumn(tx, "messages", "blocks", `TEXT NOT NULL DEFAULT ""`)
+	return err
+}
+
+func migrateStreamIndex(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_messages_stream_id ON messages (stream_id)")
+	return err
+}
+
+func migrateAPITokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS api_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0,
+			last_used_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
+	`)
+	return err
+}
+
+func migrateBranches(tx *sql.Tx) error {
+
+	added, err := addColumn(tx, "messages", "parent_id", `TEXT NOT NULL DEFAULT ""`)
+	if err != nil {
+		return err
+	}
+	if _, err := addColumn(tx, "chats", "active_message_id", `TEXT NOT NULL DEFAULT ""`); err != nil {
+		return err
+	}
+
+	// Existing chats are linear, each message follows the one created before it.
+	// Chats without an active message show their latest one.
+	if added {
+		_, err := tx.Exec(`
+			UPDATE messages SET parent_id = COALESCE((
+				SELECT p.id FROM messages p
+				WHERE p.chat_id = messages.chat_id AND (p.created_at, p.rowid) < (messages.created_at, messages.rowid)
+				ORDER BY p.created_at DESC, p.rowid DESC
+				LIMIT 1
+			), '')`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages (parent_id);
+
+		DROP TRIGGER IF EXISTS update_chat_on_message_create;
+
+		CREATE TRIGGER update_chat_on_message_create AFTER INSERT ON messages FOR EACH ROW BEGIN
+		UPDATE chats
+		SET
+			last_message_at = NEW.created_at,
+			status = NEW.status,
+			active_message_id = NEW.id
+		WHERE
+			id = NEW.chat_id;
+
+		END;
+	`)
+	return err
+
+}
+
+func migrateSearch(tx *sql.Tx) error {
+
+	if _, err := addColumn(tx, "attachments", "text", `TEXT NOT NULL DEFAULT ""`); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5 (
+			content,
+			kind UNINDEXED,
+			user_id UNINDEXED,
+			chat_id UNINDEXED,
+			message_id UNINDEXED,
+			source_id UNINDEXED,
+			tokenize = 'unicode61 remove_diacritics 2'
+		);
+
+		CREATE TABLE IF NOT EXISTS search_sources (
+			id INTEGER PRIMARY KEY,
+			source_id TEXT NOT NULL UNIQUE,
+			chat_id TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_search_sources_chat_id ON search_sources (chat_id);
+
+		DROP TRIGGER IF EXISTS index_chat_on_create;
+		DROP TRIGGER IF EXISTS index_chat_on_change;
+		DROP TRIGGER IF EXISTS index_chat_on_delete;
+		DROP TRIGGER IF EXISTS index_message_on_create;
+		DROP TRIGGER IF EXISTS index_message_on_change;
+		DROP TRIGGER IF EXISTS index_message_on_delete;
+		DROP TRIGGER IF EXISTS index_attachment_on_create;
+		DROP TRIGGER IF EXISTS index_attachment_on_change;
+		DROP TRIGGER IF EXISTS index_attachment_on_delete;
+
+		CREATE TRIGGER index_chat_on_create AFTER INSERT ON chats FOR EACH ROW BEGIN
+		INSERT INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.id);
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT id, NEW.title, 'chat', NEW.user_id, NEW.id, '', NEW.id
+		FROM search_sources WHERE source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_chat_on_change AFTER
+		UPDATE OF title ON chats FOR EACH ROW WHEN OLD.title != NEW.title BEGIN
+		DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT id, NEW.title, 'chat', NEW.user_id, NEW.id, '', NEW.id
+		FROM search_sources WHERE source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_chat_on_delete AFTER DELETE ON chats FOR EACH ROW BEGIN
+		DELETE FROM search_index WHERE rowid IN (SELECT id FROM search_sources WHERE chat_id = OLD.id);
+		DELETE FROM search_sources WHERE chat_id = OLD.id;
+		END;
+
+		CREATE TRIGGER index_message_on_create AFTER INSERT ON messages FOR EACH ROW WHEN NEW.status NOT IN ('queued', 'streaming') BEGIN
+		INSERT INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.chat_id);
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT id, NEW.content, 'message', NEW.user_id, NEW.chat_id, NEW.id, NEW.id
+		FROM search_sources WHERE source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_message_on_change AFTER
+		UPDATE OF content, status ON messages FOR EACH ROW WHEN NEW.status NOT IN ('queued', 'streaming') BEGIN
+		DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+		INSERT OR IGNORE INTO search_sources (source_id, chat_id) VALUES (NEW.id, NEW.chat_id);
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT id, NEW.content, 'message', NEW.user_id, NEW.chat_id, NEW.id, NEW.id
+		FROM search_sources WHERE source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_message_on_delete AFTER DELETE ON messages FOR EACH ROW BEGIN
+		DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+		DELETE FROM search_sources WHERE source_id = OLD.id;
+		END;
+
+		CREATE TRIGGER index_attachment_on_create AFTER INSERT ON attachments FOR EACH ROW BEGIN
+		INSERT INTO search_sources (source_id, chat_id)
+		SELECT NEW.id, m.chat_id FROM messages m WHERE m.id = NEW.message_id;
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT s.id, NEW.name || char(10) || NEW.text, 'attachment', NEW.user_id, s.chat_id, NEW.message_id, NEW.id
+		FROM search_sources s WHERE s.source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_attachment_on_change AFTER
+		UPDATE OF message_id ON attachments FOR EACH ROW BEGIN
+		DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+		DELETE FROM search_sources WHERE source_id = OLD.id;
+		INSERT INTO search_sources (source_id, chat_id)
+		SELECT NEW.id, m.chat_id FROM messages m WHERE m.id = NEW.message_id;
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT s.id, NEW.name || char(10) || NEW.text, 'attachment', NEW.user_id, s.chat_id, NEW.message_id, NEW.id
+		FROM search_sources s WHERE s.source_id = NEW.id;
+		END;
+
+		CREATE TRIGGER index_attachment_on_delete AFTER DELETE ON attachments FOR EACH ROW BEGIN
+		DELETE FROM search_index WHERE rowid = (SELECT id FROM search_sources WHERE source_id = OLD.id);
+		DELETE FROM search_sources WHERE source_id = OLD.id;
+		END;
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Index what was stored before the triggers existed. The text of existing attachments
+	// was not kept, so they are found by name only.
+	_, err = tx.Exec(`
+		DELETE FROM search_index;
+		DELETE FROM search_sources;
+
+		INSERT INTO search_sources (source_id, chat_id)
+		SELECT id, id FROM chats;
+
+		INSERT INTO search_sources (source_id, chat_id)
+		SELECT id, chat_id FROM messages WHERE status NOT IN ('queued', 'streaming');
+
+		INSERT INTO search_sources (source_id, chat_id)
+		SELECT a.id, m.chat_id FROM attachments a JOIN messages m ON m.id = a.message_id;
+
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT s.id, c.title, 'chat', c.user_id, c.id, '', c.id
+		FROM search_sources s JOIN chats c ON c.id = s.source_id;
+
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT s.id, m.content, 'message', m.user_id, m.chat_id, m.id, m.id
+		FROM search_sources s JOIN messages m ON m.id = s.source_id;
+
+		INSERT INTO search_index (rowid, content, kind, user_id, chat_id, message_id, source_id)
+		SELECT s.id, a.name || char(10) || a.text, 'attachment', a.user_id, s.chat_id, a.message_id, a.id
+		FROM search_sources s JOIN attachments a ON a.id = s.source_id;
+	`)
+	return err
+
+}
+
+func migrateImportSource(tx *sql.Tx) error {
+
+	if _, err := addColumn(tx, "chats", "import_source", `TEXT NOT NULL DEFAULT ""`); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_chats_import_source ON chats (user_id, import_source) WHERE import_source != ''")
+	return err
+
+}
+
+func migrateChatListing(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_chats_user_id_last_message_at ON chats (user_id, last_message_at)")
+	return err
+}
+
+func migrateProjects(tx *sql.Tx) error {
+
+	if _, err := addColumn(tx, "chats", "project_id", `TEXT NOT NULL DEFAULT ""`); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS projects (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT "",
+			system_prompt TEXT NOT NULL DEFAULT "",
+			model TEXT NOT NULL DEFAULT "",
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		);
+
+		CREATE TABLE IF NOT EXISTS project_attachments (
+			project_id TEXT NOT NULL,
+			attachment_id TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (project_id, attachment_id),
+			FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+			FOREIGN KEY (attachment_id) REFERENCES attachments (id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_chats_project_id ON chats (project_id);
+		CREATE INDEX IF NOT EXISTS idx_projects_user_id ON projects (user_id);
+		CREATE INDEX IF NOT EXISTS idx_project_attachments_attachment_id ON project_attachments (attachment_id);
+
+		DROP TRIGGER IF EXISTS remove_project_on_delete;
+		DROP TRIGGER IF EXISTS remove_project_attachment_on_delete;
+
+		CREATE TRIGGER remove_project_on_delete AFTER DELETE ON projects FOR EACH ROW BEGIN
+		UPDATE chats SET project_id = '' WHERE project_id = OLD.id;
+		DELETE FROM project_attachments WHERE project_id = OLD.id;
+		END;
+
+		CREATE TRIGGER remove_project_attachment_on_delete AFTER DELETE ON attachments FOR EACH ROW BEGIN
+		DELETE FROM project_attachments WHERE attachment_id = OLD.id;
+		END;
+	`)
+	return err
+
+}
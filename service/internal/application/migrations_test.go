@@ -0,0 +1,194 @@
+package application
+
+import (
+	"database/sql"
+	_ "embed"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//go:embed testdata/baseline.sql
+var baselineSQL string
+
+// openTestDB creates a database from the given schema, skipping the test if it needs FTS5
+// and the tests were built without -tags sqlite_fts5.
+func openTestDB(t *testing.T, schema string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(schema); err != nil {
+		skipWithoutFTS5(t, err)
+		t.Fatal(err)
+	}
+	return db
+}
+
+func skipWithoutFTS5(t *testing.T, err error) {
+	t.Helper()
+	if strings.Contains(err.Error(), "fts5") {
+		t.Skip("database tests need -tags sqlite_fts5")
+	}
+}
+
+// schema lists the columns, indexes and triggers of a database.
+func schema(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+
+	rows, err := db.Query(`
+		SELECT m.type || ' ' || m.name || COALESCE(' ' || c.name || ' ' || c.type || ' ' || c."notnull" || ' ' || COALESCE(c.dflt_value, ''), '')
+		FROM sqlite_master m LEFT JOIN pragma_table_info(m.name) c ON m.type = 'table'
+		WHERE m.name NOT LIKE 'sqlite_%' AND m.name NOT LIKE 'search_index_%'
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var entries []string
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(entries)
+	return entries
+}
+
+func TestMigrate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"baseline", baselineSQL},
+		{"latest", initSQL}, // Databases created before versioning start at version 0 with any schema
+	}
+
+	want := schema(t, openTestDB(t, initSQL))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			db := openTestDB(t, tt.schema)
+			if err := migrate(db); err != nil {
+				skipWithoutFTS5(t, err)
+				t.Fatal(err)
+			}
+
+			var version int
+			if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+				t.Fatal(err)
+			}
+			if version != len(migrations) {
+				t.Errorf("got version %d, want %d", version, len(migrations))
+			}
+
+			got := schema(t, db)
+			for _, entry := range want {
+				if !slices.Contains(got, entry) {
+					t.Errorf("missing %s", entry)
+				}
+			}
+			for _, entry := range got {
+				if !slices.Contains(want, entry) {
+					t.Errorf("unexpected %s", entry)
+				}
+			}
+
+			// Running them again must not fail
+			if _, err := db.Exec("PRAGMA user_version = 0"); err != nil {
+				t.Fatal(err)
+			}
+			if err := migrate(db); err != nil {
+				t.Errorf("migrating again: %v", err)
+			}
+
+		})
+	}
+
+}
+
+func TestMigrateData(t *testing.T) {
+
+	db := openTestDB(t, baselineSQL)
+	_, err := db.Exec(`
+		INSERT INTO chats (id, user_id, title, model, is_pinned, status, created_at, updated_at, last_message_at, shared_at)
+		VALUES ('c', 'u', 'Travel plans', 'model', 0, 'done', 1, 1, 3, 0);
+
+		INSERT INTO messages (id, user_id, chat_id, stream_id, role, model, content, reasoning, status, created_at, updated_at)
+		VALUES ('m1', 'u', 'c', '', 'user', 'model', 'Where to go in spring?', '', 'done', 2, 2),
+			('m2', 'u', 'c', '', 'assistant', 'model', 'Kyoto is lovely', '', 'done', 3, 3),
+			('m3', 'u', 'c', '', 'assistant', 'model', 'Lisbon', '', 'streaming', 3, 3);
+
+		INSERT INTO attachments (id, user_id, message_id, name, type, src, created_at)
+		VALUES ('a', 'u', 'm1', 'itinerary.pdf', 'application/pdf', '', 2);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db); err != nil {
+		skipWithoutFTS5(t, err)
+		t.Fatal(err)
+	}
+
+	// Messages with the same time keep the order they were inserted in
+	tests := []struct {
+		message, parent string
+	}{
+		{"m1", ""},
+		{"m2", "m1"},
+		{"m3", "m2"},
+	}
+	for _, tt := range tests {
+		var parent string
+		if err := db.QueryRow("SELECT parent_id FROM messages WHERE id = ?", tt.message).Scan(&parent); err != nil {
+			t.Fatal(err)
+		}
+		if parent != tt.parent {
+			t.Errorf("%s: got parent %q, want %q", tt.message, parent, tt.parent)
+		}
+	}
+
+	searches := []struct {
+		query string
+		want  []string
+	}{
+		{"travel", []string{"c"}},
+		{"kyoto", []string{"m2"}},
+		{"lisbon", nil}, // Still streaming
+		{"itinerary", []string{"a"}},
+	}
+	for _, tt := range searches {
+		rows, err := db.Query("SELECT source_id FROM search_index WHERE search_index MATCH ?", tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			got = append(got, id)
+		}
+		rows.Close()
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: found %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+}
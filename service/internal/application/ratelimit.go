@@ -0,0 +1,171 @@
+package application
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// rateLimiter keeps a token bucket per rule and client.
+type rateLimiter struct {
+	cfg RateLimitConfig
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // When the bucket will be full again, used to drop idle buckets
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:       cfg,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// rule returns the rule for the request, the route rule with the longest matching path wins.
+func (l *rateLimiter) rule(r *http.Request) RateLimitRule {
+	rule := l.cfg.Default
+	length := -1
+	for _, route := range l.cfg.Routes {
+		if !strings.HasPrefix(r.URL.Path, route.Path) || len(route.Path) <= length {
+			continue
+		}
+		if route.Method != "" && !strings.EqualFold(route.Method, r.Method) {
+			continue
+		}
+		rule, length = route, len(route.Path)
+	}
+	return rule
+}
+
+// client identifies the client by its user ID or, if unauthenticated, by its IP address.
+func (l *rateLimiter) client(r *http.Request) string {
+	if userID, ok := r.Context().Value("user_id").(uuid.UUID); ok {
+		return "user:" + userID.String()
+	}
+	if l.cfg.TrustProxy {
+		if ip := forwardedFor(r.Header.Values("X-Forwarded-For"), l.cfg.ProxyHops); ip != "" {
+			return "ip:" + ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// forwardedFor returns the client address appended by the outermost of the trusted proxies.
+// Entries before it are set by the client and cannot be trusted.
+func forwardedFor(headers []string, hops int) string {
+	var entries []string
+	for _, header := range headers {
+		for _, entry := range strings.Split(header, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	// A shorter chain than configured means the first proxy was reached directly
+	return entries[max(len(entries)-max(hops, 1), 0)]
+}
+
+// take takes a token from the bucket of the key. It returns whether the request is allowed,
+// the remaining tokens and the time until the next token or the full bucket is available.
+func (l *rateLimiter) take(key string, rule RateLimitRule, now time.Time) (bool, int, time.Duration, time.Duration) {
+
+	burst := rule.Burst
+	if burst <= 0 {
+		burst = rule.Limit
+	}
+	rate := float64(rule.Limit) / rule.Period.Seconds() // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill the bucket for the time passed since the last request
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	untilNext := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	untilFull := time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(untilFull)
+
+	return allowed, int(b.tokens), max(untilNext, 0), untilFull
+
+}
+
+// sweep drops buckets that are full again, they are recreated on demand.
+// The caller must hold the lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.After(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (app *App) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		rule := app.limiter.rule(r)
+		if rule.Limit <= 0 || rule.Period <= 0 || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := app.limiter.client(r)
+		key := rule.Method + " " + rule.Path + " " + client
+		allowed, remaining, untilNext, untilFull := app.limiter.take(key, rule, time.Now())
+
+		// Standard rate limit headers, see draft-ietf-httpapi-ratelimit-headers
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Limit, int(rule.Period.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(untilFull.Seconds()))))
+
+		if !allowed {
+			app.Logger.Debug("Rate limit exceeded", "client", client, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(untilNext.Seconds()))))
+			http.Error(w, "rate_limit_exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
@@ -0,0 +1,109 @@
+package application
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+
+	rule := RateLimitRule{Limit: 60, Period: time.Minute, Burst: 3} // One token per second
+
+	tests := []struct {
+		name      string
+		requests  []time.Duration // Time of each request since the first
+		allowed   []bool
+		remaining int // Tokens after the last request
+	}{
+		{"burst", []time.Duration{0, 0, 0}, []bool{true, true, true}, 0},
+		{"exceeding burst", []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}, 0},
+		{"refill", []time.Duration{0, 0, 0, time.Second}, []bool{true, true, true, true}, 0},
+		{"partial refill", []time.Duration{0, 0, 0, 500 * time.Millisecond}, []bool{true, true, true, false}, 0},
+		{"refill is capped at burst", []time.Duration{0, time.Hour}, []bool{true, true}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			l := newRateLimiter(RateLimitConfig{})
+			start := time.Now()
+			var remaining int
+			for i, d := range tt.requests {
+				var allowed bool
+				allowed, remaining, _, _ = l.take("key", rule, start.Add(d))
+				if allowed != tt.allowed[i] {
+					t.Errorf("request %d: got allowed %v, want %v", i, allowed, tt.allowed[i])
+				}
+			}
+			if remaining != tt.remaining {
+				t.Errorf("got %d remaining tokens, want %d", remaining, tt.remaining)
+			}
+
+		})
+	}
+
+}
+
+func TestRule(t *testing.T) {
+
+	l := newRateLimiter(RateLimitConfig{
+		Default: RateLimitRule{Limit: 1},
+		Routes: []RateLimitRule{
+			{Path: "/v1/", Limit: 2},
+			{Path: "/v1/auth/login/", Method: "POST", Limit: 3},
+		},
+	})
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/health/", 1},
+		{"GET", "/v1/chats/", 2},
+		{"POST", "/v1/auth/login/", 3},
+		{"GET", "/v1/auth/login/", 2},
+	}
+
+	for _, tt := range tests {
+		if got := l.rule(httptest.NewRequest(tt.method, tt.path, nil)).Limit; got != tt.want {
+			t.Errorf("%s %s: got limit %d, want %d", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+}
+
+func TestClient(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		trust     bool
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{"remote address", false, 0, nil, "ip:192.0.2.1"},
+		{"untrusted header", false, 0, []string{"203.0.113.9"}, "ip:192.0.2.1"},
+		{"single proxy", true, 0, []string{"203.0.113.9"}, "ip:203.0.113.9"},
+		{"spoofed entry", true, 1, []string{"198.51.100.7, 203.0.113.9"}, "ip:203.0.113.9"},
+		{"two proxies", true, 2, []string{"198.51.100.7, 203.0.113.9, 10.0.0.2"}, "ip:203.0.113.9"},
+		{"shorter chain", true, 3, []string{"203.0.113.9, 10.0.0.2"}, "ip:203.0.113.9"},
+		{"repeated headers", true, 1, []string{"198.51.100.7", "203.0.113.9"}, "ip:203.0.113.9"},
+		{"empty header", true, 1, []string{" "}, "ip:192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(RateLimitConfig{TrustProxy: tt.trust, ProxyHops: tt.hops})
+			r := httptest.NewRequest("POST", "/v1/auth/login/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := l.client(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,136 @@
+-- Schema of the first release, before migrations were versioned. Used to test the migrations.
+-- Auth Data
+CREATE TABLE
+    IF NOT EXISTS users (
+        id TEXT PRIMARY KEY,
+        username TEXT UNIQUE NOT NULL,
+        email TEXT UNIQUE NOT NULL,
+        password_hash TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL,
+        is_verified INTEGER NOT NULL,
+        mfa_active INTEGER NOT NULL
+    );
+
+CREATE TABLE
+    IF NOT EXISTS sessions (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        token TEXT UNIQUE NOT NULL,
+        issued_at INTEGER NOT NULL,
+        renewed_at INTEGER NOT NULL,
+        time_to_live INTEGER NOT NULL,
+        is_verified INTEGER NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    );
+
+-- Chat Data
+CREATE TABLE
+    IF NOT EXISTS user_profile (
+        user_id TEXT PRIMARY KEY,
+        -- rate_limit
+        limit_standard INTEGER NOT NULL DEFAULT 1500,
+        limit_premium INTEGER NOT NULL DEFAULT 100,
+        usage_standard INTEGER NOT NULL DEFAULT 0,
+        usage_premium INTEGER NOT NULL DEFAULT 0,
+        -- customization
+        custom_user_name TEXT NOT NULL DEFAULT "",
+        custom_user_profession TEXT NOT NULL DEFAULT "",
+        custom_assistant_trait TEXT NOT NULL DEFAULT "",
+        custom_context TEXT NOT NULL DEFAULT "",
+        -- keys
+        anthropic_api_key TEXT NOT NULL DEFAULT "",
+        openai_api_key TEXT NOT NULL DEFAULT "",
+        gemini_api_key TEXT NOT NULL DEFAULT "",
+        ollama_base_url TEXT NOT NULL DEFAULT ""
+    );
+
+CREATE TABLE
+    IF NOT EXISTS chats (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        title TEXT NOT NULL,
+        model TEXT NOT NULL,
+        is_pinned INTEGER NOT NULL,
+        status TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL,
+        last_message_at INTEGER NOT NULL,
+        shared_at INTEGER NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+    );
+
+CREATE TABLE
+    IF NOT EXISTS messages (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        chat_id TEXT NOT NULL,
+        stream_id TEXT NOT NULL,
+        role TEXT NOT NULL,
+        model TEXT NOT NULL,
+        content TEXT NOT NULL,
+        reasoning TEXT NOT NULL,
+        status TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        updated_at INTEGER NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+        FOREIGN KEY (chat_id) REFERENCES chats (id) ON DELETE CASCADE
+    );
+
+CREATE TABLE
+    IF NOT EXISTS attachments (
+        id TEXT PRIMARY KEY,
+        user_id TEXT NOT NULL,
+        message_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        type TEXT NOT NULL,
+        src TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+        FOREIGN KEY (message_id) REFERENCES messages (id) ON DELETE CASCADE
+    );
+
+-- Create indexes for more efficient querying
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+CREATE INDEX IF NOT EXISTS idx_chats_user_id ON chats (user_id);
+
+CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages (user_id);
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id ON messages (chat_id);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id_created_at ON messages (chat_id, created_at);
+
+-- Create triggers for automatic updates
+
+CREATE TRIGGER update_chat_on_message_create AFTER INSERT ON messages FOR EACH ROW BEGIN
+UPDATE chats
+SET
+    last_message_at = NEW.created_at,
+    status = NEW.status
+WHERE
+    id = NEW.chat_id;
+
+END;
+
+CREATE TRIGGER update_chat_on_message_change AFTER
+UPDATE OF status ON messages FOR EACH ROW WHEN OLD.status != NEW.status BEGIN
+UPDATE chats
+SET
+    status = NEW.status
+WHERE
+    id = NEW.chat_id;
+
+END;
+
+-- Trigger to automatically create user_profile when user is added
+CREATE TRIGGER IF NOT EXISTS create_user_profile_trigger
+    AFTER INSERT ON users
+    FOR EACH ROW
+BEGIN
+    INSERT INTO user_profile (user_id)
+    VALUES (NEW.id);
+END;
+
@@ -1,5 +1,10 @@
 package chat
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Request types
 type Request struct {
 	Model               string     `json:"model"`
@@ -10,19 +15,51 @@ type Request struct {
 	ReasoningEffort     int32      `json:"reasoning_effort"`
 	Stop                any        `json:"stop,omitempty"`
 	Messages            []*Message `json:"messages"`
-	System              string     `json:"system"` // System prompt for the chat session
+	System              string     `json:"system"`         // System prompt for the chat session
+	CodeExecution       bool       `json:"code_execution"` // Allow the model to generate and run code
 }
 
 type Message struct {
-	Role        string        `json:"role"`
-	Content     string        `json:"content"`
-	Reasoning   string        `json:"reasoning"`
-	Attachments []*Attachment `json:"attachments"` // Image attachments as byte slices
+	Role            string           `json:"role"`
+	Content         string           `json:"content"`
+	Reasoning       string           `json:"reasoning"`
+	ReasoningBlocks []ReasoningBlock `json:"reasoning_blocks,omitempty"` // Provider specific reasoning blocks, replayed by providers that require them
+	Attachments     []*Attachment    `json:"attachments"`                // Image attachments as byte slices
+}
+
+// ReasoningBlock is a complete reasoning block as returned by the provider,
+// e.g. an Anthropic thinking block including its signature.
+type ReasoningBlock struct {
+	Type      string `json:"type"`                // "thinking" or "redacted_thinking"
+	Thinking  string `json:"thinking,omitempty"`  // Reasoning text of a thinking block
+	Signature string `json:"signature,omitempty"` // Signature verifying the thinking block
+	Data      string `json:"data,omitempty"`      // Encrypted data of a redacted thinking block
 }
 
 type Attachment struct {
-	MimeType string `json:"mime_type"` // MIME type of attachment
-	Data     []byte `json:"data"`
+	Name     string `json:"name"`           // File name of the attachment
+	MimeType string `json:"mime_type"`      // MIME type of attachment
+	Data     []byte `json:"data"`           // Raw data for binary attachments (images, PDFs)
+	Text     string `json:"text,omitempty"` // Extracted text for text based attachments
+}
+
+// IsText reports whether the attachment is text based and should be sent as text instead of raw data.
+func IsText(mimeType string) bool {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	switch mimeType {
+	case "application/json", "application/xml", "application/yaml", "application/x-yaml",
+		"application/javascript", "application/x-sh", "application/sql":
+		return true
+	}
+	return false
+}
+
+// Document formats the extracted text of the attachment for the model.
+func (a *Attachment) Document() string {
+	return fmt.Sprintf("<attachment name=%q type=%q>\n%s\n</attachment>", a.Name, a.MimeType, a.Text)
 }
 
 type Options map[string]string
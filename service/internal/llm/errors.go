@@ -7,4 +7,5 @@ import (
 var (
 	ErrUnsupportedProvider = errors.New("unsupported provider")
 	ErrUnsupportedModel    = errors.New("unsupported model")
+	ErrUnknownInterceptor  = errors.New("unknown interceptor")
 )
@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"strings"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+)
+
+// InterceptorFactory creates a new interceptor instance for every stream.
+type InterceptorFactory func() stream.Interceptor
+
+// codeFenceCloser closes markdown code fences that are still open when the
+// stream ends, e.g. because the model ran into the token limit.
+type codeFenceCloser struct {
+	line string // Content of the current, incomplete line
+	open bool   // Whether a code fence is currently open
+}
+
+func NewCodeFenceCloser() stream.Interceptor {
+	return &codeFenceCloser{}
+}
+
+func (c *codeFenceCloser) Intercept(chunk stream.Chunk) ([]stream.Chunk, error) {
+	lines := strings.Split(c.line+chunk.Content, "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if isCodeFence(line) {
+			c.open = !c.open
+		}
+	}
+	c.line = lines[len(lines)-1]
+	return []stream.Chunk{chunk}, nil
+}
+
+func (c *codeFenceCloser) Flush() ([]stream.Chunk, error) {
+	if isCodeFence(c.line) {
+		c.open = !c.open
+	}
+	if !c.open {
+		return nil, nil
+	}
+	if c.line == "" {
+		return []stream.Chunk{{Content: "```\n"}}, nil
+	}
+	return []stream.Chunk{{Content: "\n```\n"}}, nil
+}
+
+func isCodeFence(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "```")
+}
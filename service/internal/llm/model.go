@@ -36,6 +36,7 @@ type ModelFeatures struct {
 	HasReasoning       bool `json:"has_reasoning,omitempty" mapstructure:"has_reasoning"`
 	HasEffortControl   bool `json:"has_effort_control,omitempty" mapstructure:"has_effort_control"`
 	HasImageGeneration bool `json:"has_image_generation,omitempty" mapstructure:"has_image_generation"`
+	HasCodeExecution   bool `json:"has_code_execution,omitempty" mapstructure:"has_code_execution"`
 }
 
 type ModelFlags struct {
@@ -56,4 +57,6 @@ type Model struct {
 	Provider    ModelProvider `json:"provider" mapstructure:"provider"`
 	Features    ModelFeatures `json:"features" mapstructure:"features"`
 	Flags       ModelFlags    `json:"flags" mapstructure:"flags"`
+
+	Interceptors []string `json:"-" mapstructure:"interceptors"` // Names of the stream interceptors applied to completions
 }
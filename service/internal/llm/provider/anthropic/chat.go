@@ -12,7 +12,7 @@ import (
 	"github.com/anthropics/anthropic-sdk-go/option"
 )
 
-func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error) {
+func StreamCompletion(s *stream.Stream, req chat.Request, opt chat.Options) error {
 
 	// TODO: handle invalid user provided api key or validate on input
 	env := os.Getenv("ANTHROPIC_API_KEY")
@@ -21,11 +21,9 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 	}
 
 	if env == "" {
-		return nil, fmt.Errorf("ANTHROPIC_API_KEY is not set")
+		return fmt.Errorf("ANTHROPIC_API_KEY is not set")
 	}
 
-	s := stream.New()
-
 	// TODO: replace with a global application client pool
 	httpClient := &http.Client{
 		Timeout: 0, // no global timeout; per-request ctx handles it
@@ -65,11 +63,23 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 	}
 
 	for _, message := range req.Messages {
-		blocks := []anthropic.ContentBlockParamUnion{
-			anthropic.NewTextBlock(message.Content),
+		blocks := []anthropic.ContentBlockParamUnion{}
+		// Replay thinking blocks with their signatures, which is required for multi-turn extended thinking
+		if message.Role == "assistant" && req.ReasoningEffort > 0 {
+			for _, block := range message.ReasoningBlocks {
+				switch block.Type {
+				case "thinking":
+					blocks = append(blocks, anthropic.NewThinkingBlock(block.Signature, block.Thinking))
+				case "redacted_thinking":
+					blocks = append(blocks, anthropic.NewRedactedThinkingBlock(block.Data))
+				}
+			}
 		}
+		blocks = append(blocks, anthropic.NewTextBlock(message.Content))
 		for _, attachment := range message.Attachments {
-			if attachment.MimeType == "image/png" || attachment.MimeType == "image/jpeg" {
+			if attachment.Text != "" {
+				blocks = append(blocks, anthropic.NewTextBlock(attachment.Document()))
+			} else if attachment.MimeType == "image/png" || attachment.MimeType == "image/jpeg" {
 				blocks = append(blocks, anthropic.NewImageBlockBase64(attachment.MimeType, base64.StdEncoding.EncodeToString(attachment.Data)))
 			} else if attachment.MimeType == "application/pdf" {
 				blocks = append(blocks, anthropic.NewDocumentBlock(anthropic.Base64PDFSourceParam{
@@ -109,6 +119,31 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 					s.Publish(stream.Chunk{
 						Reasoning: deltaVariant.Thinking,
 					})
+				case anthropic.CitationsDelta:
+					citation := deltaVariant.Citation
+					title := citation.Title
+					if title == "" {
+						title = citation.DocumentTitle
+					}
+					s.Publish(stream.Chunk{
+						Citations: []stream.Citation{{Title: title, URL: citation.URL, CitedText: citation.CitedText}},
+					})
+				}
+			case anthropic.ContentBlockStopEvent:
+				// Publish completed thinking blocks, the signature is only complete at the end of the block
+				if eventVariant.Index >= int64(len(message.Content)) {
+					continue
+				}
+				block := message.Content[eventVariant.Index]
+				switch block.Type {
+				case "thinking":
+					s.Publish(stream.Chunk{
+						ReasoningBlocks: []chat.ReasoningBlock{{Type: block.Type, Thinking: block.Thinking, Signature: block.Signature}},
+					})
+				case "redacted_thinking":
+					s.Publish(stream.Chunk{
+						ReasoningBlocks: []chat.ReasoningBlock{{Type: block.Type, Data: block.Data}},
+					})
 				}
 			}
 		}
@@ -116,6 +151,7 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 		if err := completion.Err(); err != nil {
 			s.Fail(fmt.Errorf("anthropic: %w", err))
 		} else {
+			s.SetOutputTokens(int(message.Usage.OutputTokens))
 			fmt.Println("Anthropic stream completed!") // TODO: Remove this debug statement
 			s.Close()
 		}
@@ -124,6 +160,6 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 
 	fmt.Println("Anthropic stream started!") // TODO: Remove this debug statement
 
-	return s, nil
+	return nil
 
 }
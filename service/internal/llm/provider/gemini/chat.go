@@ -11,7 +11,7 @@ import (
 	"google.golang.org/genai"
 )
 
-func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error) {
+func StreamCompletion(s *stream.Stream, req chat.Request, opt chat.Options) error {
 
 	// TODO: handle invalid user provided api key or validate on input
 	env := os.Getenv("GEMINI_API_KEY")
@@ -20,11 +20,9 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 	}
 
 	if env == "" {
-		return nil, fmt.Errorf("GEMINI_API_KEY is not set")
+		return fmt.Errorf("GEMINI_API_KEY is not set")
 	}
 
-	s := stream.New()
-
 	config := genai.GenerateContentConfig{}
 
 	// TODO: replace with a proper context
@@ -33,7 +31,7 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 		Backend: genai.BackendGeminiAPI,
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Add temperature to the ollama request options
@@ -50,6 +48,13 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 		}
 	}
 
+	// Let the model generate and run code if enabled for the model
+	if req.CodeExecution {
+		config.Tools = append(config.Tools, &genai.Tool{
+			CodeExecution: &genai.ToolCodeExecution{},
+		})
+	}
+
 	// Add system message to the ollama request messages
 	if req.System != "" {
 		config.SystemInstruction = &genai.Content{
@@ -70,6 +75,10 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 			},
 		}
 		for _, attachment := range message.Attachments {
+			if attachment.Text != "" {
+				msg.Parts = append(msg.Parts, &genai.Part{Text: attachment.Document()})
+				continue
+			}
 			msg.Parts = append(msg.Parts, &genai.Part{
 				InlineData: &genai.Blob{
 					Data:     attachment.Data,
@@ -85,6 +94,10 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 	}
 
 	for _, attachment := range req.Messages[len(req.Messages)-1].Attachments {
+		if attachment.Text != "" {
+			parts = append(parts, genai.Part{Text: attachment.Document()})
+			continue
+		}
 		parts = append(parts, genai.Part{
 			InlineData: &genai.Blob{
 				Data:     attachment.Data,
@@ -97,7 +110,7 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 
 	chat, err := client.Chats.Create(s.Context(), req.Model, &config, messages)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	go func() {
@@ -109,12 +122,13 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 				return
 			}
 
-			content, thoughts := getChunk(result)
+			if result.UsageMetadata != nil {
+				s.SetOutputTokens(int(result.UsageMetadata.CandidatesTokenCount + result.UsageMetadata.ThoughtsTokenCount))
+			}
 
-			s.Publish(stream.Chunk{
-				Content:   content,
-				Reasoning: thoughts,
-			})
+			for _, chunk := range getChunks(result) {
+				s.Publish(chunk)
+			}
 
 		}
 
@@ -125,60 +139,73 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 
 	fmt.Println("Gemini stream started!") // TODO: Remove this debug statement
 
-	return s, nil
+	return nil
 
 }
 
-func getChunk(r *genai.GenerateContentResponse) (string, string) {
+// getChunks converts the parts of the first candidate to stream chunks,
+// one per part so that blocks keep their position within the content.
+func getChunks(r *genai.GenerateContentResponse) []stream.Chunk {
 
 	if r == nil {
-		return "", ""
+		return nil
 	}
 
 	if len(r.Candidates) == 0 || r.Candidates[0].Content == nil || len(r.Candidates[0].Content.Parts) == 0 {
-		return "", ""
+		return nil
 	}
 
 	if len(r.Candidates) > 1 {
-		log.Println("Warning: there are multiple candidates in the response, returning text from the first one.")
+		log.Println("Warning: there are multiple candidates in the response, returning parts from the first one.")
 	}
 
-	var texts []string
-	var thoughts []string
-	var notTextParts []string
+	var chunks []stream.Chunk
+	var unsupportedParts []string
 	for _, part := range r.Candidates[0].Content.Parts {
-		if part.Text != "" {
-			if part.Thought {
-				thoughts = append(texts, part.Text)
-			} else {
-				texts = append(texts, part.Text)
-			}
-		} else {
-			if part.InlineData != nil {
-				notTextParts = append(notTextParts, "InlineData")
-			}
-			if part.CodeExecutionResult != nil {
-				notTextParts = append(notTextParts, "CodeExecutionResult")
-			}
-			if part.ExecutableCode != nil {
-				notTextParts = append(notTextParts, "ExecutableCode")
-			}
-			if part.FileData != nil {
-				notTextParts = append(notTextParts, "FileData")
-			}
-			if part.FunctionCall != nil {
-				notTextParts = append(notTextParts, "FunctionCall")
-			}
-			if part.FunctionResponse != nil {
-				notTextParts = append(notTextParts, "FunctionResponse")
-			}
+		switch {
+		case part.Text != "" && part.Thought:
+			chunks = append(chunks, stream.Chunk{Reasoning: part.Text})
+		case part.Text != "":
+			chunks = append(chunks, stream.Chunk{Content: part.Text})
+		case part.InlineData != nil:
+			chunks = append(chunks, stream.Chunk{Blocks: []stream.Block{{
+				Type:     "image",
+				MimeType: part.InlineData.MIMEType,
+				Data:     part.InlineData.Data,
+			}}})
+		case part.FileData != nil:
+			chunks = append(chunks, stream.Chunk{Blocks: []stream.Block{{
+				Type:     "file",
+				MimeType: part.FileData.MIMEType,
+				Src:      part.FileData.FileURI,
+			}}})
+		case part.ExecutableCode != nil:
+			chunks = append(chunks, stream.Chunk{Blocks: []stream.Block{{
+				Type:     "code",
+				Language: strings.ToLower(string(part.ExecutableCode.Language)),
+				Code:     part.ExecutableCode.Code,
+			}}})
+		case part.CodeExecutionResult != nil:
+			chunks = append(chunks, stream.Chunk{Blocks: []stream.Block{{
+				Type:    "code_result",
+				Outcome: strings.ToLower(strings.TrimPrefix(string(part.CodeExecutionResult.Outcome), "OUTCOME_")),
+				Output:  part.CodeExecutionResult.Output,
+			}}})
+		case part.FunctionCall != nil:
+			chunks = append(chunks, stream.Chunk{ToolCalls: []stream.ToolCall{{
+				ID:        part.FunctionCall.ID,
+				Name:      part.FunctionCall.Name,
+				Arguments: part.FunctionCall.Args,
+			}}})
+		case part.FunctionResponse != nil:
+			unsupportedParts = append(unsupportedParts, "FunctionResponse")
 		}
 	}
 
-	if len(notTextParts) > 0 {
-		log.Printf("Warning: there are non-text parts %s in the response, returning concatenation of all text parts. Please refer to the non text parts for a full response from model.\n", strings.Join(notTextParts, ", "))
+	if len(unsupportedParts) > 0 {
+		log.Printf("Warning: there are unsupported parts %s in the response, they are not part of the stream.\n", strings.Join(unsupportedParts, ", "))
 	}
 
-	return strings.Join(texts, ""), strings.Join(thoughts, "")
+	return chunks
 
 }
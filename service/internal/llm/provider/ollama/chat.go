@@ -11,7 +11,8 @@ import (
 	"github.com/ollama/ollama/api"
 )
 
-func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error) {
+// BaseURL returns the URL of the Ollama server, the user's own or the configured one.
+func BaseURL(opt chat.Options) (*url.URL, error) {
 
 	// TODO: handle invalid user provided api key or validate on input
 	env := os.Getenv("OLLAMA_BASE_URL")
@@ -28,6 +29,17 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 		return nil, fmt.Errorf("failed to parse OLLAMA_BASE_URL: %w", err)
 	}
 
+	return baseUrl, nil
+
+}
+
+func StreamCompletion(s *stream.Stream, req chat.Request, opt chat.Options) error {
+
+	baseUrl, err := BaseURL(opt)
+	if err != nil {
+		return err
+	}
+
 	client := api.NewClient(baseUrl, &http.Client{}) // TODO: replace with a shared client pool
 
 	request := &api.ChatRequest{
@@ -56,20 +68,23 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 
 	// Convert universal format to ollama message format
 	for _, message := range req.Messages {
+		content := message.Content
 		images := make([]api.ImageData, 0)
 		for _, attachment := range message.Attachments {
+			if attachment.Text != "" {
+				content += "\n\n" + attachment.Document()
+				continue
+			}
 			images = append(images, attachment.Data)
 		}
 		request.Messages = append(request.Messages, api.Message{
 			Role:     message.Role,
-			Content:  message.Content,
+			Content:  content,
 			Thinking: message.Reasoning, // TODO: Maybe remove to save ressources
 			Images:   images,
 		})
 	}
 
-	s := stream.New()
-
 	respFunc := func(resp api.ChatResponse) error {
 
 		// if the stream has been canceled, abort the Chat loop
@@ -77,6 +92,7 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 			return err
 		}
 		if resp.Done {
+			s.SetOutputTokens(resp.EvalCount)
 			fmt.Println("Ollama stream completed!")
 			s.Close()
 		} else {
@@ -100,6 +116,6 @@ func StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error
 
 	fmt.Println("Ollama stream started!") // TODO: Remove this debug statement
 
-	return s, nil
+	return nil
 
 }
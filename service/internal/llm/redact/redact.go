@@ -0,0 +1,198 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Config defines which secrets and personal data are redacted from outgoing prompts.
+type Config struct {
+	Enabled    bool            `mapstructure:"enabled" yaml:"enabled"`       // Enables the redaction of outgoing prompts
+	Reversible bool            `mapstructure:"reversible" yaml:"reversible"` // Restore the original values in the streamed response
+	Rules      []string        `mapstructure:"rules" yaml:"rules"`           // Built-in rules ("api_keys", "emails", "credit_cards"), all if empty
+	Patterns   []PatternConfig `mapstructure:"patterns" yaml:"patterns"`     // Additional custom patterns
+}
+
+type PatternConfig struct {
+	Name    string `mapstructure:"name" yaml:"name"`       // Used in the placeholder, e.g. "EMPLOYEE_ID"
+	Pattern string `mapstructure:"pattern" yaml:"pattern"` // Regular expression matching the value to redact
+}
+
+type rule struct {
+	name    string
+	pattern *regexp.Regexp
+	valid   func(match string) bool // Optional check to filter out false positives
+}
+
+var builtinRules = map[string][]rule{
+	"api_keys": {
+		{name: "API_KEY", pattern: regexp.MustCompile(`\bsk-(?:ant-|proj-)?[A-Za-z0-9_-]{20,}`)},
+		{name: "API_KEY", pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+		{name: "API_KEY", pattern: regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr|github_pat)_[A-Za-z0-9_]{20,}\b`)},
+		{name: "API_KEY", pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+		{name: "API_KEY", pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`)},
+	},
+	"emails": {
+		{name: "EMAIL", pattern: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`)},
+	},
+	"credit_cards": {
+		{name: "CARD_NUMBER", pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	},
+}
+
+// Redactor replaces secrets and personal data in prompts with placeholders.
+type Redactor struct {
+	rules      []rule
+	reversible bool
+}
+
+// New creates a Redactor from the config. It returns nil if redaction is disabled.
+func New(cfg Config) (*Redactor, error) {
+
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	names := cfg.Rules
+	if len(names) == 0 {
+		names = []string{"api_keys", "emails", "credit_cards"}
+	}
+
+	r := &Redactor{reversible: cfg.Reversible}
+	for _, name := range names {
+		rules, ok := builtinRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction rule %q", name)
+		}
+		r.rules = append(r.rules, rules...)
+	}
+
+	for _, p := range cfg.Patterns {
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", p.Name, err)
+		}
+		name := strings.ToUpper(nonWordPattern.ReplaceAllString(p.Name, "_"))
+		if name == "" {
+			name = "CUSTOM"
+		}
+		r.rules = append(r.rules, rule{
+			name:    name,
+			pattern: pattern,
+		})
+	}
+
+	return r, nil
+
+}
+
+// Reversible reports whether the placeholders should be restored in the response.
+func (r *Redactor) Reversible() bool {
+	return r.reversible
+}
+
+// NewSession creates a session that redacts the texts of a single request.
+// Equal values are replaced with the same placeholder within a session.
+func (r *Redactor) NewSession() *Session {
+	return &Session{
+		redactor:     r,
+		placeholders: make(map[string]string),
+		values:       make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+// Session holds the placeholders created while redacting one request.
+type Session struct {
+	redactor     *Redactor
+	placeholders map[string]string // original value -> placeholder
+	values       map[string]string // placeholder -> original value
+	counts       map[string]int    // rule name -> number of placeholders
+	redacted     int               // number of redacted matches
+}
+
+// Redact replaces all matches of the redactor's rules in text with placeholders.
+func (s *Session) Redact(text string) string {
+	for _, rule := range s.redactor.rules {
+		text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.valid != nil && !rule.valid(match) {
+				return match
+			}
+			return s.placeholder(rule.name, match)
+		})
+	}
+	return text
+}
+
+// Matches reports whether Redact would replace anything in text. No placeholders are created,
+// so checking a text that is not sent does not change the session.
+func (s *Session) Matches(text string) bool {
+	for _, rule := range s.redactor.rules {
+		for _, match := range rule.pattern.FindAllString(text, -1) {
+			if rule.valid == nil || rule.valid(match) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Restore replaces all placeholders in text with their original values.
+func (s *Session) Restore(text string) string {
+	if len(s.values) == 0 {
+		return text
+	}
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		if value, ok := s.values[placeholder]; ok {
+			return value
+		}
+		return placeholder
+	})
+}
+
+// Count returns the number of matches that were redacted.
+func (s *Session) Count() int {
+	return s.redacted
+}
+
+func (s *Session) placeholder(name, value string) string {
+	s.redacted++
+	if !s.redactor.reversible {
+		return "[REDACTED_" + name + "]"
+	}
+	if placeholder, ok := s.placeholders[value]; ok {
+		return placeholder
+	}
+	s.counts[name]++
+	placeholder := fmt.Sprintf("[REDACTED_%s_%d]", name, s.counts[name])
+	s.placeholders[value] = placeholder
+	s.values[placeholder] = value
+	return placeholder
+}
+
+var (
+	placeholderPattern = regexp.MustCompile(`\[REDACTED_[A-Z0-9_]+_[0-9]+\]`)
+	nonWordPattern     = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// luhn validates a card number candidate using the Luhn checksum.
+func luhn(match string) bool {
+	sum, digits := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
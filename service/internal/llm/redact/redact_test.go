@@ -0,0 +1,93 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+)
+
+func newSession(t *testing.T, reversible bool) *Session {
+	t.Helper()
+	r, err := New(Config{Enabled: true, Reversible: reversible})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.NewSession()
+}
+
+func TestRedact(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		reversible bool
+		input      string
+		want       string
+	}{
+		{"email", true, "mail me at jane@example.com", "mail me at [REDACTED_EMAIL_1]"},
+		{"same value same placeholder", true, "a@b.io and a@b.io", "[REDACTED_EMAIL_1] and [REDACTED_EMAIL_1]"},
+		{"distinct values", true, "a@b.io and c@d.io", "[REDACTED_EMAIL_1] and [REDACTED_EMAIL_2]"},
+		{"api key", true, "key sk-ant-REDACTED", "key [REDACTED_API_KEY_1]"},
+		{"valid card", true, "card 4111 1111 1111 1111", "card [REDACTED_CARD_NUMBER_1]"},
+		{"invalid card", true, "order 1234 5678 9012 3456", "order 1234 5678 9012 3456"},
+		{"irreversible", false, "a@b.io and c@d.io", "[REDACTED_EMAIL] and [REDACTED_EMAIL]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newSession(t, tt.reversible).Redact(tt.input); got != tt.want {
+				t.Errorf("Redact(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+
+}
+
+func TestRestorer(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{"whole placeholder", []string{"hi [REDACTED_EMAIL_1]!"}, "hi jane@example.com!"},
+		{"split placeholder", []string{"hi [RED", "ACTED_EM", "AIL_1] bye"}, "hi jane@example.com bye"},
+		{"split at bracket", []string{"hi [", "REDACTED_EMAIL_1]"}, "hi jane@example.com"},
+		{"unknown placeholder", []string{"[REDACTED_EMAIL_9]"}, "[REDACTED_EMAIL_9]"},
+		{"bracket without placeholder", []string{"a [b", "] c"}, "a [b] c"},
+		{"held back until flush", []string{"end [REDACTED_"}, "end [REDACTED_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := newSession(t, true)
+			s.Redact("jane@example.com")
+			r := s.Restorer()
+
+			var out strings.Builder
+			for _, content := range tt.chunks {
+				chunks, err := r.Intercept(stream.Chunk{Content: content})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, c := range chunks {
+					out.WriteString(c.Content)
+				}
+			}
+			chunks, err := r.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range chunks {
+				out.WriteString(c.Content)
+			}
+
+			if out.String() != tt.want {
+				t.Errorf("restored %q, want %q", out.String(), tt.want)
+			}
+
+		})
+	}
+
+}
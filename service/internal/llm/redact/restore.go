@@ -0,0 +1,72 @@
+package redact
+
+import (
+	"strings"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
+)
+
+// maxPlaceholderLength limits how much text is held back while waiting for a placeholder to complete.
+const maxPlaceholderLength = 64
+
+// Restorer returns a stream interceptor that replaces the session's
+// placeholders in the streamed response with their original values.
+func (s *Session) Restorer() stream.Interceptor {
+	return &restorer{session: s}
+}
+
+// restorer holds back text at the end of a chunk that could be the beginning
+// of a placeholder, since placeholders may be split across chunks. Reasoning
+// blocks are passed on untouched, as their signature covers the redacted text.
+type restorer struct {
+	session   *Session
+	content   string
+	reasoning string
+}
+
+func (r *restorer) Intercept(c stream.Chunk) ([]stream.Chunk, error) {
+	c.Content, r.content = r.restore(r.content + c.Content)
+	c.Reasoning, r.reasoning = r.restore(r.reasoning + c.Reasoning)
+	if c.Empty() {
+		return nil, nil
+	}
+	return []stream.Chunk{c}, nil
+}
+
+func (r *restorer) Flush() ([]stream.Chunk, error) {
+	c := stream.Chunk{
+		Content:   r.session.Restore(r.content),
+		Reasoning: r.session.Restore(r.reasoning),
+	}
+	r.content, r.reasoning = "", ""
+	if c.Empty() {
+		return nil, nil
+	}
+	return []stream.Chunk{c}, nil
+}
+
+// restore restores the placeholders in text and returns the trailing part that has to be held back.
+func (r *restorer) restore(text string) (string, string) {
+	var held string
+	if i := strings.LastIndex(text, "["); i >= 0 && len(text)-i < maxPlaceholderLength && isPlaceholderPrefix(text[i:]) {
+		text, held = text[:i], text[i:]
+	}
+	return r.session.Restore(text), held
+}
+
+// isPlaceholderPrefix reports whether s could still grow into a placeholder.
+func isPlaceholderPrefix(s string) bool {
+	const prefix = "[REDACTED_"
+	if len(s) <= len(prefix) {
+		return strings.HasPrefix(prefix, s)
+	}
+	if !strings.HasPrefix(s, prefix) {
+		return false
+	}
+	for _, c := range s[len(prefix):] {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -2,22 +2,39 @@ package llm
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/provider/anthropic"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/provider/gemini"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/provider/ollama"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/redact"
 	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/stream"
 )
 
 type ModelRouter struct {
-	models map[string]Model
+	models       map[string]Model
+	interceptors map[string]InterceptorFactory
+	redactor     *redact.Redactor
 }
 
 func NewModelRouter() *ModelRouter {
-	return &ModelRouter{
-		models: make(map[string]Model),
+	mr := &ModelRouter{
+		models:       make(map[string]Model),
+		interceptors: make(map[string]InterceptorFactory),
 	}
+	mr.RegisterInterceptor("close_code_fences", NewCodeFenceCloser)
+	return mr
+}
+
+// SetRedactor sets the redactor applied to requests that leave the server, see isLocal.
+func (mr *ModelRouter) SetRedactor(r *redact.Redactor) {
+	mr.redactor = r
+}
+
+// RegisterInterceptor makes an interceptor available to the models under the given name.
+func (mr *ModelRouter) RegisterInterceptor(name string, factory InterceptorFactory) {
+	mr.interceptors[name] = factory
 }
 
 func (mr *ModelRouter) AddModel(key string, model Model) {
@@ -33,14 +50,31 @@ func (mr *ModelRouter) ListModels() map[string]Model {
 	return mr.models
 }
 
+// StreamCompletion routes the request to the model's provider. The interceptors are
+// applied after the ones configured for the model.
 // TODO: Add Provider interface definition for the llm providers.
-func (mr *ModelRouter) StreamCompletion(req chat.Request, opt chat.Options) (*stream.Stream, error) {
+func (mr *ModelRouter) StreamCompletion(req chat.Request, opt chat.Options, interceptors ...stream.Interceptor) (*stream.Stream, error) {
+
+	s := stream.New()
+	if err := mr.Start(s, req, opt, interceptors...); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+
+}
+
+// Start streams the completion into an existing stream, e.g. one that subscribers
+// could already join while the request was queued. The stream is failed on error.
+func (mr *ModelRouter) Start(s *stream.Stream, req chat.Request, opt chat.Options, interceptors ...stream.Interceptor) error {
 
 	// Get the model that was requested.
 	// Return error if model does not exists.
 	model, ok := mr.models[req.Model]
 	if !ok {
-		return nil, fmt.Errorf("%w: %s", ErrUnsupportedModel, req.Model)
+		err := fmt.Errorf("%w: %s", ErrUnsupportedModel, req.Model)
+		s.Fail(err)
+		return err
 	}
 
 	// Replace router with provider model name.
@@ -51,16 +85,100 @@ func (mr *ModelRouter) StreamCompletion(req chat.Request, opt chat.Options) (*st
 		req.ReasoningEffort = 0
 	}
 
+	// Enable code execution for models that support it
+	req.CodeExecution = model.Features.HasCodeExecution
+
+	// Create the interceptors configured for the model before anything is published.
+	chain := make([]stream.Interceptor, 0, len(model.Interceptors)+len(interceptors))
+	for _, name := range model.Interceptors {
+		factory, ok := mr.interceptors[name]
+		if !ok {
+			err := fmt.Errorf("%w: %s", ErrUnknownInterceptor, name)
+			s.Fail(err)
+			return err
+		}
+		chain = append(chain, factory())
+	}
+	chain = append(chain, interceptors...)
+
+	// Redact secrets and personal data before the request leaves the server.
+	if mr.redactor != nil && !isLocal(model, opt) {
+		session := mr.redactor.NewSession()
+		req = redactRequest(req, session)
+		if mr.redactor.Reversible() && session.Count() > 0 {
+			s.Use(session.Restorer()) // Restore placeholders before any other interceptor sees the chunks
+		}
+	}
+
+	s.Use(chain...)
+
 	// Route the request to the corrosponding model provider.
+	var err error
 	switch model.Provider {
 	case Gemini:
-		return gemini.StreamCompletion(req, opt) // Handle request with Gemini
+		err = gemini.StreamCompletion(s, req, opt) // Handle request with Gemini
 	case Anthropic:
-		return anthropic.StreamCompletion(req, opt) // Handle request with Ollama
+		err = anthropic.StreamCompletion(s, req, opt) // Handle request with Anthropic
 	case Ollama:
-		return ollama.StreamCompletion(req, opt) // Handle request with Anthropic
+		err = ollama.StreamCompletion(s, req, opt) // Handle request with Ollama
 	default:
-		return nil, fmt.Errorf("%w: %s", ErrUnsupportedModel, model.Provider) // THIS SHOULD NEVER HAPPEN!!!
+		err = fmt.Errorf("%w: %s", ErrUnsupportedProvider, model.Provider) // THIS SHOULD NEVER HAPPEN!!!
+	}
+	if err != nil {
+		s.Fail(err)
+		return err
+	}
+
+	return nil
+
+}
+
+// isLocal reports whether the model is served on this host, so requests to it do not leave the server.
+// Ollama servers can be anywhere, the user's own as well as the configured one.
+func isLocal(model Model, opt chat.Options) bool {
+
+	if model.Provider != Ollama {
+		return false
 	}
 
+	baseURL, err := ollama.BaseURL(opt)
+	if err != nil {
+		return false
+	}
+
+	host := baseURL.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+
+}
+
+// redactRequest returns a copy of the request with all texts redacted,
+// leaving the caller's messages untouched. Signed thinking blocks cannot be altered,
+// so they are not replayed if they contain anything that would be redacted.
+func redactRequest(req chat.Request, session *redact.Session) chat.Request {
+	req.System = session.Redact(req.System)
+	messages := make([]*chat.Message, len(req.Messages))
+	for i, message := range req.Messages {
+		m := *message
+		m.Content = session.Redact(m.Content)
+		m.Reasoning = session.Redact(m.Reasoning)
+		for _, block := range m.ReasoningBlocks {
+			if block.Thinking != "" && session.Matches(block.Thinking) {
+				m.ReasoningBlocks = nil
+				break
+			}
+		}
+		m.Attachments = make([]*chat.Attachment, len(message.Attachments))
+		for j, attachment := range message.Attachments {
+			a := *attachment
+			a.Text = session.Redact(a.Text)
+			m.Attachments[j] = &a
+		}
+		messages[i] = &m
+	}
+	req.Messages = messages
+	return req
 }
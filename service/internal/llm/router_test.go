@@ -0,0 +1,82 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/redact"
+)
+
+func TestRedactRequest(t *testing.T) {
+
+	redactor, err := redact.New(redact.Config{Enabled: true, Reversible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		thinking   string
+		wantBlocks int
+	}{
+		{"clean thinking is replayed", "the user wants a poem", 1},
+		{"thinking with a secret is dropped", "the user's email is jane@example.com", 0},
+		{"placeholders are replayed", "the user's email is [REDACTED_EMAIL_1]", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			original := &chat.Message{
+				Role:            "assistant",
+				Content:         "write to jane@example.com",
+				ReasoningBlocks: []chat.ReasoningBlock{{Type: "thinking", Thinking: tt.thinking, Signature: "sig"}},
+				Attachments:     []*chat.Attachment{{Name: "a.txt", Text: "jane@example.com"}},
+			}
+			session := redactor.NewSession()
+			req := redactRequest(chat.Request{Messages: []*chat.Message{original}}, session)
+
+			m := req.Messages[0]
+			if m.Content != "write to [REDACTED_EMAIL_1]" || m.Attachments[0].Text != "[REDACTED_EMAIL_1]" {
+				t.Errorf("texts not redacted: %q, %q", m.Content, m.Attachments[0].Text)
+			}
+			if len(m.ReasoningBlocks) != tt.wantBlocks {
+				t.Errorf("got %d reasoning blocks, want %d", len(m.ReasoningBlocks), tt.wantBlocks)
+			}
+			if session.Count() != 2 {
+				t.Errorf("got %d redactions, want 2 for the sent texts", session.Count())
+			}
+			if original.Content != "write to jane@example.com" || len(original.ReasoningBlocks) != 1 || original.Attachments[0].Text != "jane@example.com" {
+				t.Error("original message was modified")
+			}
+
+		})
+	}
+
+}
+
+func TestIsLocal(t *testing.T) {
+
+	t.Setenv("OLLAMA_BASE_URL", "http://localhost:11434")
+
+	tests := []struct {
+		name  string
+		model Model
+		opt   chat.Options
+		want  bool
+	}{
+		{"configured local server", Model{Provider: Ollama}, nil, true},
+		{"user's loopback server", Model{Provider: Ollama}, chat.Options{"ollama_base_url": "http://127.0.0.1:11434"}, true},
+		{"user's IPv6 loopback server", Model{Provider: Ollama}, chat.Options{"ollama_base_url": "http://[::1]:11434"}, true},
+		{"user's remote server", Model{Provider: Ollama}, chat.Options{"ollama_base_url": "https://ollama.example.com"}, false},
+		{"user's network server", Model{Provider: Ollama}, chat.Options{"ollama_base_url": "http://192.168.1.20:11434"}, false},
+		{"hosted provider", Model{Provider: Anthropic}, nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := isLocal(tt.model, tt.opt); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+}
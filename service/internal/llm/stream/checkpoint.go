@@ -0,0 +1,59 @@
+package stream
+
+import (
+	"time"
+)
+
+// CheckpointFunc is called with the accumulated cache of a running stream.
+type CheckpointFunc func(Chunk)
+
+// checkpointer decides when the cache of a stream is checkpointed. Its state
+// is only accessed by the read loop of the stream.
+type checkpointer struct {
+	interval time.Duration // Checkpoint if this much time passed since the last checkpoint
+	bytes    int           // Checkpoint if this many bytes were emitted since the last checkpoint
+	fn       CheckpointFunc
+
+	last   time.Time
+	size   int // Size of the cache at the last checkpoint
+	blocks int // Number of blocks at the last checkpoint
+}
+
+func (c *checkpointer) due(cache Chunk, now time.Time) bool {
+	size := len(cache.Content) + len(cache.Reasoning)
+	if size == c.size && len(cache.Blocks) == c.blocks {
+		return false
+	}
+	return (c.interval > 0 && now.Sub(c.last) >= c.interval) ||
+		(c.bytes > 0 && size-c.size >= c.bytes) ||
+		len(cache.Blocks) != c.blocks
+}
+
+// OnCheckpoint sets a function that is called with the accumulated cache
+// whenever interval has passed or bytes of text were emitted since the last
+// checkpoint. A zero value disables the respective trigger. Checkpoints are
+// taken by the read loop, so they never overlap and always precede the
+// close func.
+func (s *Stream) OnCheckpoint(interval time.Duration, bytes int, fn CheckpointFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpointer = &checkpointer{
+		interval: interval,
+		bytes:    bytes,
+		fn:       fn,
+		last:     time.Now(),
+	}
+}
+
+// checkpoint calls the checkpoint func if a checkpoint is due.
+func (s *Stream) checkpoint() {
+	now := time.Now()
+	s.mu.RLock()
+	c, cache := s.checkpointer, s.cache
+	s.mu.RUnlock()
+	if c == nil || !c.due(cache, now) {
+		return
+	}
+	c.last, c.size, c.blocks = now, len(cache.Content)+len(cache.Reasoning), len(cache.Blocks)
+	c.fn(cache)
+}
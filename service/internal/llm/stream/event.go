@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"context"
+	"errors"
+)
+
+// EventType is the kind of an event. It is used as the SSE event name.
+type EventType string
+
+const (
+	EventContentDelta   EventType = "content_delta"
+	EventReasoningDelta EventType = "reasoning_delta"
+	EventToolCall       EventType = "tool_call"
+	EventCitation       EventType = "citation"
+	EventImage          EventType = "image"
+	EventBlock          EventType = "block" // Code, code results and files
+	EventUsage          EventType = "usage"
+	EventStatus         EventType = "status"
+	EventPosition       EventType = "position" // Position in the queue while the generation waits for a free slot
+	EventError          EventType = "error"
+	EventSnapshot       EventType = "snapshot" // Replaces everything received before, sent after events were dropped
+)
+
+var (
+	// ErrCanceled is the error of a stream that was canceled by the user.
+	ErrCanceled = errors.New("stream canceled by user")
+	// ErrAborted is the error of a stream that was aborted because the server shut down.
+	ErrAborted = errors.New("stream aborted by server shutdown")
+)
+
+// Event is a single typed update sent to the subscribers of a stream.
+type Event struct {
+	Type     EventType `json:"type"`
+	Seq      int       `json:"seq"`                 // Sequence number within the stream, used as SSE event id
+	Delta    string    `json:"delta,omitempty"`     // content_delta and reasoning_delta
+	ToolCall *ToolCall `json:"tool_call,omitempty"` // tool_call
+	Citation *Citation `json:"citation,omitempty"`  // citation
+	Block    *Block    `json:"block,omitempty"`     // image and block
+	Usage    *Usage    `json:"usage,omitempty"`     // usage
+	Status   string    `json:"status,omitempty"`    // status, "streaming" once a queued generation starts, then one of "done", "blocked", "canceled", "aborted" or "error"
+	Position int       `json:"position,omitempty"`  // position
+	Error    string    `json:"error,omitempty"`     // error, a stable code, see ErrorCode
+	Snapshot *Chunk    `json:"snapshot,omitempty"`  // snapshot
+}
+
+// ToolCall is a function call requested by the model.
+type ToolCall struct {
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Offset    int            `json:"offset"` // In UTF-8 bytes of the content, like Block.Offset
+}
+
+// Citation references a source the model used for the content before its offset.
+type Citation struct {
+	Title     string `json:"title,omitempty"`
+	URL       string `json:"url,omitempty"`
+	CitedText string `json:"cited_text,omitempty"`
+	Offset    int    `json:"offset"` // In UTF-8 bytes of the content, like Block.Offset
+}
+
+// Usage summarizes the metrics of a finished stream.
+type Usage struct {
+	OutputTokens     int     `json:"output_tokens"`
+	TimeToFirstToken int64   `json:"ttft_ms"`
+	Duration         int64   `json:"duration_ms"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+}
+
+// Events splits the chunk into typed events. Content is sent before the
+// blocks, tool calls and citations of the chunk since their offsets include it.
+func (c Chunk) Events() []Event {
+	var events []Event
+	if c.Reasoning != "" {
+		events = append(events, Event{Type: EventReasoningDelta, Delta: c.Reasoning})
+	}
+	if c.Content != "" {
+		events = append(events, Event{Type: EventContentDelta, Delta: c.Content})
+	}
+	for i := range c.Blocks {
+		typ := EventBlock
+		if c.Blocks[i].Type == "image" {
+			typ = EventImage
+		}
+		events = append(events, Event{Type: typ, Block: &c.Blocks[i]})
+	}
+	for i := range c.ToolCalls {
+		events = append(events, Event{Type: EventToolCall, ToolCall: &c.ToolCalls[i]})
+	}
+	for i := range c.Citations {
+		events = append(events, Event{Type: EventCitation, Citation: &c.Citations[i]})
+	}
+	return events
+}
+
+// Status returns the final status of a stream that ended with err.
+func Status(err error) string {
+	var ierr *InterceptError
+	switch {
+	case err == nil:
+		return "done"
+	case errors.As(err, &ierr):
+		return "blocked"
+	case errors.Is(err, ErrCanceled), errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrAborted):
+		return "aborted"
+	default:
+		return "error"
+	}
+}
+
+// ErrorCode returns the code of a stream error that is sent to the subscribers. Errors of
+// the providers may contain internal details, so they are only logged and reported as
+// "generation_failed".
+func ErrorCode(err error) string {
+	var ierr *InterceptError
+	switch {
+	case errors.As(err, &ierr) && ierr.Reason != "":
+		return ierr.Reason
+	case errors.Is(err, ErrCanceled), errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrAborted):
+		return "aborted"
+	default:
+		return "generation_failed"
+	}
+}
+
+// finalEvents returns the events that conclude a stream.
+func finalEvents(m Metrics, err error) []Event {
+	events := []Event{{
+		Type: EventUsage,
+		Usage: &Usage{
+			OutputTokens:     m.OutputTokens,
+			TimeToFirstToken: m.TimeToFirstToken().Milliseconds(),
+			Duration:         m.Duration().Milliseconds(),
+			TokensPerSecond:  m.TokensPerSecond(),
+		},
+	}}
+	if err != nil {
+		events = append(events, Event{Type: EventError, Error: ErrorCode(err)})
+	}
+	return append(events, Event{Type: EventStatus, Status: Status(err)})
+}
@@ -0,0 +1,55 @@
+package stream
+
+import (
+	"fmt"
+)
+
+// Interceptor sits between a provider's Publish and the fan-out to subscribers.
+// Interceptors are only ever called from the stream's read loop, so they don't
+// need to be safe for concurrent use, but every stream needs its own instance.
+type Interceptor interface {
+	// Intercept is called for every published chunk and returns the chunks that
+	// are passed on. Returning no chunks drops (or buffers) the chunk, returning
+	// an error terminates the stream.
+	Intercept(c Chunk) ([]Chunk, error)
+	// Flush is called once the provider closed the stream and returns any
+	// chunks that are still buffered.
+	Flush() ([]Chunk, error)
+}
+
+// InterceptorFunc adapts a plain function to the Interceptor interface.
+// It does not buffer, so Flush is a no-op.
+type InterceptorFunc func(c Chunk) ([]Chunk, error)
+
+func (f InterceptorFunc) Intercept(c Chunk) ([]Chunk, error) {
+	return f(c)
+}
+
+func (f InterceptorFunc) Flush() ([]Chunk, error) {
+	return nil, nil
+}
+
+// InterceptError is returned by interceptors to terminate a stream,
+// e.g. when a moderation check blocks the response.
+type InterceptError struct {
+	Interceptor string // Name of the interceptor that terminated the stream
+	Reason      string // Machine readable reason, e.g. "blocked"
+	Message     string // Human readable description
+}
+
+func (e *InterceptError) Error() string {
+	return fmt.Sprintf("stream terminated by %s (%s): %s", e.Interceptor, e.Reason, e.Message)
+}
+
+// intercept passes the chunks through a single interceptor.
+func intercept(ic Interceptor, chunks []Chunk) ([]Chunk, error) {
+	var out []Chunk
+	for _, c := range chunks {
+		next, err := ic.Intercept(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, next...)
+	}
+	return out, nil
+}
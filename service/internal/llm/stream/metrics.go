@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"time"
+)
+
+// Metrics holds the timing information recorded while a stream is running.
+type Metrics struct {
+	StartedAt      time.Time `json:"started_at"`
+	FirstTokenAt   time.Time `json:"first_token_at,omitzero"`   // First chunk carrying reasoning or content
+	FirstContentAt time.Time `json:"first_content_at,omitzero"` // First chunk carrying content (after reasoning)
+	FinishedAt     time.Time `json:"finished_at,omitzero"`
+	OutputTokens   int       `json:"output_tokens"` // Reported by the provider or estimated on finish
+}
+
+// TimeToFirstToken returns the time between starting the stream and receiving the first token.
+func (m Metrics) TimeToFirstToken() time.Duration {
+	if m.FirstTokenAt.IsZero() {
+		return 0
+	}
+	return m.FirstTokenAt.Sub(m.StartedAt)
+}
+
+// TimeToFirstContent returns the time between starting the stream and receiving the first content token.
+func (m Metrics) TimeToFirstContent() time.Duration {
+	if m.FirstContentAt.IsZero() {
+		return 0
+	}
+	return m.FirstContentAt.Sub(m.StartedAt)
+}
+
+// Duration returns the total time the stream was running.
+func (m Metrics) Duration() time.Duration {
+	if m.FinishedAt.IsZero() {
+		return time.Since(m.StartedAt)
+	}
+	return m.FinishedAt.Sub(m.StartedAt)
+}
+
+// TokensPerSecond returns the generation speed measured from the first token until the stream finished.
+func (m Metrics) TokensPerSecond() float64 {
+	if m.FirstTokenAt.IsZero() || m.FinishedAt.IsZero() || m.OutputTokens == 0 {
+		return 0
+	}
+	seconds := m.FinishedAt.Sub(m.FirstTokenAt).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(m.OutputTokens) / seconds
+}
+
+// record updates the first token timestamps for an incoming chunk.
+func (m *Metrics) record(c Chunk, now time.Time) {
+	if m.FirstTokenAt.IsZero() && (c.Reasoning != "" || c.Content != "") {
+		m.FirstTokenAt = now
+	}
+	if m.FirstContentAt.IsZero() && c.Content != "" {
+		m.FirstContentAt = now
+	}
+}
+
+// finish sets the finish timestamp and estimates the output tokens if the provider did not report them.
+func (m *Metrics) finish(cache Chunk, now time.Time) {
+	m.FinishedAt = now
+	if m.OutputTokens == 0 {
+		// Rough estimate of ~4 characters per token
+		m.OutputTokens = (len(cache.Reasoning) + len(cache.Content) + 3) / 4
+	}
+}
@@ -1,31 +1,91 @@
 package stream
 
 import (
-	"fmt"
+	"cmp"
+	"context"
+	"slices"
 	"sync"
+	"time"
 )
 
+// Info describes a stream in the pool.
+type Info struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ChatID    string `json:"chat_id"`
+	Model     string `json:"model"`
+	CreatedAt int64  `json:"created_at"` // Unix millis
+}
+
+// Entry is a snapshot of a stream in the pool.
+type Entry struct {
+	Info
+	Stats
+	Age int64 `json:"age_ms"`
+}
+
+// PoolStats summarizes the streams in the pool.
+type PoolStats struct {
+	Streams     int `json:"streams"`     // Streams in the pool
+	Running     int `json:"running"`     // Streams that are not done yet
+	Finished    int `json:"finished"`    // Done streams waiting for eviction
+	Subscribers int `json:"subscribers"` // Subscribers of all streams
+	Bytes       int `json:"bytes"`       // Accumulated content and reasoning of all streams
+	Evicted     int `json:"evicted"`     // Streams evicted since the pool was created
+}
+
+type poolEntry struct {
+	stream *Stream
+	info   Info
+}
+
 // Stream pool for managing active streams
 type StreamPool struct {
-	streams map[string]*Stream
-	mu      sync.RWMutex
+	streams   map[string]*poolEntry
+	mu        sync.RWMutex
+	retention time.Duration // How long finished streams are kept for late subscribers
+	evicted   int
 }
 
-func NewStreamPool() *StreamPool {
-	return &StreamPool{streams: make(map[string]*Stream)}
+func NewStreamPool(retention time.Duration) *StreamPool {
+	return &StreamPool{
+		streams:   make(map[string]*poolEntry),
+		retention: retention,
+	}
 }
 
-func (p *StreamPool) Add(id string, s *Stream) {
+// Add adds a stream to the pool. It is evicted once it has been done for the retention period.
+func (p *StreamPool) Add(id string, s *Stream, info Info) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.streams[id] = s
+	info.ID = id
+	info.CreatedAt = time.Now().UnixMilli()
+	p.streams[id] = &poolEntry{stream: s, info: info}
+	go func() {
+		s.Wait()
+		time.AfterFunc(p.retention, func() { p.evict(id, s) })
+	}()
 }
 
 func (p *StreamPool) Get(id string) (*Stream, bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	s, ok := p.streams[id]
-	return s, ok
+	e, ok := p.streams[id]
+	if !ok {
+		return nil, false
+	}
+	return e.stream, true
+}
+
+// Info returns the info of the stream with the id.
+func (p *StreamPool) Info(id string) (Info, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e, ok := p.streams[id]
+	if !ok {
+		return Info{}, false
+	}
+	return e.info, true
 }
 
 func (p *StreamPool) Remove(id string) {
@@ -34,22 +94,108 @@ func (p *StreamPool) Remove(id string) {
 	delete(p.streams, id)
 }
 
-func (p *StreamPool) Cancel(id string) {
+// evict removes the stream with the id unless it was replaced in the meantime.
+func (p *StreamPool) evict(id string, s *Stream) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if s, ok := p.streams[id]; ok {
-		s.Fail(fmt.Errorf("stream cancelled by user"))
+	if e, ok := p.streams[id]; ok && e.stream == s {
 		delete(p.streams, id)
+		p.evicted++
+	}
+}
+
+// Cancel cancels a running stream. It stays in the pool until it is evicted.
+func (p *StreamPool) Cancel(id string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if e, ok := p.streams[id]; ok {
+		e.stream.Fail(ErrCanceled)
 	}
 }
 
-func (p *StreamPool) Subscribe(id string) (sub *Subscription, ok bool) {
-	var s *Stream
+func (p *StreamPool) Subscribe(id string, opts SubscribeOptions) (sub *Subscription, ok bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	s, ok = p.streams[id]
+	e, ok := p.streams[id]
 	if ok {
-		return s.Subscribe(10), true // TODO: find a buffer size that works well
+		return e.stream.Subscribe(opts), true
 	}
 	return nil, false
 }
+
+// Shutdown waits until the running streams are done or ctx expires. Streams
+// still running then are aborted with ErrAborted. Shutdown returns once their
+// close funcs were called and reports how many streams were aborted.
+func (p *StreamPool) Shutdown(ctx context.Context) int {
+
+	p.mu.RLock()
+	var running []*Stream
+	for _, e := range p.streams {
+		if !e.stream.Stats().Done {
+			running = append(running, e.stream)
+		}
+	}
+	p.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, s := range running {
+			s.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+
+	aborted := 0
+	for _, s := range running {
+		if !s.Stats().Done {
+			s.Fail(ErrAborted)
+			aborted++
+		}
+	}
+	<-done
+	return aborted
+
+}
+
+// List returns a snapshot of all streams in the pool, oldest first.
+func (p *StreamPool) List() []Entry {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now().UnixMilli()
+	list := make([]Entry, 0, len(p.streams))
+	for _, e := range p.streams {
+		list = append(list, Entry{
+			Info:  e.info,
+			Stats: e.stream.Stats(),
+			Age:   now - e.info.CreatedAt,
+		})
+	}
+	slices.SortFunc(list, func(a, b Entry) int {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	})
+	return list
+}
+
+// Stats returns a summary of the streams in the pool.
+func (p *StreamPool) Stats() PoolStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := PoolStats{Streams: len(p.streams), Evicted: p.evicted}
+	for _, e := range p.streams {
+		s := e.stream.Stats()
+		if s.Done {
+			stats.Finished++
+		} else {
+			stats.Running++
+		}
+		stats.Subscribers += s.Subscribers
+		stats.Bytes += s.Bytes
+	}
+	return stats
+}
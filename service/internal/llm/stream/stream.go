@@ -2,21 +2,55 @@ package stream
 
 import (
 	"context"
-	"fmt"
 	"slices"
 	"sync"
+	"time"
+
+	"github.com/Hinkolas/t3-chat-cloneathon/service/internal/llm/chat"
 )
 
 type CloseFunc func(Chunk, error)
 
 type Chunk struct {
-	Reasoning string `json:"reasoning,omitempty"`
-	Content   string `json:"content,omitempty"`
+	Reasoning       string                `json:"reasoning,omitempty"`
+	Content         string                `json:"content,omitempty"`
+	Blocks          []Block               `json:"blocks,omitempty"`
+	ToolCalls       []ToolCall            `json:"tool_calls,omitempty"`
+	Citations       []Citation            `json:"citations,omitempty"`
+	ReasoningBlocks []chat.ReasoningBlock `json:"-"` // Completed reasoning blocks, only needed to replay them to the provider
+}
+
+// Block is a structured, non-text part of a response.
+type Block struct {
+	Type   string `json:"type"`   // "code", "code_result", "image" or "file"
+	Offset int    `json:"offset"` // Length of the content in UTF-8 bytes when the block was emitted, used to interleave blocks with the content
+
+	// Code and code execution results
+	Language string `json:"language,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Outcome  string `json:"outcome,omitempty"`
+	Output   string `json:"output,omitempty"`
+
+	// Images and files
+	MimeType     string `json:"mime_type,omitempty"`
+	Data         []byte `json:"-"` // Inline data, replaced by an attachment before it is persisted
+	AttachmentID string `json:"attachment_id,omitempty"`
+	Src          string `json:"src,omitempty"`
+}
+
+// Empty reports whether the chunk carries no data.
+func (c Chunk) Empty() bool {
+	return c.Reasoning == "" && c.Content == "" && len(c.Blocks) == 0 && len(c.ToolCalls) == 0 &&
+		len(c.Citations) == 0 && len(c.ReasoningBlocks) == 0
 }
 
 func (c *Chunk) append(c2 Chunk) {
 	c.Reasoning += c2.Reasoning
 	c.Content += c2.Content
+	c.Blocks = append(c.Blocks, c2.Blocks...)
+	c.ToolCalls = append(c.ToolCalls, c2.ToolCalls...)
+	c.Citations = append(c.Citations, c2.Citations...)
+	c.ReasoningBlocks = append(c.ReasoningBlocks, c2.ReasoningBlocks...)
 }
 
 // Stream represents one ongoing streaming process.
@@ -24,33 +58,28 @@ type Stream struct {
 	mu        sync.RWMutex
 	wg        sync.WaitGroup
 	closeOnce sync.Once
+	endOnce   sync.Once
 
-	cache Chunk
-	done  bool
-	err   error
+	cache      Chunk
+	log        []Event // The latest events sent to subscribers, at most maxLogEvents
+	seq        int     // Sequence number of the last event
+	contentSeq int     // Sequence number of the last event emitted for a chunk
+	done       bool
+	err        error
+	metrics    Metrics
 
-	pub       chan Chunk
-	subs      []chan Chunk
-	closeFunc CloseFunc
+	pub          chan Chunk
+	end          chan struct{}
+	subs         []*subscriber
+	closeFunc    CloseFunc
+	checkpointer *checkpointer
+	interceptors []Interceptor
 
 	// new fields for cancellation
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
-type Subscription struct {
-	ch     chan Chunk
-	cancel func()
-}
-
-func (s *Subscription) Cancel() {
-	s.cancel()
-}
-
-func (s *Subscription) Read() <-chan Chunk {
-	return s.ch
-}
-
 // New creates a Stream with a background context.
 func New() *Stream {
 	return NewWithContext(context.Background())
@@ -61,31 +90,123 @@ func NewWithContext(parent context.Context) *Stream {
 	ctx, cancel := context.WithCancel(parent)
 	s := &Stream{
 		cache:     Chunk{},
+		metrics:   Metrics{StartedAt: time.Now()},
 		pub:       make(chan Chunk),
+		end:       make(chan struct{}),
 		closeFunc: func(Chunk, error) {},
 		ctx:       ctx,
 		cancel:    cancel,
 	}
 	s.wg.Add(1)
-	go func() {
-		defer s.wg.Done()
-		for chunk := range s.pub {
-			s.emit(chunk)
-		}
-		s.finish()
-	}()
+	go s.run()
 	return s
 }
 
+// run is the read loop of the stream. It passes published chunks through
+// the interceptors and emits them until the stream is closed or canceled.
+func (s *Stream) run() {
+	defer s.wg.Done()
+	defer s.finish()
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.setError(context.Cause(s.ctx))
+			return
+		case <-s.end:
+			s.flush()
+			return
+		case chunk := <-s.pub:
+			chunks, err := s.intercept(chunk)
+			if err != nil {
+				s.setError(err)
+				return
+			}
+			for _, c := range chunks {
+				s.emit(c)
+			}
+			s.await()
+			s.checkpoint()
+		}
+	}
+}
+
 // Context returns the Stream's context.
 func (s *Stream) Context() context.Context {
 	return s.ctx
 }
 
-func (s *Stream) OnClose(fn CloseFunc) {
+// Metrics returns a snapshot of the stream's timing metrics.
+func (s *Stream) Metrics() Metrics {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.metrics
+}
+
+// ResetStartTime sets the start time of the metrics to now, e.g. after the stream waited in a queue.
+func (s *Stream) ResetStartTime() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics.StartedAt = time.Now()
+}
+
+// SetOutputTokens stores the number of output tokens reported by the provider.
+func (s *Stream) SetOutputTokens(n int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.metrics.OutputTokens = n
+}
+
+// Stats holds the size and state of a stream.
+type Stats struct {
+	Bytes       int  `json:"bytes"`       // Accumulated content and reasoning
+	Events      int  `json:"events"`      // Events sent to subscribers
+	Subscribers int  `json:"subscribers"` // Current subscribers
+	Done        bool `json:"done"`
+}
+
+// Stats returns the current size and state of the stream.
+func (s *Stream) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return Stats{
+		Bytes:       len(s.cache.Content) + len(s.cache.Reasoning),
+		Events:      s.seq,
+		Subscribers: len(s.subs),
+		Done:        s.done,
+	}
+}
+
+// OnClose sets the function called once the stream is done.
+// If the stream is already done, fn is called immediately.
+func (s *Stream) OnClose(fn CloseFunc) {
+	s.mu.Lock()
+	if s.done {
+		cache, err := s.cache, s.err
+		s.mu.Unlock()
+		fn(cache, err)
+		return
+	}
 	s.closeFunc = fn
+	s.mu.Unlock()
+}
+
+// Use appends interceptors to the stream's chain. Chunks pass through
+// them in the order they were added. Use must be called before the
+// first chunk is published.
+func (s *Stream) Use(interceptors ...Interceptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// Notify sends an event that is not part of the content, e.g. a queue
+// position, to all subscribers. It is ignored once the stream is done.
+func (s *Stream) Notify(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		s.dispatch([]Event{e})
+	}
 }
 
 // Publish sends a chunk unless the stream has been canceled.
@@ -98,65 +219,186 @@ func (s *Stream) Publish(c Chunk) {
 	}
 }
 
-// Subscribe returns a channel on which the caller will receive all past and future chunks
-func (s *Stream) Subscribe(buffer int) *Subscription {
-	ch := make(chan Chunk, buffer)
+// Subscribe returns a subscription on which the caller will receive all past and future events.
+// Past events after opts.After are replayed from the log. Without a sequence number that is
+// still in the log, the subscriber receives a snapshot of the cache instead.
+func (s *Stream) Subscribe(opts SubscribeOptions) *Subscription {
 	s.mu.Lock()
-	ch <- s.cache
-	s.subs = append(s.subs, ch)
-	s.mu.Unlock()
-	return &Subscription{ch, func() { s.unsubscribe(ch) }}
+	defer s.mu.Unlock()
+	var past []Event
+	if first := s.seq - len(s.log); opts.After > 0 && opts.After >= first && opts.After <= s.seq {
+		past = slices.Clone(s.log[opts.After-first:])
+	} else {
+		past = s.snapshot()
+	}
+	sub := newSubscriber(opts)
+	sub.push(past)
+	if s.done {
+		sub.end()
+	} else {
+		s.subs = append(s.subs, sub)
+	}
+	return &Subscription{sub, func() { s.unsubscribe(sub, nil) }}
 }
 
-// unsubscribe removes ch from s.subs and closes it.
-func (s *Stream) unsubscribe(ch chan Chunk) {
+// unsubscribe removes sub from s.subs and closes it with err.
+// The caller must not hold the lock.
+func (s *Stream) unsubscribe(sub *subscriber, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// find & remove
-	for i, c := range s.subs {
-		if c == ch {
-			s.subs = slices.Delete(s.subs, i, i+1)
-			close(ch)
-			return
-		}
+	s.remove(sub, err)
+}
+
+// remove removes sub from s.subs and closes it with err. Subscribers of a
+// finished stream are stopped too, dropping the events they did not read.
+// The caller must hold the lock.
+func (s *Stream) remove(sub *subscriber, err error) {
+	if i := slices.Index(s.subs, sub); i >= 0 {
+		s.subs = slices.Delete(s.subs, i, i+1)
 	}
+	sub.stop(err)
 }
 
 // Wait blocks until the stream is done. It returns any error.
 func (s *Stream) Wait() error {
 	s.wg.Wait()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.err
 }
 
+// Fail terminates the stream with the given error.
 func (s *Stream) Fail(err error) {
 	s.setError(err)
 	s.cancel() // unblock any upstream readers
-	s.finish()
 }
 
-// Closes the stream and all subscriber channels. Should be called ofter stream is done.
+// Close signals that the provider is done publishing. Buffered chunks
+// are flushed from the interceptors before the subscribers are closed.
 func (s *Stream) Close() {
-	s.cancel()
-	s.finish()
+	s.endOnce.Do(func() {
+		close(s.end)
+	})
+}
+
+// intercept passes a published chunk through the interceptor chain.
+func (s *Stream) intercept(chunk Chunk) ([]Chunk, error) {
+	chunks := []Chunk{chunk}
+	for _, ic := range s.interceptors {
+		var err error
+		if chunks, err = intercept(ic, chunks); err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// flush releases the chunks buffered by the interceptors. Chunks flushed
+// by one interceptor still pass through all interceptors after it.
+func (s *Stream) flush() {
+	var chunks []Chunk
+	for _, ic := range s.interceptors {
+		var err error
+		if chunks, err = intercept(ic, chunks); err != nil {
+			s.setError(err)
+			return
+		}
+		flushed, err := ic.Flush()
+		if err != nil {
+			s.setError(err)
+			return
+		}
+		chunks = append(chunks, flushed...)
+	}
+	for _, c := range chunks {
+		s.emit(c)
+	}
+	s.await()
 }
 
-// emit is called for each incoming chunk.
-// It appends to the buffer, fans out to all
-// subscriber chans, and invokes handlers.
+// emit is called for each chunk leaving the interceptor chain.
+// It appends to the buffer and fans out its events to all subscriber chans.
+// Offsets count the UTF-8 bytes of the content, not characters. JavaScript clients have to
+// encode the content, e.g. with TextEncoder, before using them to split it.
 func (s *Stream) emit(chunk Chunk) {
 	s.mu.Lock()
-	// s.chunks = append(s.chunks, chunk)
-	s.cache.append(chunk)        // accumulate into cache for Close
-	subs := slices.Clone(s.subs) // snapshot subscribers
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	s.metrics.record(chunk, time.Now())
+	offset := len(s.cache.Content) + len(chunk.Content)
+	if len(chunk.Blocks) > 0 {
+		chunk.Blocks = slices.Clone(chunk.Blocks)
+		for i := range chunk.Blocks {
+			chunk.Blocks[i].Offset = offset
+		}
+	}
+	if len(chunk.ToolCalls) > 0 {
+		chunk.ToolCalls = slices.Clone(chunk.ToolCalls)
+		for i := range chunk.ToolCalls {
+			chunk.ToolCalls[i].Offset = offset
+		}
+	}
+	if len(chunk.Citations) > 0 {
+		chunk.Citations = slices.Clone(chunk.Citations)
+		for i := range chunk.Citations {
+			chunk.Citations[i].Offset = offset
+		}
+	}
+	s.cache.append(chunk) // accumulate into cache for Close
+	events := s.record(chunk.Events())
+	// The cache and the log have to agree before a resync takes a snapshot
+	s.contentSeq = s.seq
+	s.broadcast(events)
+}
 
-	// fan-out to subscribers (best-effort)
-	for _, ch := range subs {
-		select {
-		case ch <- chunk:
-		default:
-			// TODO: Handle subscriber not keeping up (e.g. cancel subscription)
-			fmt.Println("subscriber is slow, blocking on chunk")
+// maxLogEvents is the number of events kept for replay. Once the log is full, its older half is
+// dropped, subscribers resuming before the remaining events receive a snapshot instead.
+const maxLogEvents = 1024
+
+// record assigns sequence numbers to the events and appends them to the log.
+// The caller must hold the lock.
+func (s *Stream) record(events []Event) []Event {
+	for i := range events {
+		s.seq++
+		events[i].Seq = s.seq
+		s.log = append(s.log, events[i])
+	}
+	if len(s.log) > maxLogEvents {
+		s.log = slices.Clone(s.log[len(s.log)-maxLogEvents/2:])
+	}
+	return events
+}
+
+// dispatch records the events and broadcasts them. The caller must hold the lock.
+func (s *Stream) dispatch(events []Event) {
+	s.broadcast(s.record(events))
+}
+
+// snapshot returns the events a subscriber needs to catch up with the stream:
+// a snapshot of the cache followed by the latest event of each type logged
+// after the last chunk, e.g. the current queue position and status. It always
+// fits the buffer of a subscription. The caller must hold the lock.
+func (s *Stream) snapshot() []Event {
+	var events []Event
+	if s.contentSeq > 0 {
+		cache := s.cache
+		events = append(events, Event{Type: EventSnapshot, Seq: s.contentSeq, Snapshot: &cache})
+	}
+	first := s.seq - len(s.log)
+	trailing := s.log[max(s.contentSeq-first, 0):]
+	for i, e := range trailing {
+		if !slices.ContainsFunc(trailing[i+1:], func(later Event) bool { return later.Type == e.Type }) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// broadcast queues events for all subscribers, applying the backpressure
+// policy of subscribers that are not keeping up. The caller must hold the lock.
+func (s *Stream) broadcast(events []Event) {
+	for _, sub := range slices.Clone(s.subs) {
+		if sub.push(events) {
+			s.backpressure(sub)
 		}
 	}
 }
@@ -170,17 +412,23 @@ func (s *Stream) setError(err error) {
 }
 
 // finish is called exactly once when the read loop terminates.
-// It marks done and closes every subscriber channel.
+// It marks done, cancels the context, sends the final usage and status
+// events and closes every subscriber channel.
+// The close func is called after the lock is released,
+// so it may safely use the stream's accessors.
 func (s *Stream) finish() {
 	s.closeOnce.Do(func() {
 		s.mu.Lock()
-		defer s.mu.Unlock()
 		s.done = true
-		close(s.pub)
-		for _, ch := range s.subs {
-			close(ch)
+		s.metrics.finish(s.cache, time.Now())
+		s.cancel()
+		s.dispatch(finalEvents(s.metrics, s.err))
+		for _, sub := range s.subs {
+			sub.end()
 		}
 		s.subs = nil
-		s.closeFunc(s.cache, s.err)
+		cache, err, closeFunc := s.cache, s.err, s.closeFunc
+		s.mu.Unlock()
+		closeFunc(cache, err)
 	})
 }
@@ -0,0 +1,286 @@
+package stream
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// received rebuilds the content a client sees from the events of a subscription,
+// failing on events that go back in the log.
+func received(t *testing.T, sub *Subscription) (content string, blocks int, status string) {
+	t.Helper()
+	var seq int
+	for e := range sub.Read() {
+		if e.Seq < seq {
+			t.Errorf("event %d (%s) received after event %d", e.Seq, e.Type, seq)
+		}
+		seq = e.Seq
+		switch e.Type {
+		case EventSnapshot:
+			content, blocks = e.Snapshot.Content, len(e.Snapshot.Blocks)
+		case EventContentDelta:
+			content += e.Delta
+		case EventBlock:
+			blocks++
+		case EventStatus:
+			status = e.Status
+		}
+	}
+	return content, blocks, status
+}
+
+func publish(s *Stream, n int) {
+	for i := 0; i < n; i++ {
+		s.Publish(Chunk{Content: "x", Blocks: []Block{{Type: "code", Code: "y"}}})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		after int
+		want  string
+	}{
+		{"snapshot without sequence number", 0, "xxx"},
+		{"replay after sequence number", 2, "xx"}, // The first chunk was sent as events 1 and 2
+		{"unknown sequence number", 100, "xxx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s := New()
+			publish(s, 3)
+			s.Close()
+			s.Wait()
+
+			content, _, status := received(t, s.Subscribe(SubscribeOptions{After: tt.after}))
+			if content != tt.want || status != "done" {
+				t.Errorf("got %q with status %q, want %q with status done", content, status, tt.want)
+			}
+
+		})
+	}
+
+}
+
+// A subscriber that does not read falls behind in the middle of a chunk, as each chunk
+// is sent as a content and a block event. The resync must neither lose nor repeat content.
+func TestResyncMidChunk(t *testing.T) {
+
+	for _, chunks := range []int{minBuffer/2 + 1, minBuffer, 3 * minBuffer, 100} {
+
+		s := New()
+		sub := s.Subscribe(SubscribeOptions{Policy: PolicyResync})
+		publish(s, chunks)
+		s.Close()
+		s.Wait()
+
+		content, blocks, status := received(t, sub)
+		if content != strings.Repeat("x", chunks) || blocks != chunks {
+			t.Errorf("%d chunks: got %d characters and %d blocks", chunks, len(content), blocks)
+		}
+		if status != "done" || sub.Err() != nil {
+			t.Errorf("%d chunks: got status %q and error %v", chunks, status, sub.Err())
+		}
+
+	}
+
+}
+
+func TestPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy  Policy
+		wantErr error
+	}{
+		{PolicyResync, nil},
+		{PolicyDisconnect, ErrSlowSubscriber},
+		{PolicyBlock, ErrSlowSubscriber},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+
+			s := New()
+			slow := s.Subscribe(SubscribeOptions{Policy: tt.policy, Timeout: 200 * time.Millisecond})
+			fast := s.Subscribe(SubscribeOptions{Policy: PolicyResync})
+			result := make(chan string)
+			go func() {
+				content, _, _ := received(t, fast)
+				result <- content
+			}()
+
+			go func() {
+				publish(s, 3*minBuffer)
+				s.Close()
+			}()
+
+			// A blocked subscriber must not hold up anything but the publisher
+			time.Sleep(20 * time.Millisecond)
+			start := time.Now()
+			s.Stats()
+			s.Notify(Event{Type: EventPosition, Position: 1})
+			if d := time.Since(start); d > 50*time.Millisecond {
+				t.Errorf("Stats and Notify took %v while a subscriber was behind", d)
+			}
+
+			s.Wait()
+			if content := <-result; content != strings.Repeat("x", 3*minBuffer) {
+				t.Errorf("other subscriber got %d characters", len(content))
+			}
+
+			for range slow.Read() {
+			}
+			if slow.Err() != tt.wantErr {
+				t.Errorf("got error %v, want %v", slow.Err(), tt.wantErr)
+			}
+
+		})
+	}
+
+}
+
+func TestBlockCatchesUp(t *testing.T) {
+
+	s := New()
+	sub := s.Subscribe(SubscribeOptions{Policy: PolicyBlock, Timeout: time.Second})
+	go func() {
+		publish(s, 5*minBuffer)
+		s.Close()
+	}()
+
+	// Read slowly, the publisher has to wait instead of dropping anything
+	var content string
+	for e := range sub.Read() {
+		if e.Type == EventSnapshot {
+			t.Fatal("blocking subscriber received a snapshot")
+		}
+		content += e.Delta
+		time.Sleep(time.Millisecond)
+	}
+
+	if content != strings.Repeat("x", 5*minBuffer) || sub.Err() != nil {
+		t.Errorf("got %d characters and error %v", len(content), sub.Err())
+	}
+
+}
+
+func TestCancelStopsDelivery(t *testing.T) {
+
+	s := New()
+	sub := s.Subscribe(SubscribeOptions{})
+	publish(s, 2)
+	sub.Cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for range sub.Read() {
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed after Cancel")
+	}
+
+	s.Close()
+	s.Wait()
+
+}
+
+// Errors of the providers are reported to the subscribers as stable codes only.
+func TestErrorEvent(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.New("dial tcp 10.0.0.7:443: connection refused"), "generation_failed"},
+		{&InterceptError{Interceptor: "moderation", Reason: "blocked", Message: "flagged as harmful"}, "blocked"},
+		{ErrCanceled, "canceled"},
+		{ErrAborted, "aborted"},
+	}
+
+	for _, tt := range tests {
+
+		s := New()
+		sub := s.Subscribe(SubscribeOptions{})
+		s.Fail(tt.err)
+		s.Close()
+
+		var got []string
+		for e := range sub.Read() {
+			if e.Type == EventError {
+				got = append(got, e.Error)
+			}
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%v: got error events %q, want %q", tt.err, got, tt.want)
+		}
+
+	}
+
+}
+
+// The log keeps the latest events only, subscribers resuming from an older event get a snapshot.
+func TestLogLimit(t *testing.T) {
+
+	s := New()
+	publish(s, maxLogEvents) // Two events per chunk
+	s.Close()
+	s.Wait()
+
+	if n := len(s.log); n > maxLogEvents {
+		t.Errorf("got %d events in the log, want at most %d", n, maxLogEvents)
+	}
+	last := s.Stats().Events
+
+	tests := []struct {
+		name  string
+		after int
+		want  string
+	}{
+		{"dropped sequence number", 2, strings.Repeat("x", maxLogEvents)},
+		{"kept sequence number", last - 4, "x"}, // The last chunk, then the usage and status events
+	}
+
+	for _, tt := range tests {
+		content, _, status := received(t, s.Subscribe(SubscribeOptions{After: tt.after, Buffer: maxLogEvents}))
+		if content != tt.want || status != "done" {
+			t.Errorf("%s: got %d characters with status %q, want %d with status done", tt.name, len(content), status, len(tt.want))
+		}
+	}
+
+}
+
+// Offsets count UTF-8 bytes, so multibyte characters before a block count more than once.
+func TestBlockOffsets(t *testing.T) {
+
+	s := New()
+	s.Publish(Chunk{Content: "Grüße 👋"})
+	s.Publish(Chunk{Content: "\n", Blocks: []Block{{Type: "code", Code: "x"}}, Citations: []Citation{{URL: "https://example.com"}}})
+	s.Publish(Chunk{Content: "Ende"})
+	s.Close()
+	s.Wait()
+
+	var cache Chunk
+	s.OnClose(func(c Chunk, err error) { cache = c })
+
+	want := len("Grüße 👋\n") // 14 bytes for 9 characters
+	if got := cache.Blocks[0].Offset; got != want {
+		t.Errorf("got block offset %d, want %d", got, want)
+	}
+	if got := cache.Citations[0].Offset; got != want {
+		t.Errorf("got citation offset %d, want %d", got, want)
+	}
+	if before := cache.Content[:cache.Blocks[0].Offset]; before != "Grüße 👋\n" {
+		t.Errorf("got content %q before the block", before)
+	}
+
+}
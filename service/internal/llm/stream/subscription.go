@@ -0,0 +1,233 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Policy defines how a stream treats a subscriber that is not keeping up.
+type Policy string
+
+const (
+	// PolicyResync drops the pending events of the subscriber and replaces
+	// them with a snapshot of the accumulated cache, so no content is lost.
+	PolicyResync Policy = "resync"
+	// PolicyBlock blocks the stream until the subscriber catches up or the
+	// timeout expires, after which the subscriber is disconnected.
+	PolicyBlock Policy = "block"
+	// PolicyDisconnect disconnects the subscriber immediately.
+	PolicyDisconnect Policy = "disconnect"
+)
+
+// ParsePolicy returns the policy with the given name.
+func ParsePolicy(name string) (Policy, bool) {
+	switch p := Policy(name); p {
+	case PolicyResync, PolicyBlock, PolicyDisconnect:
+		return p, true
+	default:
+		return "", false
+	}
+}
+
+// ErrSlowSubscriber is the error of a subscription that was disconnected
+// because it did not keep up with the stream.
+var ErrSlowSubscriber = errors.New("subscriber did not keep up with the stream")
+
+// minBuffer is the smallest buffer of a subscription. It has to fit a
+// snapshot followed by the latest event of every other type.
+const minBuffer = 8
+
+type SubscribeOptions struct {
+	Buffer  int           // Number of events buffered for the subscriber
+	After   int           // Sequence number of the last event the subscriber received, e.g. from Last-Event-ID
+	Policy  Policy        // Applied when the buffer is full, defaults to PolicyResync
+	Timeout time.Duration // How long PolicyBlock waits for the subscriber
+}
+
+// subscriber queues the events of one subscription. The stream only appends to the
+// queue while holding its lock, a sender goroutine delivers them on ch, so a slow
+// subscriber never blocks the stream or other subscribers.
+type subscriber struct {
+	ch   chan Event
+	opts SubscribeOptions
+
+	mu     sync.Mutex
+	queue  []Event
+	ending bool  // Close ch once the queue is delivered
+	err    error // Set before ch is closed if the subscriber was disconnected
+
+	wake     chan struct{} // Signals the sender that events were queued
+	sent     chan struct{} // Signals waiting publishers that an event was delivered
+	quit     chan struct{} // Closed to stop the sender without delivering the queue
+	stopOnce sync.Once
+}
+
+func newSubscriber(opts SubscribeOptions) *subscriber {
+	opts.Buffer = max(opts.Buffer, minBuffer)
+	sub := &subscriber{
+		ch:   make(chan Event),
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		sent: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	go sub.run()
+	return sub
+}
+
+// run delivers the queued events until the subscriber is stopped or ended.
+func (sub *subscriber) run() {
+	defer close(sub.ch)
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			ending := sub.ending
+			sub.mu.Unlock()
+			if ending {
+				return
+			}
+			select {
+			case <-sub.wake:
+				continue
+			case <-sub.quit:
+				return
+			}
+		}
+		e := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+		select {
+		case sub.ch <- e:
+			signal(sub.sent)
+		case <-sub.quit:
+			return
+		}
+	}
+}
+
+// push queues events and reports whether the subscriber fell behind by more than its buffer.
+func (sub *subscriber) push(events []Event) bool {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, events...)
+	behind := len(sub.queue) > sub.opts.Buffer
+	sub.mu.Unlock()
+	signal(sub.wake)
+	return behind
+}
+
+// replace drops the queued events in favor of events.
+func (sub *subscriber) replace(events []Event) {
+	sub.mu.Lock()
+	sub.queue = events
+	sub.mu.Unlock()
+	signal(sub.wake)
+}
+
+// end closes the subscriber once the queued events are delivered.
+func (sub *subscriber) end() {
+	sub.mu.Lock()
+	sub.ending = true
+	sub.mu.Unlock()
+	signal(sub.wake)
+}
+
+// stop closes the subscriber with err, dropping the queued events.
+func (sub *subscriber) stop(err error) {
+	sub.stopOnce.Do(func() {
+		sub.mu.Lock()
+		sub.err = err
+		sub.mu.Unlock()
+		close(sub.quit)
+	})
+}
+
+// wait blocks until the subscriber's queue fits its buffer again or the stream is done.
+// It reports false if the timeout expired first.
+func (sub *subscriber) wait(done <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		sub.mu.Lock()
+		caughtUp := len(sub.queue) <= sub.opts.Buffer
+		sub.mu.Unlock()
+		if caughtUp {
+			return true
+		}
+		select {
+		case <-sub.sent:
+		case <-sub.quit:
+			return true
+		case <-done:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// signal notifies the receiver of ch without blocking, signals are not counted.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+type Subscription struct {
+	sub    *subscriber
+	cancel func()
+}
+
+func (s *Subscription) Cancel() {
+	s.cancel()
+}
+
+func (s *Subscription) Read() <-chan Event {
+	return s.sub.ch
+}
+
+// Err returns ErrSlowSubscriber if the subscription was disconnected by its
+// backpressure policy. It must only be called after the channel was closed.
+func (s *Subscription) Err() error {
+	s.sub.mu.Lock()
+	defer s.sub.mu.Unlock()
+	return s.sub.err
+}
+
+// backpressure applies the policy of a subscriber whose queue exceeds its buffer.
+// The caller must hold the lock.
+func (s *Stream) backpressure(sub *subscriber) {
+	switch sub.opts.Policy {
+	case PolicyBlock:
+		// The publisher waits for the subscriber once the lock is released, see await
+	case PolicyDisconnect:
+		s.remove(sub, ErrSlowSubscriber)
+	default:
+		s.resync(sub)
+	}
+}
+
+// resync replaces the queued events of a subscriber with a snapshot of the cache.
+// The caller must hold the lock.
+func (s *Stream) resync(sub *subscriber) {
+	sub.replace(s.snapshot())
+}
+
+// await blocks until the subscribers with PolicyBlock caught up and disconnects those
+// that did not within their timeout. The caller must not hold the lock.
+func (s *Stream) await() {
+	s.mu.RLock()
+	var blocking []*subscriber
+	for _, sub := range s.subs {
+		if sub.opts.Policy == PolicyBlock {
+			blocking = append(blocking, sub)
+		}
+	}
+	s.mu.RUnlock()
+	for _, sub := range blocking {
+		if !sub.wait(s.ctx.Done(), sub.opts.Timeout) {
+			s.unsubscribe(sub, ErrSlowSubscriber)
+		}
+	}
+}